@@ -8,47 +8,9 @@ import (
 	"time"
 )
 
-// NOTE: All admin handlers are wrapped with RequireAdmin - RBAC enforced server-side.
-
-// RequireAdmin returns a handler that only allows admin users
-func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		_, role, ok := GetSessionUser(r)
-		if !ok {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Unauthorized", "authed": false})
-			return
-		}
-		if role != RoleAdmin {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusForbidden)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Admin access required"})
-			return
-		}
-		next(w, r)
-	}
-}
-
-// RequireAgentOrAdmin returns a handler that allows agent or admin
-func RequireAgentOrAdmin(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		_, role, ok := GetSessionUser(r)
-		if !ok {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Unauthorized", "authed": false})
-			return
-		}
-		if role != RoleAdmin && role != RoleSRM {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusForbidden)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Agent or Admin access required"})
-			return
-		}
-		next(w, r)
-	}
-}
+// NOTE: All admin handlers are mounted by the /api/admin group in Routes(),
+// which requires one of adminConsolePermissions unless a route names its own
+// Permissions - RBAC enforced server-side.
 
 func adminDashboard(w http.ResponseWriter, r *http.Request) {
 	settings := StoreGetGlobalSettings()
@@ -72,11 +34,20 @@ func adminDashboard(w http.ResponseWriter, r *http.Request) {
 		"sessionsToday":  today,
 		"pendingReviews": pending,
 		"activeAgents":   len(agents),
+		"teams":          summarizeTeams(sessions, todayStart),
 	})
 }
 
+// adminListAgents lists SRMs, or users with ?role= (all staff for role=all)
 func adminListAgents(w http.ResponseWriter, r *http.Request) {
-	list := StoreListUsers(RoleSRM)
+	role := Role(strings.TrimSpace(r.URL.Query().Get("role")))
+	switch role {
+	case "":
+		role = RoleSRM
+	case "all":
+		role = ""
+	}
+	list := StoreListUsers(role)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"agents": list})
 }
@@ -89,6 +60,7 @@ func adminCreateAgent(w http.ResponseWriter, r *http.Request) {
 	var body struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		Role     Role   `json:"role"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -101,18 +73,28 @@ func adminCreateAgent(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "Email required"})
 		return
 	}
-	if len(body.Password) < 6 {
+	body.Password = strings.TrimSpace(body.Password)
+	if msg := currentPasswordPolicy().check(body.Password, email); msg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+	if body.Role == "" {
+		body.Role = RoleSRM
+	}
+	userID, actorRole, _ := GetSessionUser(r)
+	if msg := assignableRole(actorRole, body.Role); msg != "" {
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Password must be at least 6 characters"})
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
 		return
 	}
-	h, err := hashPassword(body.Password)
+	h, err := HashPassword(body.Password)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create agent"})
 		return
 	}
-	u, err := StoreCreateUser(email, RoleSRM, h)
+	u, err := StoreCreateUser(email, body.Role, h)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create agent"})
@@ -123,8 +105,9 @@ func adminCreateAgent(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "Agent with this email already exists"})
 		return
 	}
-	userID, _, _ := GetSessionUser(r)
-	StoreAppendGlobalAudit("admin", userID, "srm_create", map[string]interface{}{"email": email, "id": u.ID})
+	// The admin chose this password, so the user replaces it at first login
+	requirePasswordChange(u)
+	StoreAppendGlobalAudit(string(actorRole), userID, "srm_create", map[string]interface{}{"email": email, "id": u.ID, "role": u.Role})
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -149,22 +132,63 @@ func adminUpdateAgent(w http.ResponseWriter, r *http.Request) {
 	var body struct {
 		Active   *bool   `json:"active"`
 		Password *string `json:"password"`
+		Role     *Role   `json:"role"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
 		return
 	}
+	userID, actorRole, _ := GetSessionUser(r)
+	target := StoreGetUser(agentID)
+	if target == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Agent not found"})
+		return
+	}
+	// The actor may only manage users whose current role they could assign,
+	// so resetting a password cannot take over a more privileged account
+	if msg := assignableRole(actorRole, target.Role); msg != "" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+	var newHash string
+	if body.Password != nil {
+		pw := strings.TrimSpace(*body.Password)
+		if msg := currentPasswordPolicy().check(pw, target.Email); msg != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": msg})
+			return
+		}
+		newHash, _ = HashPassword(pw)
+	}
+	if body.Role != nil {
+		if msg := assignableRole(actorRole, *body.Role); msg != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": msg})
+			return
+		}
+	}
+	var oldRole Role
+	history := currentPasswordPolicy().History
 	ok := StoreUpdateUser(agentID, func(u *User) bool {
-		if u.Role != RoleSRM {
+		// Admin accounts are managed through the env seed only, service
+		// accounts through /service-accounts
+		if u.Role == RoleAdmin || u.Role == RoleClient || u.Service || u.Role != target.Role {
 			return false
 		}
+		oldRole = u.Role
+		if body.Role != nil {
+			u.Role = *body.Role
+		}
 		if body.Active != nil {
 			u.Active = *body.Active
 		}
-		if body.Password != nil && len(*body.Password) >= 6 {
-			h, _ := hashPassword(*body.Password)
-			u.Password = h
+		if newHash != "" {
+			// A reset password is temporary; the user must replace it
+			setPassword(u, newHash, history)
+			u.MustChangePassword = true
 		}
 		return true
 	})
@@ -173,12 +197,20 @@ func adminUpdateAgent(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "Agent not found"})
 		return
 	}
-	userID, _, _ := GetSessionUser(r)
 	if body.Active != nil {
-		StoreAppendGlobalAudit("admin", userID, "srm_toggle", map[string]interface{}{"agentId": agentID, "active": *body.Active})
+		StoreAppendGlobalAudit(string(actorRole), userID, "srm_toggle", map[string]interface{}{"agentId": agentID, "active": *body.Active})
+		if !*body.Active {
+			revokeLoginsFor(r, agentID, "", "deactivated")
+		}
 	}
 	if body.Password != nil {
-		StoreAppendGlobalAudit("admin", userID, "srm_password_reset", map[string]interface{}{"agentId": agentID})
+		StoreAppendGlobalAudit(string(actorRole), userID, "srm_password_reset", map[string]interface{}{"agentId": agentID})
+		revokeLoginsFor(r, agentID, "", "password_reset")
+	}
+	if body.Role != nil && *body.Role != oldRole {
+		StoreAppendGlobalAudit(string(actorRole), userID, "user_role_change", map[string]interface{}{"agentId": agentID, "from": oldRole, "to": *body.Role})
+		// Logins carry the role they were opened with
+		revokeLoginsFor(r, agentID, "", "role_change")
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
@@ -186,6 +218,7 @@ func adminUpdateAgent(w http.ResponseWriter, r *http.Request) {
 
 func adminGetSettings(w http.ResponseWriter, r *http.Request) {
 	s := StoreGetGlobalSettings()
+	s.TurnSecret = ""
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(s)
 }
@@ -201,6 +234,9 @@ func adminSetSettings(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
 		return
 	}
+	if s.TurnSecret == "" {
+		s.TurnSecret = StoreGetGlobalSettings().TurnSecret
+	}
 	StoreSetGlobalSettings(&s)
 	userID, _, _ := GetSessionUser(r)
 	StoreAppendGlobalAudit("admin", userID, "settings_update", map[string]interface{}{"companyName": s.CompanyName})
@@ -230,8 +266,9 @@ func adminCreateDocument(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "Title required"})
 		return
 	}
-	StoreSaveDocument(&d)
 	userID, _, _ := GetSessionUser(r)
+	d.ID, d.UpdatedBy, d.RolledBackFrom = "", userID, 0
+	StoreSaveDocument(&d)
 	StoreAppendGlobalAudit("admin", userID, "document_create", map[string]interface{}{"title": d.Title, "id": d.ID})
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(d)
@@ -261,8 +298,12 @@ func adminUpdateDocument(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
 		return
 	}
-	d.ID = id
+	userID, _, _ := GetSessionUser(r)
+	d.ID, d.UpdatedBy, d.RolledBackFrom = id, userID, 0
 	StoreSaveDocument(&d)
+	StoreAppendGlobalAudit("admin", userID, "document_update", map[string]interface{}{
+		"id": id, "version": d.Version, "changes": diffDocumentTemplates(*existing, d),
+	})
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(d)
 }
@@ -373,6 +414,7 @@ func adminTerminateSession(w http.ResponseWriter, r *http.Request) {
 	userID, _, _ := GetSessionUser(r)
 	StoreAppendAudit(sessionID, "admin", userID, "admin_terminate", map[string]interface{}{})
 	StoreAppendGlobalAudit("admin", userID, "session_terminate", map[string]interface{}{"sessionId": sessionID})
+	PublishSessionEvent(sessionID, EventSessionTerminated, nil)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
 }
@@ -391,10 +433,21 @@ func adminGetSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	evs := StoreGetAuditEvents(sessionID)
+	// The template versions the client was given, not the current ones
+	var templates []DocumentTemplate
+	for _, a := range s.AppliedDocTemplates {
+		if d := StoreGetDocumentVersion(a.ID, a.Version); d != nil {
+			templates = append(templates, *d)
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"session": s,
-		"audit":   evs,
+		"session":    s,
+		"documentTemplates": templates,
+		"audit":      evs,
+		"recordings": StoreListRecordings(sessionID),
+		"snapshots":  StoreListSnapshots(sessionID),
+		"connectionQuality": summarizeConnStats(StoreGetConnStats(sessionID)),
 	})
 }
 
@@ -418,25 +471,43 @@ func adminReviewSession(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
 		return
 	}
+	// Required checklist items must be in to submit, and settled to approve
+	var missing, added []string
 	ok := StoreUpdateSession(sessionID, func(s *CoBrowseSession) bool {
+		switch SessionStatus(body.Status) {
+		case StatusSubmitted:
+			missing = checklistMissing(s, false)
+		case StatusApproved:
+			missing = checklistMissing(s, true)
+		}
+		if len(missing) > 0 {
+			return false
+		}
 		s.AdminDecision = body.Status
 		s.AdminNotes = body.Notes
 		s.Status = SessionStatus(body.Status)
 		if body.Docs != nil {
 			s.RequestedDocs = append(s.RequestedDocs, body.Docs...)
+			added = requestChecklistDocs(s, body.Docs, userID)
 		}
 		now := time.Now()
 		s.EndedAt = &now
 		return true
 	})
+	if len(missing) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Required documents are not yet satisfied", "missing": missing})
+		return
+	}
 	if !ok {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Session not found"})
 		return
 	}
 	StoreAppendAudit(sessionID, "admin", userID, "admin_review", map[string]interface{}{
-		"status": body.Status, "notes": body.Notes,
+		"status": body.Status, "notes": body.Notes, "checklistAdded": added,
 	})
+	PublishSessionEvent(sessionID, EventReview, map[string]interface{}{"status": body.Status})
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
 }
@@ -0,0 +1,409 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Service accounts let other systems, such as the CRM, call the session API.
+// A service account is a User with Service set and no password; it acts
+// through API keys sent as "Authorization: Bearer lpk_<id>_<secret>". A key
+// grants the permissions in its scopes that the account's role also grants,
+// only on routes with Route.APIKeys, and is rate limited per key on each
+// instance.
+
+const (
+	apiKeyPrefix         = "lpk_"
+	serviceEmailDomain   = "@service.invalid"
+	defaultAPIKeyRate    = 60 // requests per minute
+	maxAPIKeyRate        = 6000
+	apiKeyTouchFrequency = time.Minute
+)
+
+// apiKeyScopes are the permissions a key may carry
+var apiKeyScopes = []Permission{PermSessionCreate, PermSessionReview}
+
+var serviceNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+
+type apiKeyContextKey struct{}
+
+// apiCaller is the API key authenticating a request and its account's role
+type apiCaller struct {
+	Key  APIKey
+	Role Role
+}
+
+var (
+	apiKeyMu      sync.Mutex
+	apiKeyBuckets = make(map[string]*guidanceBucket) // key ID -> token bucket
+)
+
+func hashAPISecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeyToken returns a new key ID and the bearer token carrying it
+func newAPIKeyToken() (id, token, hash string) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id = hex.EncodeToString(b)
+	secret := randomURLToken(32)
+	return id, apiKeyPrefix + id + "_" + secret, hashAPISecret(secret)
+}
+
+// bearerAPIKey returns the API key token of the request, if any
+func bearerAPIKey(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(auth[7:])
+	return token, strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// lookupAPIKey resolves a bearer token to its key and active service account
+func lookupAPIKey(token string) (*APIKey, *User) {
+	parts := strings.SplitN(strings.TrimPrefix(token, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	k := StoreGetAPIKey(parts[0])
+	if k == nil || subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hashAPISecret(parts[1]))) != 1 {
+		return nil, nil
+	}
+	u := StoreGetUser(k.UserID)
+	if u == nil || !u.Service || !u.Active {
+		return nil, nil
+	}
+	return k, u
+}
+
+// allowAPIKey takes one request from the key's bucket and returns how long to
+// wait when it is empty
+func allowAPIKey(k *APIKey) (bool, time.Duration) {
+	limit := float64(k.RateLimit)
+	if limit <= 0 {
+		limit = defaultAPIKeyRate
+	}
+	apiKeyMu.Lock()
+	defer apiKeyMu.Unlock()
+	now := time.Now()
+	b := apiKeyBuckets[k.ID]
+	if b == nil {
+		b = &guidanceBucket{tokens: limit, last: now}
+		apiKeyBuckets[k.ID] = b
+	}
+	b.tokens += now.Sub(b.last).Minutes() * limit
+	if b.tokens > limit {
+		b.tokens = limit
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / limit * float64(time.Minute))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// authenticateAPIKey checks the bearer key of a request to rt. It answers
+// failures itself and returns nil; otherwise it returns the request carrying
+// the caller, or r unchanged when there is no key.
+func authenticateAPIKey(rt Route, w http.ResponseWriter, r *http.Request) *http.Request {
+	token, ok := bearerAPIKey(r)
+	if !ok {
+		return r
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !rt.APIKeys {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "API keys are not accepted on this endpoint"})
+		return nil
+	}
+	k, u := lookupAPIKey(token)
+	if k == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "Invalid API key", "authed": false})
+		return nil
+	}
+	if ok, wait := allowAPIKey(k); !ok {
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": "API key rate limit exceeded"})
+		return nil
+	}
+	now := time.Now()
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= apiKeyTouchFrequency || k.LastUsedIP != loginIP(r) {
+		StoreTouchAPIKey(k.ID, loginIP(r), now)
+	}
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, &apiCaller{Key: *k, Role: u.Role}))
+}
+
+// requestAPIKey returns the API key authenticating r, or nil for a login
+func requestAPIKey(r *http.Request) *apiCaller {
+	c, _ := r.Context().Value(apiKeyContextKey{}).(*apiCaller)
+	return c
+}
+
+// scopedPermissions narrows perms to the scopes of the request's API key
+func scopedPermissions(r *http.Request, perms []Permission) []Permission {
+	c := requestAPIKey(r)
+	if c == nil {
+		return perms
+	}
+	var out []Permission
+	for _, p := range perms {
+		if containsPermission(c.Key.Scopes, p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// requestPermissions lists what role grants, narrowed to the scopes of the
+// request's API key. Handlers deciding what data to return use it rather than
+// the role alone, so a narrowly scoped key never gets the role's full view.
+func requestPermissions(r *http.Request, role Role) []Permission {
+	return scopedPermissions(r, rolePermissions(role))
+}
+
+// requestHasPermission is RoleHasPermission with the API key's scopes applied
+func requestHasPermission(r *http.Request, role Role, p Permission) bool {
+	return containsPermission(requestPermissions(r, role), p)
+}
+
+// withAPIKey adds the request's API key to an audit payload
+func withAPIKey(r *http.Request, payload map[string]interface{}) map[string]interface{} {
+	if c := requestAPIKey(r); c != nil {
+		payload["apiKeyId"] = c.Key.ID
+	}
+	return payload
+}
+
+// serviceAccountView is a service account with its keys
+type serviceAccountView struct {
+	User
+	Name string   `json:"name"`
+	Keys []APIKey `json:"keys"`
+}
+
+func viewServiceAccount(u User) serviceAccountView {
+	return serviceAccountView{User: u, Name: strings.TrimSuffix(u.Email, serviceEmailDomain), Keys: StoreListAPIKeys(u.ID)}
+}
+
+// serviceAccountFromPath returns the service account named by /service-accounts/:id
+func serviceAccountFromPath(w http.ResponseWriter, r *http.Request) *User {
+	u := StoreGetUser(firstSegment(r.URL.Path, "/service-accounts/"))
+	if u == nil || !u.Service {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Service account not found"})
+		return nil
+	}
+	return u
+}
+
+// adminListServiceAccounts handles GET /service-accounts
+func adminListServiceAccounts(w http.ResponseWriter, r *http.Request) {
+	list := []serviceAccountView{}
+	for _, u := range StoreListServiceAccounts() {
+		list = append(list, viewServiceAccount(u))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"serviceAccounts": list, "scopes": apiKeyScopes})
+}
+
+// adminCreateServiceAccount handles POST /service-accounts
+func adminCreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Name string `json:"name"`
+		Role Role   `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	body.Name = strings.ToLower(strings.TrimSpace(body.Name))
+	if !serviceNamePattern.MatchString(body.Name) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Name must be 2-32 lowercase letters, digits, - or _"})
+		return
+	}
+	if body.Role == "" {
+		body.Role = RoleSRM
+	}
+	actorID, actorRole, _ := GetSessionUser(r)
+	if msg := assignableRole(actorRole, body.Role); msg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+	u, err := StoreCreateUser(body.Name+serviceEmailDomain, body.Role, "")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create service account"})
+		return
+	}
+	if u == nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Service account with this name already exists"})
+		return
+	}
+	StoreUpdateUser(u.ID, func(x *User) bool {
+		x.Service = true
+		return true
+	})
+	u.Service = true
+	StoreAppendGlobalAudit(string(actorRole), actorID, "service_account_create", map[string]interface{}{"id": u.ID, "name": body.Name, "role": u.Role})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(viewServiceAccount(*u))
+}
+
+// adminUpdateServiceAccount handles PUT /service-accounts/:id; deactivating
+// an account suspends all its keys
+func adminUpdateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	u := serviceAccountFromPath(w, r)
+	if u == nil {
+		return
+	}
+	var body struct {
+		Active *bool `json:"active"`
+		Role   *Role `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	actorID, actorRole, _ := GetSessionUser(r)
+	if body.Role != nil {
+		if msg := assignableRole(actorRole, *body.Role); msg != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": msg})
+			return
+		}
+	}
+	StoreUpdateUser(u.ID, func(x *User) bool {
+		if body.Role != nil {
+			x.Role = *body.Role
+		}
+		if body.Active != nil {
+			x.Active = *body.Active
+		}
+		return true
+	})
+	if body.Active != nil && *body.Active != u.Active {
+		StoreAppendGlobalAudit(string(actorRole), actorID, "service_account_toggle", map[string]interface{}{"id": u.ID, "active": *body.Active})
+	}
+	if body.Role != nil && *body.Role != u.Role {
+		StoreAppendGlobalAudit(string(actorRole), actorID, "user_role_change", map[string]interface{}{"agentId": u.ID, "from": u.Role, "to": *body.Role})
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
+
+// adminCreateAPIKey handles POST /service-accounts/:id/keys. The response is
+// the only time the token is shown.
+func adminCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !strings.HasSuffix(r.URL.Path, "/keys") {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not found"})
+		return
+	}
+	u := serviceAccountFromPath(w, r)
+	if u == nil {
+		return
+	}
+	var body struct {
+		Name      string       `json:"name"`
+		Scopes    []Permission `json:"scopes"`
+		RateLimit int          `json:"rateLimit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	if len(body.Scopes) == 0 {
+		body.Scopes = []Permission{PermSessionCreate}
+	}
+	for _, p := range body.Scopes {
+		if !containsPermission(apiKeyScopes, p) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unknown API key scope: " + string(p)})
+			return
+		}
+		if !RoleHasPermission(u.Role, p) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "The account's role does not grant " + string(p)})
+			return
+		}
+	}
+	if body.RateLimit == 0 {
+		body.RateLimit = defaultAPIKeyRate
+	}
+	if body.RateLimit < 1 || body.RateLimit > maxAPIKeyRate {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Rate limit must be 1-%d requests per minute", maxAPIKeyRate)})
+		return
+	}
+	actorID, actorRole, _ := GetSessionUser(r)
+	id, token, hash := newAPIKeyToken()
+	k := &APIKey{
+		ID: id, UserID: u.ID, Name: strings.TrimSpace(body.Name), Hash: hash, Scopes: body.Scopes,
+		RateLimit: body.RateLimit, CreatedAt: time.Now(), CreatedBy: actorID,
+	}
+	StoreSaveAPIKey(k)
+	StoreAppendGlobalAudit(string(actorRole), actorID, "api_key_create", map[string]interface{}{
+		"serviceAccountId": u.ID, "apiKeyId": id, "scopes": k.Scopes, "rateLimit": k.RateLimit,
+	})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"key": k, "token": token})
+}
+
+// adminRevokeAPIKey handles DELETE /service-accounts/:id/keys/:keyId
+func adminRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	u := serviceAccountFromPath(w, r)
+	if u == nil {
+		return
+	}
+	keyID := ""
+	if i := strings.Index(r.URL.Path, "/keys/"); i >= 0 {
+		keyID = firstSegment(r.URL.Path[i:], "/keys/")
+	}
+	k := StoreGetAPIKey(keyID)
+	if k == nil || k.UserID != u.ID || !StoreDeleteAPIKey(k.ID) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "API key not found"})
+		return
+	}
+	apiKeyMu.Lock()
+	delete(apiKeyBuckets, k.ID)
+	apiKeyMu.Unlock()
+	actorID, actorRole, _ := GetSessionUser(r)
+	StoreAppendGlobalAudit(string(actorRole), actorID, "api_key_revoke", map[string]interface{}{"serviceAccountId": u.ID, "apiKeyId": k.ID})
+	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
+
+func containsPermission(list []Permission, p Permission) bool {
+	for _, x := range list {
+		if x == p {
+			return true
+		}
+	}
+	return false
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -22,10 +23,29 @@ const (
 )
 
 type sessionInfo struct {
-	Email   string
-	UserID  string
-	Role    Role
-	Expires time.Time
+	Email     string
+	UserID    string
+	Role      Role
+	Method    string    // how the user signed in: password, totp, recovery or oidc
+	Expires   time.Time // absolute end of the login, however active it is
+	CreatedAt time.Time
+	LastSeen  time.Time // slides the idle timeout
+	IP        string
+	UserAgent string
+	savedSeen time.Time // LastSeen as last written to the broker
+}
+
+// awaitingPasswordChange reports whether this login is held back until the
+// user sets a new password. SSO users have no usable local password.
+func (info *sessionInfo) awaitingPasswordChange() bool {
+	return info.Method != "oidc" && needsPasswordChange(info.UserID)
+}
+
+// awaiting2FAEnrollment reports whether this login is held back until the
+// user enrolls a second factor. SSO logins prove the IdP's MFA at sign-in
+// instead (see oidcUser).
+func (info *sessionInfo) awaiting2FAEnrollment() bool {
+	return info.Method != "oidc" && needs2FAEnrollment(info.UserID, info.Role)
 }
 
 var (
@@ -40,13 +60,6 @@ func defaultAgentEmail() string {
 	return "sales@orientfinance.com"
 }
 
-func defaultAgentPassword() string {
-	if p := os.Getenv("AGENT_PASSWORD"); p != "" {
-		return p
-	}
-	return "orient@123"
-}
-
 func adminEmail() string {
 	if e := os.Getenv("ADMIN_EMAIL"); e != "" {
 		return strings.TrimSpace(strings.ToLower(e))
@@ -54,14 +67,8 @@ func adminEmail() string {
 	return "admin@orientfinance.com"
 }
 
-func adminPassword() string {
-	if p := os.Getenv("ADMIN_PASSWORD"); p != "" {
-		return p
-	}
-	return "myadmin123"
-}
-
-func hashPassword(password string) (string, error) {
+// HashPassword returns the bcrypt hash stored for a password
+func HashPassword(password string) (string, error) {
 	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return "", err
@@ -74,70 +81,124 @@ func checkPassword(hashed, plain string) bool {
 	return err == nil
 }
 
-// SeedAdmin ensures an admin user exists from ADMIN_EMAIL/ADMIN_PASSWORD env vars
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// checkNoPassword spends as long as checkPassword, so a login for an unknown
+// email takes as long as one with a wrong password
+func checkNoPassword(plain string) {
+	dummyHashOnce.Do(func() { dummyHash, _ = HashPassword(newSessionID()) })
+	checkPassword(dummyHash, plain)
+}
+
+// seedPasswordHash returns the hash to seed an account with: the bcrypt hash
+// in <env>_HASH (see `laplace hash-password`), else a hash of the plaintext
+// <env>, else of def. isDefault reports the fallback to def, the only case in
+// which the password must be changed at first login. The plaintext is not kept
+// after seeding.
+func seedPasswordHash(env, def string) (hash string, isDefault bool, err error) {
+	if h := strings.TrimSpace(os.Getenv(env + "_HASH")); h != "" {
+		if _, err := bcrypt.Cost([]byte(h)); err != nil {
+			return "", false, fmt.Errorf("%s_HASH is not a bcrypt hash: %v", env, err)
+		}
+		return h, false, nil
+	}
+	pw := strings.TrimSpace(os.Getenv(env))
+	if pw == "" {
+		log.Printf("[seed] %s not set; using the built-in default, which must be changed at first login", env)
+		pw, isDefault = def, true
+	}
+	hash, err = HashPassword(pw)
+	return hash, isDefault, err
+}
+
+// SeedAdmin ensures an admin user exists from ADMIN_EMAIL and
+// ADMIN_PASSWORD or ADMIN_PASSWORD_HASH. It runs once at startup; logins
+// only ever check the stored hash.
 func SeedAdmin() {
 	em := adminEmail()
-	pw := adminPassword()
-	if em == "" || pw == "" {
+	if em == "" {
 		return
 	}
 	u := StoreGetUserByEmail(em)
 	if u != nil && u.Role == RoleAdmin {
 		return
 	}
+	h, isDefault, err := seedPasswordHash("ADMIN_PASSWORD", "myadmin123")
+	if err != nil {
+		log.Printf("[seed] Failed to hash admin password: %v", err)
+		return
+	}
 	if u != nil {
+		history := currentPasswordPolicy().History
 		StoreUpdateUser(u.ID, func(usr *User) bool {
 			usr.Role = RoleAdmin
 			usr.Active = true
-			h, _ := hashPassword(pw)
-			usr.Password = h
+			setPassword(usr, h, history)
+			usr.MustChangePassword = isDefault
 			return true
 		})
 		log.Printf("[seed] Admin user updated: %s", em)
 		return
 	}
-	h, err := hashPassword(pw)
-	if err != nil {
-		log.Printf("[seed] Failed to hash admin password: %v", err)
-		return
-	}
-	_, err = StoreCreateUser(em, RoleAdmin, h)
+	nu, err := StoreCreateUser(em, RoleAdmin, h)
 	if err != nil {
 		log.Printf("[seed] Failed to create admin: %v", err)
 		return
 	}
+	if isDefault {
+		requirePasswordChange(nu)
+	}
 	log.Printf("[seed] Admin user created: %s", em)
 }
 
-// SeedDefaultAgent ensures default agent exists from AGENT_EMAIL/AGENT_PASSWORD
+// SeedDefaultAgent ensures the default agent exists from AGENT_EMAIL and
+// AGENT_PASSWORD or AGENT_PASSWORD_HASH
 func SeedDefaultAgent() {
 	em := defaultAgentEmail()
-	pw := defaultAgentPassword()
 	em = strings.TrimSpace(strings.ToLower(em))
 	u := StoreGetUserByEmail(em)
 	if u != nil && u.Role == RoleSRM {
 		return
 	}
+	h, isDefault, err := seedPasswordHash("AGENT_PASSWORD", "orient@123")
+	if err != nil {
+		log.Printf("[seed] Failed to hash agent password: %v", err)
+		return
+	}
 	if u != nil {
+		history := currentPasswordPolicy().History
 		StoreUpdateUser(u.ID, func(usr *User) bool {
 			usr.Role = RoleSRM
 			usr.Active = true
-			h, _ := hashPassword(pw)
-			usr.Password = h
+			setPassword(usr, h, history)
+			usr.MustChangePassword = isDefault
 			return true
 		})
 		log.Printf("[seed] Agent user updated: %s", em)
 		return
 	}
-	h, err := hashPassword(pw)
-	if err != nil {
-		log.Printf("[seed] Failed to hash agent password: %v", err)
-		return
+	nu, _ := StoreCreateUser(em, RoleSRM, h)
+	if isDefault {
+		requirePasswordChange(nu)
 	}
-	_, _ = StoreCreateUser(em, RoleSRM, h)
 	log.Printf("[seed] Agent user created: %s", em)
 }
 
+// requirePasswordChange makes a new user replace the password someone else
+// chose at first login
+func requirePasswordChange(u *User) {
+	if u == nil {
+		return
+	}
+	StoreUpdateUser(u.ID, func(usr *User) bool {
+		usr.MustChangePassword = true
+		return true
+	})
+}
+
 func newSessionID() string {
 	b := make([]byte, sessionSize)
 	rand.Read(b)
@@ -148,7 +209,7 @@ func setSessionCookie(w http.ResponseWriter, r *http.Request, sessionID string)
 	secure := r.TLS != nil
 	http.SetCookie(w, &http.Cookie{
 		Name:     cookieName,
-		Value:    sessionID,
+		Value:    sealSession(sessionID, lookupSession(sessionID)),
 		Path:     cookiePath,
 		MaxAge:   maxAge,
 		HttpOnly: true,
@@ -167,116 +228,220 @@ func clearSessionCookie(w http.ResponseWriter) {
 	})
 }
 
+// getSessionFromRequest returns the login session ID from the cookie,
+// restoring the login from a sealed cookie when it has been forgotten
 func getSessionFromRequest(r *http.Request) string {
 	c, err := r.Cookie(cookieName)
 	if err != nil || c == nil || c.Value == "" {
 		return ""
 	}
+	if claims := openSession(c.Value); claims != nil {
+		restoreSession(r, claims)
+		return claims.SID
+	}
 	return c.Value
 }
 
 func IsAuthenticated(r *http.Request) bool {
-	sid := getSessionFromRequest(r)
-	if sid == "" {
-		return false
+	_, _, ok := GetSessionUser(r)
+	return ok
+}
+
+func loginKey(sessionID string) string { return "laplace:login:" + sessionID }
+
+func CreateSession(r *http.Request, email, userID string, role Role, method string) string {
+	sid := newSessionID()
+	now := time.Now()
+	info := &sessionInfo{
+		Email:     email,
+		UserID:    userID,
+		Role:      role,
+		Method:    method,
+		Expires:   now.Add(time.Duration(maxAge) * time.Second),
+		CreatedAt: now,
+		LastSeen:  now,
+		IP:        loginIP(r),
+		UserAgent: r.UserAgent(),
+		savedSeen: now,
+	}
+	sessionsMu.Lock()
+	sessions[sid] = info
+	sessionsMu.Unlock()
+	saveSession(sid, info)
+	addUserLogin(userID, sid)
+	return sid
+}
+
+// saveSession shares the login session with other instances until it expires
+func saveSession(sessionID string, info *sessionInfo) {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return
 	}
+	if err := getBroker().Set(loginKey(sessionID), b, time.Until(info.Expires)); err != nil {
+		log.Printf("[auth] Failed to share login session: %v", err)
+	}
+}
+
+// lookupSession returns the login session from the local cache, falling back
+// to the broker for sessions created on another instance
+func lookupSession(sessionID string) *sessionInfo {
 	sessionsMu.RLock()
-	info, ok := sessions[sid]
+	info, ok := sessions[sessionID]
 	sessionsMu.RUnlock()
-	if !ok || info == nil || time.Now().After(info.Expires) {
-		return false
+	if ok {
+		return info
+	}
+	b, ok, err := getBroker().Get(loginKey(sessionID))
+	if err != nil || !ok {
+		return nil
+	}
+	info = &sessionInfo{}
+	if err := json.Unmarshal(b, info); err != nil {
+		return nil
+	}
+	info.savedSeen = info.LastSeen
+	// Users get new IDs when this instance re-seeds them after a restart
+	if StoreGetUser(info.UserID) == nil {
+		if u := StoreGetUserByEmail(info.Email); u != nil {
+			info.UserID = u.ID
+		}
 	}
-	return true
+	sessionsMu.Lock()
+	sessions[sessionID] = info
+	sessionsMu.Unlock()
+	return info
 }
 
-func CreateSession(email, userID string, role Role) string {
-	sid := newSessionID()
+// sessionIdle reports whether the login has gone unused past the idle timeout
+func sessionIdle(info *sessionInfo) bool {
+	sessionsMu.RLock()
+	seen := info.LastSeen
+	sessionsMu.RUnlock()
+	return time.Since(seen) > loginIdleTimeout()
+}
+
+// liveSession returns the login session unless it has expired or been idle
+// too long; idle sessions are destroyed
+func liveSession(sessionID string) *sessionInfo {
+	if sessionID == "" {
+		return nil
+	}
+	info := lookupSession(sessionID)
+	if info != nil && sessionIdle(info) {
+		// Another instance may have renewed the login since it was cached here
+		forgetSession(sessionID)
+		info = lookupSession(sessionID)
+	}
+	if info == nil || time.Now().After(info.Expires) {
+		return nil
+	}
+	if sessionIdle(info) {
+		DestroySession(sessionID)
+		return nil
+	}
+	return info
+}
+
+// validSession returns a copy of the live login session, or nil, and slides
+// its idle timeout. The broker copy is rewritten at most once a minute.
+func validSession(sessionID string) *sessionInfo {
+	info := liveSession(sessionID)
+	if info == nil {
+		return nil
+	}
+	now := time.Now()
 	sessionsMu.Lock()
-	sessions[sid] = &sessionInfo{
-		Email:   email,
-		UserID:  userID,
-		Role:    role,
-		Expires: time.Now().Add(time.Duration(maxAge) * time.Second),
+	info.LastSeen = now
+	save := now.Sub(info.savedSeen) > time.Minute
+	if save {
+		info.savedSeen = now
 	}
+	cp := *info
 	sessionsMu.Unlock()
-	return sid
+	if save {
+		saveSession(sessionID, &cp)
+	}
+	return &cp
 }
 
 func getSessionInfo(sessionID string) (email, userID string, role Role, ok bool) {
-	sessionsMu.RLock()
-	info, ok := sessions[sessionID]
-	sessionsMu.RUnlock()
-	if !ok || info == nil || time.Now().After(info.Expires) {
+	info := validSession(sessionID)
+	if info == nil {
 		return "", "", "", false
 	}
 	return info.Email, info.UserID, info.Role, true
 }
 
+// GetSessionUser returns the logged-in user. A login that must change its
+// password, or whose role requires 2FA, is not authenticated until the user
+// has done so (see loginUser).
 func GetSessionUser(r *http.Request) (userID string, role Role, ok bool) {
-	sid := getSessionFromRequest(r)
-	if sid == "" {
+	if c := requestAPIKey(r); c != nil {
+		return c.Key.UserID, c.Role, true
+	}
+	info := validSession(getSessionFromRequest(r))
+	if info == nil {
 		return "", "", false
 	}
-	_, uid, role, ok := getSessionInfo(sid)
-	return uid, role, ok
+	if info.awaitingPasswordChange() || info.awaiting2FAEnrollment() {
+		return info.UserID, info.Role, false
+	}
+	return info.UserID, info.Role, true
+}
+
+// pendingPasswordChange reports whether the request carries a valid login
+// that is held back by a required password change
+func pendingPasswordChange(r *http.Request) bool {
+	info := validSession(getSessionFromRequest(r))
+	return info != nil && info.awaitingPasswordChange()
+}
+
+// pending2FAEnrollment reports whether the request carries a valid login that
+// is held back only by 2FA enrollment
+func pending2FAEnrollment(r *http.Request) bool {
+	info := validSession(getSessionFromRequest(r))
+	return info != nil && info.awaiting2FAEnrollment()
 }
 
 func DestroySession(sessionID string) {
+	var expires time.Time
+	if info := lookupSession(sessionID); info != nil {
+		removeUserLogin(info.UserID, sessionID)
+		expires = info.Expires
+	}
+	markRevoked(sessionID, expires)
+	forgetSession(sessionID)
+	_ = getBroker().Del(loginKey(sessionID))
+	publishState(stateMessage{Kind: stateLogout, LoginID: sessionID})
+}
+
+// forgetSession drops a login session from this instance's cache
+func forgetSession(sessionID string) {
 	sessionsMu.Lock()
 	delete(sessions, sessionID)
 	sessionsMu.Unlock()
 }
 
+// authenticateUser checks email and password against the stored bcrypt hash.
+// Disabled accounts are only reported once the password is correct.
 func authenticateUser(email, password string) (*User, string) {
-	email = strings.TrimSpace(strings.ToLower(email))
+	email = normalizeEmail(email)
 	password = strings.TrimSpace(password)
 	if email == "" || password == "" {
 		return nil, "Invalid email or password"
 	}
-	// 1. Check admin env (seed)
-	if ae := adminEmail(); ae != "" && email == ae {
-		if adminPassword() == password {
-			u := StoreGetUserByEmail(email)
-			if u == nil {
-				SeedAdmin()
-				u = StoreGetUserByEmail(email)
-			}
-			if u != nil {
-				return u, ""
-			}
-			// Create on the fly if store failed
-			h, _ := hashPassword(password)
-			nu, _ := StoreCreateUser(email, RoleAdmin, h)
-			if nu != nil {
-				return nu, ""
-			}
-		}
-	}
-	// 2. Check agent env
-	ae := defaultAgentEmail()
-	ap := defaultAgentPassword()
-	ae = strings.TrimSpace(strings.ToLower(ae))
-	if email == ae && password == ap {
-		u := StoreGetUserByEmail(email)
-		if u == nil {
-			SeedDefaultAgent()
-			u = StoreGetUserByEmail(email)
-		}
-		if u != nil {
-			return u, ""
-		}
-	}
-	// 3. Check store
 	u := StoreGetUserByEmail(email)
 	if u == nil {
+		checkNoPassword(password)
+		return nil, "Invalid email or password"
+	}
+	if u.Service || !checkPassword(u.Password, password) {
 		return nil, "Invalid email or password"
 	}
 	if !u.Active {
 		return nil, "Account is disabled"
 	}
-	if !checkPassword(u.Password, password) {
-		return nil, "Invalid email or password"
-	}
 	return u, ""
 }
 
@@ -289,33 +454,81 @@ func apiLogin(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if !passwordLoginAllowed() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Password login is disabled; use single sign-on"})
+		return
+	}
 	email := strings.TrimSpace(strings.ToLower(r.FormValue("email")))
 	password := strings.TrimSpace(r.FormValue("password"))
+	ip := loginIP(r)
+	if wait, locked := loginWait(email, ip); wait > 0 {
+		writeLoginThrottled(w, wait, locked)
+		return
+	}
 
 	u, errMsg := authenticateUser(email, password)
 	if u == nil {
+		recordLoginFailure(email, ip, errMsg)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(map[string]string{"error": errMsg})
 		return
 	}
 
-	sid := CreateSession(u.Email, u.ID, u.Role)
-	setSessionCookie(w, r, sid)
-	StoreAppendGlobalAudit(string(u.Role), u.ID, "login", map[string]interface{}{"email": email})
+	// A password that does not meet the current policy still signs in, but
+	// must be replaced before the app can be used
+	if !u.MustChangePassword && currentPasswordPolicy().check(password, u.Email) != "" {
+		requirePasswordChange(u)
+	}
 
-	redirect := "/srm"
-	if u.Role == RoleAdmin {
-		redirect = "/admin"
+	if u.TOTPEnabled {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"mfaRequired": true,
+			"mfaToken":    newMFAChallenge(u.ID),
+		})
+		return
 	}
+	completeLogin(w, r, u, "password")
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
+// startLogin creates the login session and cookie for u once every required
+// factor has been checked, records method in the login audit and returns
+// where the user should go next.
+func startLogin(w http.ResponseWriter, r *http.Request, u *User, method string) string {
+	clearLoginFailures(u.Email)
+	sid := CreateSession(r, u.Email, u.ID, u.Role, method)
+	setSessionCookie(w, r, sid)
+	StoreAppendGlobalAudit(string(u.Role), u.ID, "login", map[string]interface{}{"email": u.Email, "method": method})
+	info := validSession(sid)
+	if info.awaitingPasswordChange() {
+		return "/password"
+	}
+	if info.awaiting2FAEnrollment() {
+		return "/2fa"
+	}
+	return homePath(u.Role)
+}
+
+// completeLogin answers a JSON login request after startLogin
+func completeLogin(w http.ResponseWriter, r *http.Request, u *User, method string) {
+	redirect := startLogin(w, r, u, method)
+	resp := map[string]interface{}{
 		"ok":       true,
 		"redirect": redirect,
 		"role":     string(u.Role),
-	})
+	}
+	switch redirect {
+	case "/password":
+		resp["passwordChangeRequired"] = true
+	case "/2fa":
+		resp["mfaEnrollRequired"] = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
 }
 
 func apiLogout(w http.ResponseWriter, r *http.Request) {
@@ -341,18 +554,23 @@ func ApiAuthCheck(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Content-Type", "application/json")
 	sid := getSessionFromRequest(r)
-	email, userID, role, ok := getSessionInfo(sid)
-	if !ok {
+	info := validSession(sid)
+	if info == nil {
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(map[string]interface{}{"authed": false})
 		return
 	}
 	resp := map[string]interface{}{
-		"authed": true,
-		"role":   string(role),
+		"authed":                 true,
+		"csrfToken":              csrfToken(sid),
+		"role":                   string(info.Role),
+		"permissions":            rolePermissions(info.Role),
+		"home":                   homePath(info.Role),
+		"mfaEnrollRequired":      info.awaiting2FAEnrollment(),
+		"passwordChangeRequired": info.awaitingPasswordChange(),
 		"user": map[string]interface{}{
-			"id":    userID,
-			"email": email,
+			"id":    info.UserID,
+			"email": info.Email,
 		},
 	}
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,341 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlobStore keeps uploaded files. Keys are slash-separated paths chosen by the
+// server, such as sessions/<id>/<file>. The local filesystem store is the
+// default; the S3 store works with AWS and with S3-compatible servers such as
+// MinIO, which also serves as a local stand-in for testing.
+type BlobStore interface {
+	Put(key string, body io.ReadSeeker, contentType string) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// ErrBlobNotFound is returned by Get for a missing key
+var ErrBlobNotFound = errors.New("blob not found")
+
+var (
+	blobStoreMu sync.RWMutex
+	blobStore   BlobStore = &FSBlobStore{Dir: "uploads"}
+)
+
+func getBlobStore() BlobStore {
+	blobStoreMu.RLock()
+	defer blobStoreMu.RUnlock()
+	return blobStore
+}
+
+// SetBlobStore replaces the store for uploaded files
+func SetBlobStore(b BlobStore) {
+	blobStoreMu.Lock()
+	blobStore = b
+	blobStoreMu.Unlock()
+}
+
+// NewBlobStoreFromURL returns the store for a -blob-store flag value:
+// "" or file:///dir for the local filesystem (dir defaults to uploads), or
+// s3://bucket[/prefix]?region=...&endpoint=... for S3. With an endpoint,
+// objects are addressed path-style (endpoint/bucket/key), as MinIO expects.
+// S3 credentials are passed separately.
+func NewBlobStoreFromURL(raw, accessKey, secretKey string) (BlobStore, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return &FSBlobStore{Dir: "uploads"}, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("blob store: %v", err)
+	}
+	switch u.Scheme {
+	case "file":
+		// file://uploads is relative, file:///srv/uploads absolute
+		dir := u.Host + u.Path
+		if dir == "" {
+			dir = "uploads"
+		}
+		return &FSBlobStore{Dir: dir}, nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("blob store: want s3://bucket[/prefix]?region=...&endpoint=...")
+		}
+		if accessKey == "" || secretKey == "" {
+			return nil, fmt.Errorf("blob store: S3 credentials required")
+		}
+		q := u.Query()
+		s := &S3BlobStore{
+			Bucket:    u.Host,
+			Prefix:    strings.Trim(u.Path, "/"),
+			Region:    q.Get("region"),
+			Endpoint:  strings.TrimRight(q.Get("endpoint"), "/"),
+			AccessKey: accessKey,
+			SecretKey: secretKey,
+		}
+		if s.Region == "" {
+			s.Region = "us-east-1"
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("blob store: unsupported scheme %q", u.Scheme)
+}
+
+// FSBlobStore keeps blobs as files under Dir
+type FSBlobStore struct {
+	Dir string
+}
+
+func (s *FSBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(clean)), nil
+}
+
+func (s *FSBlobStore) Put(key string, body io.ReadSeeker, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *FSBlobStore) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (s *FSBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// S3BlobStore keeps blobs as objects in an S3 bucket, signing requests with
+// AWS Signature Version 4
+type S3BlobStore struct {
+	Bucket    string
+	Prefix    string // optional key prefix
+	Region    string
+	Endpoint  string // e.g. http://127.0.0.1:9000; empty for AWS
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3BlobStore) objectURL(key string) string {
+	if s.Prefix != "" {
+		key = s.Prefix + "/" + key
+	}
+	var parts []string
+	for _, p := range strings.Split(key, "/") {
+		parts = append(parts, s3Escape(p))
+	}
+	path := strings.Join(parts, "/")
+	if s.Endpoint != "" {
+		return s.Endpoint + "/" + s3Escape(s.Bucket) + "/" + path
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.Bucket, s.Region, path)
+}
+
+func (s *S3BlobStore) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signV4(req, s.AccessKey, s.SecretKey, s.Region, "s3", payloadHash, time.Now())
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 2 * time.Minute}
+	}
+	return client.Do(req)
+}
+
+func (s *S3BlobStore) Put(key string, body io.ReadSeeker, contentType string) error {
+	h := sha256.New()
+	size, err := io.Copy(h, body)
+	if err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key), ioutil.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := s.do(req, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return s3Error("put", res)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) Get(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrBlobNotFound
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		return nil, s3Error("get", res)
+	}
+	return res.Body, nil
+}
+
+func (s *S3BlobStore) Delete(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 && res.StatusCode != http.StatusNotFound {
+		return s3Error("delete", res)
+	}
+	return nil
+}
+
+func s3Error(op string, res *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	return fmt.Errorf("s3 %s: %s: %s", op, res.Status, strings.TrimSpace(string(b)))
+}
+
+// s3Escape percent-encodes everything but RFC 3986 unreserved characters, as
+// SigV4 canonical URIs require
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// signV4 adds X-Amz-Date and an AWS Signature Version 4 Authorization header
+// to req. It signs Host and every X-Amz-*, Content-Type and Range header.
+func signV4(req *http.Request, accessKey, secretKey, region, service, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method, uri, canonicalQuery(req.URL.Query()), canonHeaders.String(), signed, payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signed, sig))
+}
+
+func canonicalQuery(q url.Values) string {
+	var pairs []string
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
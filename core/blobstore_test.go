@@ -0,0 +1,284 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sigV4Vectors are published AWS Signature Version 4 examples: the first two
+// from the SigV4 test suite (get-vanilla, get-vanilla-query-order-key-case),
+// the rest from the S3 "Signature Calculations for the Authorization Header"
+// examples.
+var sigV4Vectors = []struct {
+	name, method, url, secret, region, service, date string
+	headers                                          map[string]string
+	want                                             string
+}{
+	{
+		name: "get-vanilla", method: "GET", url: "https://example.amazonaws.com/",
+		secret: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", region: "us-east-1", service: "service", date: "20150830T123600Z",
+		want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+	},
+	{
+		name: "get-vanilla-query-order-key-case", method: "GET", url: "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+		secret: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", region: "us-east-1", service: "service", date: "20150830T123600Z",
+		want: "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+	},
+	{
+		name: "s3-get-object", method: "GET", url: "https://examplebucket.s3.amazonaws.com/test.txt",
+		secret: "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", region: "us-east-1", service: "s3", date: "20130524T000000Z",
+		headers: map[string]string{"Range": "bytes=0-9", "X-Amz-Content-Sha256": emptyPayloadHash},
+		want:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20130524/us-east-1/s3/aws4_request, SignedHeaders=host;range;x-amz-content-sha256;x-amz-date, Signature=f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41",
+	},
+	{
+		name: "s3-get-bucket-lifecycle", method: "GET", url: "https://examplebucket.s3.amazonaws.com/?lifecycle",
+		secret: "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", region: "us-east-1", service: "s3", date: "20130524T000000Z",
+		headers: map[string]string{"X-Amz-Content-Sha256": emptyPayloadHash},
+		want:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20130524/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=fea454ca298b7da1c68078a5d1bdbfbbe0d65c699e0f91ac7a200a0136783543",
+	},
+	{
+		name: "s3-list-objects", method: "GET", url: "https://examplebucket.s3.amazonaws.com/?max-keys=2&prefix=J",
+		secret: "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", region: "us-east-1", service: "s3", date: "20130524T000000Z",
+		headers: map[string]string{"X-Amz-Content-Sha256": emptyPayloadHash},
+		want:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20130524/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=34b48302e7b5fa45bde8084f4b7868a86f0a534bc59db6670ed5711ef69dc6f7",
+	},
+}
+
+func TestSignV4Vectors(t *testing.T) {
+	for _, v := range sigV4Vectors {
+		req, err := http.NewRequest(v.method, v.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, val := range v.headers {
+			req.Header.Set(k, val)
+		}
+		now, _ := time.Parse("20060102T150405Z", v.date)
+		signV4(req, "AKIDEXAMPLE", v.secret, v.region, v.service, emptyPayloadHash, now)
+		if got := req.Header.Get("Authorization"); got != v.want {
+			t.Errorf("%s:\n got %s\nwant %s", v.name, got, v.want)
+		}
+		if got := req.Header.Get("X-Amz-Date"); got != v.date {
+			t.Errorf("%s: X-Amz-Date = %s", v.name, got)
+		}
+	}
+}
+
+// fakeS3 is an httptest stand-in for an S3 endpoint (path-style, as MinIO). It
+// checks each request's SigV4 signature and payload hash independently of
+// signV4 and keeps objects in memory.
+type fakeS3 struct {
+	t                    *testing.T
+	accessKey, secretKey string
+	region               string
+
+	mu      sync.Mutex
+	objects map[string][]byte // by escaped path, /bucket/key
+	types   map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if msg := f.verify(r, body); msg != "" {
+		f.t.Logf("fake S3 rejected %s %s: %s", r.Method, r.URL, msg)
+		http.Error(w, "SignatureDoesNotMatch: "+msg, http.StatusForbidden)
+		return
+	}
+	path := strings.SplitN(r.RequestURI, "?", 2)[0]
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[path] = body
+		f.types[path] = r.Header.Get("Content-Type")
+	case http.MethodGet:
+		b, ok := f.objects[path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	case http.MethodDelete:
+		delete(f.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verify recomputes the signature from the request as received
+func (f *fakeS3) verify(r *http.Request, body []byte) string {
+	sum := sha256.Sum256(body)
+	if hash := r.Header.Get("X-Amz-Content-Sha256"); hash != hex.EncodeToString(sum[:]) {
+		return "payload hash " + hash
+	}
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	fields := map[string]string{}
+	for _, part := range strings.Split(auth, ", ") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	date := r.Header.Get("X-Amz-Date")
+	if len(date) != 16 {
+		return "missing X-Amz-Date"
+	}
+	scope := date[:8] + "/" + f.region + "/s3/aws4_request"
+	if fields["Credential"] != f.accessKey+"/"+scope {
+		return "credential " + fields["Credential"]
+	}
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	var headers strings.Builder
+	for _, name := range signed {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	for _, must := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !strings.Contains(";"+fields["SignedHeaders"]+";", ";"+must+";") {
+			return must + " not signed"
+		}
+	}
+	parts := strings.SplitN(r.RequestURI, "?", 2)
+	var query []string
+	if len(parts) == 2 && parts[1] != "" {
+		query = strings.Split(parts[1], "&")
+		for i, q := range query {
+			if !strings.Contains(q, "=") {
+				query[i] = q + "="
+			}
+		}
+		sort.Strings(query)
+	}
+	canonical := strings.Join([]string{
+		r.Method, parts[0], strings.Join(query, "&"), headers.String(), fields["SignedHeaders"], r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	csum := sha256.Sum256([]byte(canonical))
+	key := hmacSHA256([]byte("AWS4"+f.secretKey), date[:8])
+	for _, d := range []string{f.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, d)
+	}
+	want := hex.EncodeToString(hmacSHA256(key, "AWS4-HMAC-SHA256\n"+date+"\n"+scope+"\n"+hex.EncodeToString(csum[:])))
+	if fields["Signature"] != want {
+		return "signature"
+	}
+	return ""
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		t: t, accessKey: "AKIDEXAMPLE", secretKey: "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", region: "eu-west-1",
+		objects: make(map[string][]byte), types: make(map[string]string),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func TestS3BlobStore(t *testing.T) {
+	f, srv := newFakeS3(t)
+	store, err := NewBlobStoreFromURL("s3://uploads/tenant a?region=eu-west-1&endpoint="+srv.URL+"/", f.accessKey, f.secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys with characters that SigV4 and URL escaping treat differently
+	for _, key := range []string{"sessions/abc/report.pdf", "sessions/abc/my file (1).png", "sessions/abc/$price+tax=€.txt", "sessions/abc/a~b_c-d.e"} {
+		body := []byte("contents of " + key)
+		if err := store.Put(key, bytes.NewReader(body), "application/pdf"); err != nil {
+			t.Fatalf("Put %q: %v", key, err)
+		}
+		rc, err := store.Get(key)
+		if err != nil {
+			t.Fatalf("Get %q: %v", key, err)
+		}
+		got, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if !bytes.Equal(got, body) {
+			t.Fatalf("Get %q = %q", key, got)
+		}
+		if err := store.Delete(key); err != nil {
+			t.Fatalf("Delete %q: %v", key, err)
+		}
+		if _, err := store.Get(key); err != ErrBlobNotFound {
+			t.Fatalf("Get %q after Delete: %v", key, err)
+		}
+	}
+	f.mu.Lock()
+	n := len(f.types)
+	ct := f.types["/uploads/tenant%20a/sessions/abc/report.pdf"]
+	f.mu.Unlock()
+	if n != 4 || ct != "application/pdf" {
+		t.Fatalf("stored %d objects, report.pdf as %q; want 4 under /uploads/tenant%%20a/", n, ct)
+	}
+
+	bad, _ := NewBlobStoreFromURL("s3://uploads?region=eu-west-1&endpoint="+srv.URL, f.accessKey, "wrong-secret")
+	if err := bad.Put("k", bytes.NewReader([]byte("x")), ""); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Put with a wrong secret: %v", err)
+	}
+}
+
+func TestFSBlobStoreKeys(t *testing.T) {
+	root, err := ioutil.TempDir("", "blobstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "uploads")
+	store := &FSBlobStore{Dir: dir}
+
+	for _, key := range []string{"", "/", "..", "../outside", "sessions/../../outside", "sessions/..", "/../outside", `..\outside`} {
+		if err := store.Put(key, bytes.NewReader([]byte("x")), ""); err == nil {
+			t.Errorf("Put %q accepted", key)
+		}
+		if _, err := store.Get(key); err == nil || err == ErrBlobNotFound {
+			t.Errorf("Get %q: %v, want an invalid key error", key, err)
+		}
+		if err := store.Delete(key); err == nil {
+			t.Errorf("Delete %q accepted", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "outside")); !os.IsNotExist(err) {
+		t.Fatalf("a file was written outside the store: %v", err)
+	}
+
+	// Absolute keys are kept under Dir, not at the filesystem root
+	for _, key := range []string{"/sessions/abs.txt", "//sessions//double.txt", filepath.Join(root, "escape.txt")} {
+		if err := store.Put(key, bytes.NewReader([]byte(key)), ""); err != nil {
+			t.Fatalf("Put %q: %v", key, err)
+		}
+		path, _ := store.path(key)
+		if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			t.Fatalf("%q stored at %s, outside %s", key, path, dir)
+		}
+		rc, err := store.Get(key)
+		if err != nil {
+			t.Fatalf("Get %q: %v", key, err)
+		}
+		got, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if string(got) != key {
+			t.Fatalf("Get %q = %q", key, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "escape.txt")); !os.IsNotExist(err) {
+		t.Fatalf("absolute key written outside the store: %v", err)
+	}
+	if _, err := store.Get("sessions/missing"); err != ErrBlobNotFound {
+		t.Fatalf("Get missing = %v", err)
+	}
+	if err := store.Delete("sessions/missing"); err != nil {
+		t.Fatalf("Delete missing = %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Broker carries room signaling and shared state between laplace instances.
+// The in-process implementation is the default; the Redis implementation lets
+// several machines serve the same rooms, pending codes and login sessions.
+type Broker interface {
+	Publish(channel string, payload []byte) error
+	Subscribe(channel string) (Subscription, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Get(key string) ([]byte, bool, error)
+	Del(key string) error
+	Close() error
+}
+
+// Subscription delivers payloads published on one channel until closed
+type Subscription interface {
+	C() <-chan []byte
+	Close() error
+}
+
+var (
+	brokerMu   sync.RWMutex
+	broker     Broker = newMemoryBroker()
+	instanceID        = newInstanceID()
+)
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func getBroker() Broker {
+	brokerMu.RLock()
+	defer brokerMu.RUnlock()
+	return broker
+}
+
+// SetBroker replaces the process broker. Pending session codes move to the
+// broker so they can be validated on any instance, and replicated state from
+// other instances starts being applied locally.
+func SetBroker(b Broker) {
+	brokerMu.Lock()
+	broker = b
+	brokerMu.Unlock()
+	defaultStore = &brokerSessionStore{b: b}
+	startStateReplication(b)
+}
+
+// BrokerPersistent reports whether the broker outlives this process, so keys
+// set in it survive a restart
+func BrokerPersistent() bool {
+	_, memory := getBroker().(*memoryBroker)
+	return !memory
+}
+
+// NewBrokerFromURL returns the broker for a -broker flag value:
+// "" or "memory" for in-process, redis://[:password@]host:port[/db] for Redis.
+func NewBrokerFromURL(raw string) (Broker, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || raw == "memory" {
+		return newMemoryBroker(), nil
+	}
+	return NewRedisBroker(raw)
+}
+
+// memoryBroker is the single-process Broker
+type memoryBroker struct {
+	mu        sync.Mutex
+	subs      map[string]map[*memorySubscription]struct{}
+	kv        map[string]memoryEntry
+	lastSweep time.Time
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+type memorySubscription struct {
+	b       *memoryBroker
+	channel string
+	ch      chan []byte
+	once    sync.Once
+}
+
+const brokerBufferSize = 64
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{
+		subs: make(map[string]map[*memorySubscription]struct{}),
+		kv:   make(map[string]memoryEntry),
+	}
+}
+
+func (b *memoryBroker) Publish(channel string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs[channel] {
+		cp := make([]byte, len(payload))
+		copy(cp, payload)
+		select {
+		case sub.ch <- cp:
+		default:
+			log.Println("broker: dropping message for slow subscriber on", channel)
+		}
+	}
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(channel string) (Subscription, error) {
+	sub := &memorySubscription{b: b, channel: channel, ch: make(chan []byte, brokerBufferSize)}
+	b.mu.Lock()
+	if b.subs[channel] == nil {
+		b.subs[channel] = make(map[*memorySubscription]struct{})
+	}
+	b.subs[channel][sub] = struct{}{}
+	b.mu.Unlock()
+	return sub, nil
+}
+
+func (b *memoryBroker) Set(key string, value []byte, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if now.Sub(b.lastSweep) > time.Minute {
+		// Expired keys are otherwise only dropped when read again, and
+		// many (login failures for random emails) never are
+		for k, e := range b.kv {
+			if !e.expires.IsZero() && now.After(e.expires) {
+				delete(b.kv, k)
+			}
+		}
+		b.lastSweep = now
+	}
+	e := memoryEntry{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		e.expires = now.Add(ttl)
+	}
+	b.kv[key] = e
+	return nil
+}
+
+func (b *memoryBroker) Get(key string) ([]byte, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.kv[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		delete(b.kv, key)
+		return nil, false, nil
+	}
+	return append([]byte(nil), e.value...), true, nil
+}
+
+func (b *memoryBroker) Del(key string) error {
+	b.mu.Lock()
+	delete(b.kv, key)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *memoryBroker) Close() error {
+	return nil
+}
+
+func (s *memorySubscription) C() <-chan []byte {
+	return s.ch
+}
+
+func (s *memorySubscription) Close() error {
+	s.once.Do(func() {
+		s.b.mu.Lock()
+		delete(s.b.subs[s.channel], s)
+		if len(s.b.subs[s.channel]) == 0 {
+			delete(s.b.subs, s.channel)
+		}
+		s.b.mu.Unlock()
+		close(s.ch)
+	})
+	return nil
+}
@@ -0,0 +1,383 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisBroker implements Broker over the Redis protocol (RESP2). It speaks to
+// any server that understands PUBLISH/SUBSCRIBE/SET/GET/DEL, so a local stand-in
+// can replace Redis in development and tests.
+type redisBroker struct {
+	addr     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+const (
+	redisDialTimeout = 5 * time.Second
+	redisMinBackoff  = 100 * time.Millisecond
+	redisMaxBackoff  = 5 * time.Second
+)
+
+// redisIOTimeout bounds each command, so a stalled server fails the request
+// instead of hanging every caller queued behind the shared connection
+var redisIOTimeout = 5 * time.Second
+
+var errRedisNil = errors.New("redis: nil")
+
+// NewRedisBroker connects to redis://[:password@]host:port[/db]
+func NewRedisBroker(raw string) (Broker, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("broker: unsupported scheme %q", u.Scheme)
+	}
+	b := &redisBroker{addr: u.Host}
+	if !strings.Contains(b.addr, ":") {
+		b.addr += ":6379"
+	}
+	if u.User != nil {
+		if p, ok := u.User.Password(); ok {
+			b.password = p
+		} else {
+			b.password = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if b.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("broker: invalid db %q", db)
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.connectLocked(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *redisBroker) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, redisDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	rd := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(redisIOTimeout))
+	if b.password != "" {
+		if _, err := redisRoundTrip(conn, rd, "AUTH", b.password); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	if b.db != 0 {
+		if _, err := redisRoundTrip(conn, rd, "SELECT", strconv.Itoa(b.db)); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, rd, nil
+}
+
+func (b *redisBroker) connectLocked() error {
+	conn, rd, err := b.dial()
+	if err != nil {
+		return err
+	}
+	b.conn, b.rd = conn, rd
+	return nil
+}
+
+// do runs one command on the shared connection, reconnecting once on I/O
+// errors other than timeouts
+func (b *redisBroker) do(args ...string) (interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if b.conn == nil {
+			if err := b.connectLocked(); err != nil {
+				return nil, err
+			}
+		}
+		b.conn.SetDeadline(time.Now().Add(redisIOTimeout))
+		reply, err := redisRoundTrip(b.conn, b.rd, args...)
+		if err == nil || err == errRedisNil || isRedisError(err) {
+			return reply, err
+		}
+		// The reply may still arrive, so the connection cannot be reused;
+		// a stalled server is not retried
+		b.conn.Close()
+		b.conn = nil
+		if ne, ok := err.(net.Error); attempt > 0 || ok && ne.Timeout() {
+			return nil, err
+		}
+	}
+}
+
+func (b *redisBroker) Publish(channel string, payload []byte) error {
+	_, err := b.do("PUBLISH", channel, string(payload))
+	return err
+}
+
+func (b *redisBroker) Set(key string, value []byte, ttl time.Duration) error {
+	if ttl > 0 {
+		_, err := b.do("SET", key, string(value), "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+		return err
+	}
+	_, err := b.do("SET", key, string(value))
+	return err
+}
+
+func (b *redisBroker) Get(key string) ([]byte, bool, error) {
+	reply, err := b.do("GET", key)
+	if err == errRedisNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	s, ok := reply.(string)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected GET reply %T", reply)
+	}
+	return []byte(s), true, nil
+}
+
+func (b *redisBroker) Del(key string) error {
+	_, err := b.do("DEL", key)
+	return err
+}
+
+func (b *redisBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.Close()
+	b.conn = nil
+	return err
+}
+
+// Subscribe opens a dedicated connection in subscriber mode for channel. If
+// the connection drops it is reopened with backoff; messages published while
+// it is down are lost.
+func (b *redisBroker) Subscribe(channel string) (Subscription, error) {
+	conn, rd, err := b.subscribe(channel)
+	if err != nil {
+		return nil, err
+	}
+	sub := &redisSubscription{
+		b:       b,
+		channel: channel,
+		conn:    conn,
+		ch:      make(chan []byte, brokerBufferSize),
+		done:    make(chan struct{}),
+	}
+	go sub.read(rd)
+	return sub, nil
+}
+
+func (b *redisBroker) subscribe(channel string) (net.Conn, *bufio.Reader, error) {
+	conn, rd, err := b.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Only the handshake has a deadline: a quiet channel is not a dead one
+	conn.SetDeadline(time.Now().Add(redisIOTimeout))
+	if _, err := redisRoundTrip(conn, rd, "SUBSCRIBE", channel); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, rd, nil
+}
+
+type redisSubscription struct {
+	b       *redisBroker
+	channel string
+	ch      chan []byte
+	done    chan struct{}
+	once    sync.Once
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (s *redisSubscription) read(rd *bufio.Reader) {
+	defer close(s.ch)
+	for {
+		err := s.receive(rd)
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		log.Println("broker: subscription", s.channel, "lost:", err)
+		if rd = s.resubscribe(); rd == nil {
+			return
+		}
+	}
+}
+
+// receive delivers messages until the connection fails
+func (s *redisSubscription) receive(rd *bufio.Reader) error {
+	for {
+		reply, err := readRedisReply(rd)
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 {
+			continue
+		}
+		if kind, _ := parts[0].(string); kind != "message" {
+			continue
+		}
+		payload, _ := parts[2].(string)
+		select {
+		case s.ch <- []byte(payload):
+		default:
+			log.Println("broker: dropping message for slow subscriber on", s.channel)
+		}
+	}
+}
+
+// resubscribe reconnects with exponential backoff until it succeeds or the
+// subscription is closed, in which case it returns nil
+func (s *redisSubscription) resubscribe() *bufio.Reader {
+	backoff := redisMinBackoff
+	for {
+		select {
+		case <-s.done:
+			return nil
+		case <-time.After(backoff):
+		}
+		conn, rd, err := s.b.subscribe(s.channel)
+		if err != nil {
+			if backoff *= 2; backoff > redisMaxBackoff {
+				backoff = redisMaxBackoff
+			}
+			continue
+		}
+		s.mu.Lock()
+		select {
+		case <-s.done:
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		default:
+		}
+		s.conn = conn
+		s.mu.Unlock()
+		log.Println("broker: subscription", s.channel, "restored")
+		return rd
+	}
+}
+
+func (s *redisSubscription) C() <-chan []byte {
+	return s.ch
+}
+
+func (s *redisSubscription) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.mu.Lock()
+		close(s.done)
+		err = s.conn.Close()
+		s.mu.Unlock()
+	})
+	return err
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func isRedisError(err error) bool {
+	_, ok := err.(redisError)
+	return ok
+}
+
+func redisRoundTrip(conn net.Conn, rd *bufio.Reader, args ...string) (interface{}, error) {
+	if err := writeRedisCommand(conn, args...); err != nil {
+		return nil, err
+	}
+	return readRedisReply(rd)
+}
+
+func writeRedisCommand(w io.Writer, args ...string) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := readRedisReply(rd)
+			if err != nil && err != errRedisNil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,277 @@
+package core
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process server for the subset of RESP2 redisBroker
+// speaks. drop() cuts every open connection, as a Redis restart or failover
+// would; stall makes it stop answering.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	kv    map[string]string
+	subs  map[string]map[net.Conn]bool
+	stall bool
+	auths int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		ln: ln, password: password,
+		conns: make(map[net.Conn]bool),
+		kv:    make(map[string]string),
+		subs:  make(map[string]map[net.Conn]bool),
+	}
+	go f.serve()
+	t.Cleanup(func() {
+		ln.Close()
+		f.drop()
+	})
+	return f
+}
+
+func (f *fakeRedis) addr() string { return f.ln.Addr().String() }
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns[conn] = true
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = make(map[net.Conn]bool)
+	f.subs = make(map[string]map[net.Conn]bool)
+}
+
+func (f *fakeRedis) setStall(stall bool) {
+	f.mu.Lock()
+	f.stall = stall
+	f.mu.Unlock()
+}
+
+func (f *fakeRedis) subscribers(channel string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subs[channel])
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		reply, err := readRedisReply(rd)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		var args []string
+		for _, it := range items {
+			s, _ := it.(string)
+			args = append(args, s)
+		}
+		if len(args) == 0 {
+			return
+		}
+		f.mu.Lock()
+		stall := f.stall
+		f.mu.Unlock()
+		if stall {
+			continue
+		}
+		cmd := strings.ToUpper(args[0])
+		if !authed && cmd != "AUTH" {
+			conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+			continue
+		}
+		switch cmd {
+		case "AUTH":
+			if args[1] != f.password {
+				conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+				continue
+			}
+			authed = true
+			f.mu.Lock()
+			f.auths++
+			f.mu.Unlock()
+			conn.Write([]byte("+OK\r\n"))
+		case "SELECT":
+			conn.Write([]byte("+OK\r\n"))
+		case "SET":
+			f.mu.Lock()
+			f.kv[args[1]] = args[2]
+			f.mu.Unlock()
+			conn.Write([]byte("+OK\r\n"))
+		case "GET":
+			f.mu.Lock()
+			v, ok := f.kv[args[1]]
+			f.mu.Unlock()
+			if !ok {
+				conn.Write([]byte("$-1\r\n"))
+				continue
+			}
+			conn.Write([]byte("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"))
+		case "DEL":
+			f.mu.Lock()
+			delete(f.kv, args[1])
+			f.mu.Unlock()
+			conn.Write([]byte(":1\r\n"))
+		case "SUBSCRIBE":
+			f.mu.Lock()
+			if f.subs[args[1]] == nil {
+				f.subs[args[1]] = make(map[net.Conn]bool)
+			}
+			f.subs[args[1]][conn] = true
+			f.mu.Unlock()
+			conn.Write([]byte("*3\r\n$9\r\nsubscribe\r\n$" + strconv.Itoa(len(args[1])) + "\r\n" + args[1] + "\r\n:1\r\n"))
+		case "PUBLISH":
+			f.mu.Lock()
+			n := 0
+			for sub := range f.subs[args[1]] {
+				writeRedisCommand(sub, "message", args[1], args[2])
+				n++
+			}
+			f.mu.Unlock()
+			conn.Write([]byte(":" + strconv.Itoa(n) + "\r\n"))
+		default:
+			conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+func TestRedisBrokerKeys(t *testing.T) {
+	f := newFakeRedis(t, "s3cret")
+	b, err := NewRedisBroker("redis://:s3cret@" + f.addr() + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if err := b.Set("k", []byte("v"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := b.Get("k"); err != nil || !ok || string(v) != "v" {
+		t.Fatalf("Get = %q %v %v", v, ok, err)
+	}
+	if err := b.Del("k"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := b.Get("k"); err != nil || ok {
+		t.Fatalf("Get after Del = %v %v", ok, err)
+	}
+
+	// A dropped connection is reopened (and authenticated) for the next command
+	f.drop()
+	if err := b.Set("k", []byte("again"), 0); err != nil {
+		t.Fatalf("Set after drop: %v", err)
+	}
+	if v, _, _ := b.Get("k"); string(v) != "again" {
+		t.Fatalf("Get after drop = %q", v)
+	}
+	f.mu.Lock()
+	auths := f.auths
+	f.mu.Unlock()
+	if auths < 2 {
+		t.Fatalf("auths = %d, want a new AUTH after reconnecting", auths)
+	}
+
+	if _, err := NewRedisBroker("redis://:wrong@" + f.addr()); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+}
+
+func TestRedisBrokerTimeout(t *testing.T) {
+	defer func(d time.Duration) { redisIOTimeout = d }(redisIOTimeout)
+	redisIOTimeout = 200 * time.Millisecond
+	f := newFakeRedis(t, "")
+	b, err := NewRedisBroker("redis://" + f.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	f.setStall(true)
+	start := time.Now()
+	if _, _, err := b.Get("k"); err == nil {
+		t.Fatal("Get from a stalled server succeeded")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Get took %v against a stalled server", d)
+	}
+	f.setStall(false)
+	if err := b.Set("k", []byte("v"), 0); err != nil {
+		t.Fatalf("Set after the server recovered: %v", err)
+	}
+}
+
+func TestRedisBrokerResubscribe(t *testing.T) {
+	f := newFakeRedis(t, "")
+	b, err := NewRedisBroker("redis://" + f.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	sub, err := b.Subscribe("chan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive := func(want string) {
+		t.Helper()
+		select {
+		case got, ok := <-sub.C():
+			if !ok || string(got) != want {
+				t.Fatalf("received %q (open %v), want %q", got, ok, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no message %q", want)
+		}
+	}
+	b.Publish("chan", []byte("one"))
+	receive("one")
+
+	f.drop()
+	deadline := time.Now().Add(5 * time.Second)
+	for f.subscribers("chan") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("subscription was not restored")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	b.Publish("chan", []byte("two"))
+	receive("two")
+
+	sub.Close()
+	select {
+	case _, ok := <-sub.C():
+		if ok {
+			t.Fatal("message after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed after Close")
+	}
+}
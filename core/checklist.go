@@ -0,0 +1,285 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Each CoBrowseSession carries a checklist of the documents the client must
+// provide, one item per document the SRM or a reviewer requested. Document
+// templates are terms shown to the client, not documents it provides, so they
+// are not on the checklist. The client's uploads move items to uploaded; the SRM or a reviewer accepts,
+// rejects (with a reason) or waives them. The client cannot submit while a
+// required item is still requested or rejected, and a session cannot be
+// approved until every required item is accepted or waived.
+
+// ChecklistState is where a checklist item stands
+type ChecklistState string
+
+const (
+	ChecklistRequested ChecklistState = "requested"
+	ChecklistUploaded  ChecklistState = "uploaded"
+	ChecklistAccepted  ChecklistState = "accepted"
+	ChecklistRejected  ChecklistState = "rejected"
+	ChecklistWaived    ChecklistState = "waived"
+)
+
+// ChecklistItem is one required or requested document of a session
+type ChecklistItem struct {
+	ID          string         `json:"id"`
+	Name        string         `json:"name"`
+	Required    bool           `json:"required"`
+	State       ChecklistState `json:"state"`
+	Reason      string         `json:"reason,omitempty"` // why it was rejected or waived
+	DocumentIDs []string       `json:"documentIds,omitempty"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
+	UpdatedBy   string         `json:"updatedBy,omitempty"`
+}
+
+// checklistActions maps each staff action to the states it may start from
+// and the state it leads to
+var checklistActions = map[string]struct {
+	from []ChecklistState
+	to   ChecklistState
+}{
+	"accept":  {[]ChecklistState{ChecklistUploaded}, ChecklistAccepted},
+	"reject":  {[]ChecklistState{ChecklistUploaded, ChecklistAccepted}, ChecklistRejected},
+	"waive":   {[]ChecklistState{ChecklistRequested, ChecklistUploaded, ChecklistRejected}, ChecklistWaived},
+	"request": {[]ChecklistState{ChecklistUploaded, ChecklistAccepted, ChecklistRejected, ChecklistWaived}, ChecklistRequested},
+}
+
+const maxChecklistItems = 50
+
+func newChecklistItem(name string, required bool) ChecklistItem {
+	return ChecklistItem{ID: GetRandomName(1), Name: name, Required: required, State: ChecklistRequested, UpdatedAt: time.Now()}
+}
+
+// checklistItem finds an item by ID, or by name when id is empty
+func checklistItem(s *CoBrowseSession, id, name string) *ChecklistItem {
+	for i := range s.Checklist {
+		it := &s.Checklist[i]
+		if (id != "" && it.ID == id) || (id == "" && name != "" && strings.EqualFold(it.Name, name)) {
+			return it
+		}
+	}
+	return nil
+}
+
+// requestChecklistDocs adds a required item for each name not already on the
+// checklist, or asks again for one that was settled, and returns the names added
+func requestChecklistDocs(s *CoBrowseSession, names []string, actorID string) []string {
+	var added []string
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if it := checklistItem(s, "", name); it != nil {
+			if it.State != ChecklistRequested && it.State != ChecklistUploaded {
+				it.State, it.Reason, it.UpdatedAt, it.UpdatedBy = ChecklistRequested, "", time.Now(), actorID
+			}
+			continue
+		}
+		if len(s.Checklist) >= maxChecklistItems {
+			break
+		}
+		it := newChecklistItem(name, true)
+		it.UpdatedBy = actorID
+		s.Checklist = append(s.Checklist, it)
+		added = append(added, name)
+	}
+	return added
+}
+
+// checklistMissing returns the names of required items that block submission
+// or, with forApproval, approval
+func checklistMissing(s *CoBrowseSession, forApproval bool) []string {
+	missing := []string{}
+	for _, it := range s.Checklist {
+		if !it.Required {
+			continue
+		}
+		switch it.State {
+		case ChecklistAccepted, ChecklistWaived:
+			continue
+		case ChecklistUploaded:
+			if !forApproval {
+				continue
+			}
+		}
+		missing = append(missing, it.Name)
+	}
+	return missing
+}
+
+// clientChecklistItem is what the client sees of an item
+type clientChecklistItem struct {
+	ID       string         `json:"id"`
+	Name     string         `json:"name"`
+	Required bool           `json:"required"`
+	State    ChecklistState `json:"state"`
+	Reason   string         `json:"reason,omitempty"`
+}
+
+func clientChecklist(s *CoBrowseSession) []clientChecklistItem {
+	list := make([]clientChecklistItem, 0, len(s.Checklist))
+	for _, it := range s.Checklist {
+		c := clientChecklistItem{ID: it.ID, Name: it.Name, Required: it.Required, State: it.State}
+		if it.State == ChecklistRejected {
+			c.Reason = it.Reason
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+// apiSessionChecklist handles POST /api/session/checklist?sessionId=... for
+// the session's SRM or a reviewer, with either {itemId, action, reason} where
+// action is accept, reject, waive or request, or {action: "add", name,
+// required} to ask for another document
+func apiSessionChecklist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID, role, authed := RequestCan(r, PermSessionCreate, PermSessionReview)
+	if !authed {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Agent or Admin login required"})
+		return
+	}
+	sessionID := strings.TrimSpace(r.URL.Query().Get("sessionId"))
+	s := StoreGetSession(sessionID)
+	if s == nil || !canActOnSession(r, userID, role, s) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Session not found"})
+		return
+	}
+	var body struct {
+		ItemID   string `json:"itemId"`
+		Action   string `json:"action"`
+		Reason   string `json:"reason"`
+		Name     string `json:"name"`
+		Required *bool  `json:"required"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	body.Reason = strings.TrimSpace(body.Reason)
+	if utf8.RuneCountInString(body.Reason) > 500 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Reason must be at most 500 characters"})
+		return
+	}
+
+	var item ChecklistItem
+	var from ChecklistState
+	var errCode int
+	var errMsg string
+	switch body.Action {
+	case "add":
+		name := strings.TrimSpace(body.Name)
+		if name == "" || len(name) > 200 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Document name required"})
+			return
+		}
+		required := body.Required == nil || *body.Required
+		StoreUpdateSession(s.ID, func(cs *CoBrowseSession) bool {
+			if checklistItem(cs, "", name) != nil {
+				errCode, errMsg = http.StatusConflict, "Already on the checklist"
+				return false
+			}
+			if len(cs.Checklist) >= maxChecklistItems {
+				errCode, errMsg = http.StatusConflict, "Checklist is full"
+				return false
+			}
+			item = newChecklistItem(name, required)
+			item.UpdatedBy = userID
+			cs.Checklist = append(cs.Checklist, item)
+			cs.RequestedDocs = append(cs.RequestedDocs, name)
+			return true
+		})
+	default:
+		act, ok := checklistActions[body.Action]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "action must be add, accept, reject, waive or request"})
+			return
+		}
+		if body.Action == "reject" && body.Reason == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "A reason is required to reject a document"})
+			return
+		}
+		StoreUpdateSession(s.ID, func(cs *CoBrowseSession) bool {
+			it := checklistItem(cs, body.ItemID, "")
+			if it == nil {
+				errCode, errMsg = http.StatusNotFound, "Checklist item not found"
+				return false
+			}
+			allowed := false
+			for _, st := range act.from {
+				allowed = allowed || it.State == st
+			}
+			if !allowed {
+				errCode, errMsg = http.StatusConflict, "Cannot "+body.Action+" an item that is "+string(it.State)
+				return false
+			}
+			from = it.State
+			it.State, it.Reason, it.UpdatedAt, it.UpdatedBy = act.to, "", time.Now(), userID
+			if act.to == ChecklistRejected || act.to == ChecklistWaived {
+				it.Reason = body.Reason
+			}
+			item = *it
+			return true
+		})
+	}
+	if errCode != 0 {
+		w.WriteHeader(errCode)
+		json.NewEncoder(w).Encode(map[string]string{"error": errMsg})
+		return
+	}
+	StoreAppendAudit(s.ID, string(role), userID, "checklist_update", map[string]interface{}{
+		"itemId": item.ID, "name": item.Name, "action": body.Action, "from": from, "to": item.State, "reason": item.Reason,
+	})
+	PublishSessionEvent(s.ID, EventChecklistUpdated, map[string]interface{}{"itemId": item.ID, "state": item.State})
+	json.NewEncoder(w).Encode(item)
+}
+
+// apiSessionSubmit handles POST /api/session/submit?token=<code>: the client
+// submits the application once every required document is in
+func apiSessionSubmit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	s := uploadSession(w, r)
+	if s == nil {
+		return
+	}
+	var missing []string
+	var status SessionStatus
+	ok := StoreUpdateSession(s.ID, func(cs *CoBrowseSession) bool {
+		status = cs.Status
+		if !uploadsOpen(cs) {
+			return false
+		}
+		if missing = checklistMissing(cs, false); len(missing) > 0 {
+			return false
+		}
+		cs.Status = StatusSubmitted
+		return true
+	})
+	if !ok {
+		w.WriteHeader(http.StatusConflict)
+		if len(missing) > 0 {
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Some required documents are still outstanding", "missing": missing})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"error": "This application cannot be submitted now", "status": string(status)})
+		return
+	}
+	StoreAppendAudit(s.ID, "client", "", "application_submitted", map[string]interface{}{"from": status, "ip": loginIP(r)})
+	PublishSessionEvent(s.ID, EventSubmitted, nil)
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "status": StatusSubmitted})
+}
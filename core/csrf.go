@@ -0,0 +1,128 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// State-changing requests are protected against cross-site forgery in two
+// ways. Every POST, PUT, PATCH or DELETE whose Origin is another site is
+// refused unless that origin is configured for CORS. A request that carries
+// a login cookie must also send the login's CSRF token in X-CSRF-Token; the
+// token is derived from the session ID, so it needs no storage and is the
+// same on every instance, and is handed to pages by /api/auth-check.
+// Requests authenticated with an API key carry no cookie and need no token.
+
+const csrfHeader = "X-CSRF-Token"
+
+var (
+	corsMu         sync.RWMutex
+	allowedOrigins = make(map[string]bool)
+)
+
+// SetAllowedOrigins sets the origins, such as https://crm.example.com, that
+// may call the session API from a browser
+func SetAllowedOrigins(origins []string) {
+	m := make(map[string]bool)
+	for _, o := range origins {
+		if o = strings.TrimRight(strings.TrimSpace(o), "/"); o != "" {
+			m[strings.ToLower(o)] = true
+		}
+	}
+	corsMu.Lock()
+	allowedOrigins = m
+	corsMu.Unlock()
+}
+
+func originAllowed(origin string) bool {
+	corsMu.RLock()
+	defer corsMu.RUnlock()
+	return allowedOrigins[strings.ToLower(origin)]
+}
+
+// sameOrigin reports whether origin is this site, as reached by r or as
+// configured with SetPublicURL
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	publicURLMu.RLock()
+	base := publicURL
+	publicURLMu.RUnlock()
+	p, err := url.Parse(base)
+	return base != "" && err == nil && strings.EqualFold(u.Host, p.Host)
+}
+
+// setCORSHeaders lets a configured origin read the response. Credentials are
+// never allowed, so browsers on other sites can only use API keys.
+func setCORSHeaders(w http.ResponseWriter, r *http.Request, methods string) {
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !originAllowed(origin) {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", methods)
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Max-Age", "600")
+	}
+}
+
+// csrfToken is the CSRF token of a login session
+func csrfToken(sessionID string) string {
+	if sessionID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte("laplace-csrf:" + sessionID))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func unsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
+
+// checkCSRF applies the Origin and token checks to a request for rt,
+// answering failures with 403
+func checkCSRF(rt Route, w http.ResponseWriter, r *http.Request) bool {
+	if !unsafeMethod(r.Method) {
+		return true
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(r, origin) && !originAllowed(origin) {
+		writeCSRFDenied(w, "Cross-site request refused")
+		return false
+	}
+	if rt.NoCSRF || requestAPIKey(r) != nil {
+		return true
+	}
+	sid := getSessionFromRequest(r)
+	if sid == "" || validSession(sid) == nil {
+		return true
+	}
+	want := csrfToken(sid)
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(want)) != 1 {
+		writeCSRFDenied(w, "Missing or invalid CSRF token")
+		return false
+	}
+	return true
+}
+
+func writeCSRFDenied(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": msg, "csrf": true})
+}
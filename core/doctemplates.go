@@ -0,0 +1,153 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Every save of a DocumentTemplate is kept as a numbered version with its
+// author and time. Sessions pin the versions they were given, so reviewers can
+// see the exact terms a client saw; a rollback saves an old version again as
+// the newest one rather than rewriting history.
+
+// documentChange is one metadata field that differs between two versions
+type documentChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// diffDocumentTemplates lists the metadata fields that differ from a to b
+func diffDocumentTemplates(a, b DocumentTemplate) []documentChange {
+	changes := []documentChange{}
+	add := func(field string, from, to interface{}) {
+		if from != to {
+			changes = append(changes, documentChange{Field: field, From: from, To: to})
+		}
+	}
+	add("title", a.Title, b.Title)
+	add("url", a.URL, b.URL)
+	add("type", a.Type, b.Type)
+	add("required", a.Required, b.Required)
+	return changes
+}
+
+// documentVersionView adds the author's email to a stored version
+type documentVersionView struct {
+	DocumentTemplate
+	UpdatedByEmail string `json:"updatedByEmail,omitempty"`
+}
+
+func viewDocumentVersion(d DocumentTemplate) documentVersionView {
+	v := documentVersionView{DocumentTemplate: d}
+	if u := StoreGetUser(d.UpdatedBy); u != nil {
+		v.UpdatedByEmail = u.Email
+	}
+	return v
+}
+
+// documentPath splits /documents/:id/:action[/:arg]
+func documentPath(path string) (id, action, arg string) {
+	parts := strings.SplitN(strings.Trim(strings.TrimPrefix(path, "/documents/"), "/"), "/", 3)
+	id = parts[0]
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	if len(parts) > 2 {
+		arg = parts[2]
+	}
+	return id, action, arg
+}
+
+// adminDocumentHistory handles GET /documents/:id/versions,
+// GET /documents/:id/versions/:version and
+// GET /documents/:id/diff?from=&to= (to defaults to the latest version)
+func adminDocumentHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, action, arg := documentPath(r.URL.Path)
+	versions := StoreListDocumentVersions(id)
+	if id == "" || len(versions) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Document not found"})
+		return
+	}
+	switch action {
+	case "versions":
+		if arg == "" {
+			list := make([]documentVersionView, 0, len(versions))
+			for _, d := range versions {
+				list = append(list, viewDocumentVersion(d))
+			}
+			current := StoreGetDocument(id)
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "current": current, "versions": list})
+			return
+		}
+		v, _ := strconv.Atoi(arg)
+		d := StoreGetDocumentVersion(id, v)
+		if d == nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Version not found"})
+			return
+		}
+		json.NewEncoder(w).Encode(viewDocumentVersion(*d))
+	case "diff":
+		q := r.URL.Query()
+		from, _ := strconv.Atoi(q.Get("from"))
+		to := len(versions)
+		if q.Get("to") != "" {
+			to, _ = strconv.Atoi(q.Get("to"))
+		}
+		a, b := StoreGetDocumentVersion(id, from), StoreGetDocumentVersion(id, to)
+		if a == nil || b == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "from and to must be existing versions"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id": id, "from": viewDocumentVersion(*a), "to": viewDocumentVersion(*b), "changes": diffDocumentTemplates(*a, *b),
+		})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not found"})
+	}
+}
+
+// adminDocumentRollback handles POST /documents/:id/rollback {version}. The
+// chosen version is saved again as a new version; a deleted template is
+// restored to the library.
+func adminDocumentRollback(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, action, _ := documentPath(r.URL.Path)
+	if action != "rollback" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not found"})
+		return
+	}
+	var body struct {
+		Version int `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	old := StoreGetDocumentVersion(id, body.Version)
+	if old == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Version not found"})
+		return
+	}
+	versions := StoreListDocumentVersions(id)
+	latest := versions[len(versions)-1]
+	userID, _, _ := GetSessionUser(r)
+	d := *old
+	d.UpdatedBy, d.RolledBackFrom = userID, old.Version
+	StoreSaveDocument(&d)
+	StoreAppendGlobalAudit("admin", userID, "document_rollback", map[string]interface{}{
+		"id": id, "fromVersion": latest.Version, "restoredVersion": old.Version, "version": d.Version,
+		"changes": diffDocumentTemplates(latest, d),
+	})
+	json.NewEncoder(w).Encode(viewDocumentVersion(d))
+}
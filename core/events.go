@@ -0,0 +1,197 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Live event types pushed to SRM and admin dashboards
+const (
+	EventSessionCreated     = "session_created"
+	EventClientConnected    = "client_connected"
+	EventClientDisconnected = "client_disconnected"
+	EventConsent            = "consent"
+	EventReview             = "review"
+	EventSessionTerminated  = "session_terminated"
+	EventSessionReassigned  = "session_reassigned"
+	EventDocumentUploaded   = "document_uploaded"
+	EventChecklistUpdated   = "checklist_updated"
+	EventSubmitted          = "submitted"
+)
+
+// LiveEvent is a session change pushed over /api/events
+type LiveEvent struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	SessionID string                 `json:"sessionId"`
+	AgentID   string                 `json:"agentId,omitempty"`
+	Status    SessionStatus          `json:"status,omitempty"`
+	Payload   map[string]interface{} `json:"payload,omitempty"`
+	CreatedAt time.Time              `json:"createdAt"`
+}
+
+type eventSubscriber struct {
+	userID string
+	perms  []Permission // the role's, narrowed to an API key's scopes
+	ch     chan LiveEvent
+}
+
+// eventPermissions may open the event stream
+var eventPermissions = []Permission{PermSessionCreate, PermSessionReview, PermAuditRead}
+
+// canSee reports whether the subscriber may receive ev: reviewers and auditors
+// see everything, supervisors their team's sessions, SRMs only their own.
+func (sub *eventSubscriber) canSee(ev LiveEvent) bool {
+	if containsPermission(sub.perms, PermSessionReview) || containsPermission(sub.perms, PermAuditRead) {
+		return true
+	}
+	if !containsPermission(sub.perms, PermSessionCreate) || ev.AgentID == "" {
+		return false
+	}
+	return ev.AgentID == sub.userID || supervises(sub.userID, ev.AgentID)
+}
+
+var (
+	eventSubsMu sync.RWMutex
+	eventSubs   = make(map[*eventSubscriber]struct{})
+)
+
+const (
+	eventBufferSize  = 32
+	eventKeepAlive   = 15 * time.Second
+	eventContentType = "text/event-stream"
+)
+
+func subscribeEvents(userID string, perms []Permission) *eventSubscriber {
+	sub := &eventSubscriber{userID: userID, perms: perms, ch: make(chan LiveEvent, eventBufferSize)}
+	eventSubsMu.Lock()
+	eventSubs[sub] = struct{}{}
+	eventSubsMu.Unlock()
+	return sub
+}
+
+// refreshEventSubscriber re-checks the stream's login at each keepalive. It
+// reports false once the login is revoked or expired, the user deactivated, or
+// their current role no longer opens the stream; otherwise it updates what
+// the subscriber may see to the role they have now.
+func refreshEventSubscriber(r *http.Request, sub *eventSubscriber) bool {
+	userID, _, ok := GetSessionUser(r)
+	if !ok || userID != sub.userID {
+		return false
+	}
+	u := StoreGetUser(userID)
+	if u == nil || !u.Active {
+		return false
+	}
+	if !RoleHasAnyPermission(u.Role, scopedPermissions(r, eventPermissions)...) {
+		return false
+	}
+	eventSubsMu.Lock()
+	sub.perms = requestPermissions(r, u.Role)
+	eventSubsMu.Unlock()
+	return true
+}
+
+func unsubscribeEvents(sub *eventSubscriber) {
+	eventSubsMu.Lock()
+	delete(eventSubs, sub)
+	eventSubsMu.Unlock()
+}
+
+// PublishEvent fans ev out to every subscriber allowed to see it, on this and
+// other instances. Slow subscribers whose buffer is full miss the event rather
+// than blocking callers.
+func PublishEvent(ev LiveEvent) {
+	if ev.ID == "" {
+		ev.ID = GetRandomName(1)
+	}
+	if ev.CreatedAt.IsZero() {
+		ev.CreatedAt = time.Now()
+	}
+	publishLocalEvent(ev)
+	publishState(stateMessage{Kind: stateEvent, Event: &ev})
+}
+
+func publishLocalEvent(ev LiveEvent) {
+	eventSubsMu.RLock()
+	defer eventSubsMu.RUnlock()
+	for sub := range eventSubs {
+		if !sub.canSee(ev) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+}
+
+// PublishSessionEvent publishes eventType for a CoBrowseSession, filling in
+// its owner and current status from the store.
+func PublishSessionEvent(sessionID, eventType string, payload map[string]interface{}) {
+	ev := LiveEvent{Type: eventType, SessionID: sessionID, Payload: payload}
+	if s := StoreGetSession(sessionID); s != nil {
+		ev.AgentID = s.AgentID
+		ev.Status = s.Status
+	}
+	PublishEvent(ev)
+}
+
+// apiEvents handles GET /api/events as a Server-Sent Events stream
+func apiEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	userID, role, authed := RequestCan(r, eventPermissions...)
+	if !authed {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "login required"})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sub := subscribeEvents(userID, requestPermissions(r, role))
+	defer unsubscribeEvents(sub)
+
+	w.Header().Set("Content-Type", eventContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if !refreshEventSubscriber(r, sub) {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev := <-sub.ch:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, b); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
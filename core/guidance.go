@@ -0,0 +1,142 @@
+package core
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Guidance message types relayed from viewer (SRM) to client over the room's WebSockets.
+const (
+	GuidancePointer              = "pointer"
+	GuidanceHighlight            = "highlight"
+	GuidanceRequestClick         = "requestClick"
+	GuidanceRequestClickResponse = "requestClickResponse"
+	GuidanceRateLimited          = "guidanceRateLimited"
+)
+
+const maxGuidanceValueSize = 2048
+
+// guidanceRule is the server-side rate limit for one guidance type
+type guidanceRule struct {
+	Rate  float64 // events per second
+	Burst float64
+}
+
+var guidanceRules = map[string]guidanceRule{
+	GuidancePointer:      {Rate: 30, Burst: 60},
+	GuidanceHighlight:    {Rate: 2, Burst: 5},
+	GuidanceRequestClick: {Rate: 0.2, Burst: 2},
+}
+
+// guidanceLimiter is a per-StreamSession token bucket keyed by guidance type
+type guidanceLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*guidanceBucket
+}
+
+type guidanceBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newGuidanceLimiter() *guidanceLimiter {
+	return &guidanceLimiter{buckets: make(map[string]*guidanceBucket)}
+}
+
+func (l *guidanceLimiter) allow(msgType string) bool {
+	rule, ok := guidanceRules[msgType]
+	if !ok {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b := l.buckets[msgType]
+	if b == nil {
+		b = &guidanceBucket{tokens: rule.Burst, last: now}
+		l.buckets[msgType] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rule.Rate
+	if b.tokens > rule.Burst {
+		b.tokens = rule.Burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// IsGuidanceType reports whether msgType is a viewer → client guidance event
+func IsGuidanceType(msgType string) bool {
+	_, ok := guidanceRules[msgType]
+	return ok
+}
+
+// parseGuidanceValue checks that a guidance Value is a bounded JSON object
+func parseGuidanceValue(value string) (map[string]interface{}, bool) {
+	if len(value) == 0 || len(value) > maxGuidanceValueSize {
+		return nil, false
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &v); err != nil || v == nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// relayGuidance validates and rate-limits a guidance event from the viewer and
+// forwards it to the client. Returns false when the event was dropped.
+func relayGuidance(s *StreamSession, msg WSMessage) bool {
+	if s.ViewerID == "" {
+		return false
+	}
+	v, ok := parseGuidanceValue(msg.Value)
+	if !ok {
+		return false
+	}
+	if !s.guidance.allow(msg.Type) {
+		// Through WriteCallee, so the notice is serialized with the caller's
+		// messages to the same viewer connection
+		_ = s.WriteCallee(WSMessage{
+			SessionID: s.ID,
+			Type:      GuidanceRateLimited,
+			Value:     msg.Type,
+		})
+		return false
+	}
+	if msg.Type == GuidanceRequestClick {
+		StoreAppendAudit(s.RoomID, string(s.ViewerRole), s.ViewerID, "guidance_request_click", map[string]interface{}{
+			"streamSessionId": s.ID,
+			"requestId":       v["id"],
+			"message":         v["message"],
+		})
+	}
+	if err := s.WriteCaller(msg); err != nil {
+		return false
+	}
+	return true
+}
+
+// recordGuidanceResponse audits the client's accept/decline of a request-click prompt
+func recordGuidanceResponse(s *StreamSession, msg WSMessage) {
+	v, ok := parseGuidanceValue(msg.Value)
+	if !ok {
+		return
+	}
+	accepted, _ := v["accepted"].(bool)
+	action := "guidance_request_click_declined"
+	if accepted {
+		action = "guidance_request_click_accepted"
+	}
+	clientIP := ""
+	if ses := StoreGetSession(s.RoomID); ses != nil {
+		clientIP = ses.ClientIPAtConnect
+	}
+	StoreAppendAudit(s.RoomID, "client", clientIP, action, map[string]interface{}{
+		"streamSessionId": s.ID,
+		"requestId":       v["id"],
+	})
+}
@@ -0,0 +1,292 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failed logins are tracked per account (email) and per client IP. Each
+// account failure delays the next attempt exponentially (1s, 2s, 4s … 30s);
+// an IP, which may be a shared NAT, only backs off past half its threshold.
+// Reaching a threshold locks the key for the lockout period. Counters are
+// forgotten once a key has been quiet for a lockout period. They are kept in
+// the broker, so the limits hold across instances; instances failing the same
+// key at the same moment may race, which at worst loses a count.
+const (
+	defaultLoginMaxFailures   = 5
+	defaultLoginIPMaxFailures = 20
+	defaultLoginLockout       = 15 * time.Minute
+	loginBackoffCap           = 30 * time.Second
+	maxLockoutIndex           = 1000
+)
+
+type loginThrottle struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LockedUntil time.Time `json:"lockedUntil,omitempty"`
+}
+
+// loginMu serialises counter updates on this instance
+var loginMu sync.Mutex
+
+func accountKey(email string) string { return "account:" + normalizeEmail(email) }
+func ipKey(ip string) string         { return "ip:" + ip }
+
+func lockoutKey(key string) string { return "laplace:lockout:" + key }
+
+// lockoutIndexKey lists the keys that have failed, oldest first, so admins
+// can list them from any instance
+const lockoutIndexKey = "laplace:lockouts"
+
+// loginIP is the client IP without the port, so every connection from one
+// address shares a counter
+func loginIP(r *http.Request) string {
+	return requestIP(r)
+}
+
+// loginLimits returns the account threshold, IP threshold and lockout period
+func loginLimits() (int, int, time.Duration) {
+	gs := StoreGetGlobalSettings()
+	acct, ip, lock := gs.LoginMaxFailures, gs.LoginIPMaxFailures, time.Duration(gs.LoginLockoutMinutes)*time.Minute
+	if acct <= 0 {
+		acct = defaultLoginMaxFailures
+	}
+	if ip <= 0 {
+		ip = defaultLoginIPMaxFailures
+	}
+	if lock <= 0 {
+		lock = defaultLoginLockout
+	}
+	return acct, ip, lock
+}
+
+// getThrottle returns the entry for key, or nil when there is none or it has
+// expired
+func getThrottle(key string, lockout time.Duration, now time.Time) *loginThrottle {
+	b, ok, err := getBroker().Get(lockoutKey(key))
+	if err != nil || !ok {
+		return nil
+	}
+	var t loginThrottle
+	if json.Unmarshal(b, &t) != nil {
+		return nil
+	}
+	if now.After(t.LockedUntil) && now.Sub(t.LastFailure) > lockout {
+		return nil
+	}
+	return &t
+}
+
+// saveThrottle stores t until it has been quiet for a lockout period
+func saveThrottle(t *loginThrottle, lockout time.Duration, now time.Time) {
+	until := t.LastFailure.Add(lockout)
+	if t.LockedUntil.After(until) {
+		until = t.LockedUntil
+	}
+	b, _ := json.Marshal(t)
+	if err := getBroker().Set(lockoutKey(t.Key), b, until.Sub(now)); err != nil {
+		log.Printf("[auth] Failed to save login failures: %v", err)
+	}
+}
+
+func lockoutIndex() []string {
+	b, ok, err := getBroker().Get(lockoutIndexKey)
+	if err != nil || !ok {
+		return nil
+	}
+	var keys []string
+	json.Unmarshal(b, &keys)
+	return keys
+}
+
+// saveLockoutIndex keeps the newest maxLockoutIndex keys, so attempts with
+// random emails cannot grow it without bound. A key dropped from the index
+// is still counted; it is only missing from the admin list. Expired keys are
+// pruned when the list is read.
+func saveLockoutIndex(keys []string) {
+	if len(keys) > maxLockoutIndex {
+		keys = keys[len(keys)-maxLockoutIndex:]
+	}
+	if len(keys) == 0 {
+		_ = getBroker().Del(lockoutIndexKey)
+		return
+	}
+	b, _ := json.Marshal(keys)
+	_ = getBroker().Set(lockoutIndexKey, b, 0)
+}
+
+// loginWait reports how long the client must wait before another attempt for
+// email from ip, and whether that is because of a lockout
+func loginWait(email, ip string) (time.Duration, bool) {
+	_, _, lockout := loginLimits()
+	now := time.Now()
+	var wait time.Duration
+	locked := false
+	for _, key := range []string{accountKey(email), ipKey(ip)} {
+		t := getThrottle(key, lockout, now)
+		if t == nil {
+			continue
+		}
+		if now.Before(t.LockedUntil) {
+			locked = true
+			if d := t.LockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		} else if d := t.NextAttempt.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, locked
+}
+
+// recordLoginFailure counts a failed attempt for email and ip and records
+// login_failed, plus account_locked when a threshold is reached
+func recordLoginFailure(email, ip, reason string) {
+	maxAcct, maxIP, lockout := loginLimits()
+	now := time.Now()
+	type lockEvent struct {
+		scope, key string
+		failures   int
+	}
+	var locks []lockEvent
+	failures := 0
+	var added []string
+	loginMu.Lock()
+	for _, k := range []struct {
+		key, scope string
+		max, free  int // free: failures before backoff starts
+	}{{accountKey(email), "account", maxAcct, 0}, {ipKey(ip), "ip", maxIP, maxIP / 2}} {
+		t := getThrottle(k.key, lockout, now)
+		if t == nil {
+			t = &loginThrottle{Key: k.key}
+			added = append(added, k.key)
+		}
+		t.Failures++
+		t.LastFailure = now
+		if n := t.Failures - k.free; n > 0 {
+			backoff := time.Duration(math.Pow(2, float64(n-1))) * time.Second
+			if backoff > loginBackoffCap {
+				backoff = loginBackoffCap
+			}
+			t.NextAttempt = now.Add(backoff)
+		}
+		if t.Failures >= k.max && !now.Before(t.LockedUntil) {
+			t.LockedUntil = now.Add(lockout)
+			locks = append(locks, lockEvent{k.scope, k.key, t.Failures})
+		}
+		saveThrottle(t, lockout, now)
+		if k.scope == "account" {
+			failures = t.Failures
+		}
+	}
+	if len(added) > 0 {
+		keys := lockoutIndex()
+		for _, key := range added {
+			keys = append(removeString(keys, key), key)
+		}
+		saveLockoutIndex(keys)
+	}
+	loginMu.Unlock()
+
+	actorID := ""
+	if u := StoreGetUserByEmail(normalizeEmail(email)); u != nil {
+		actorID = u.ID
+	}
+	StoreAppendGlobalAudit("", actorID, "login_failed", map[string]interface{}{
+		"email": email, "ip": ip, "reason": reason, "failures": failures,
+	})
+	for _, l := range locks {
+		StoreAppendGlobalAudit("", actorID, "account_locked", map[string]interface{}{
+			"email": email, "ip": ip, "scope": l.scope, "failures": l.failures, "until": now.Add(lockout),
+		})
+	}
+}
+
+// clearLoginFailures resets the account counter after a successful login.
+// The IP counter is left to expire so one good account cannot unlock an IP.
+func clearLoginFailures(email string) {
+	_ = getBroker().Del(lockoutKey(accountKey(email)))
+}
+
+// writeLoginThrottled answers a throttled login with 429 and Retry-After
+func writeLoginThrottled(w http.ResponseWriter, wait time.Duration, locked bool) {
+	secs := int(math.Ceil(wait.Seconds()))
+	msg := fmt.Sprintf("Too many failed attempts. Try again in %d seconds.", secs)
+	if locked {
+		msg = fmt.Sprintf("Too many failed attempts. Sign-in is locked for %d minutes.", int(math.Ceil(wait.Minutes())))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", fmt.Sprint(secs))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": msg, "retryAfter": secs, "locked": locked})
+}
+
+// adminListLockouts handles GET /lockouts: keys currently locked or backing off
+func adminListLockouts(w http.ResponseWriter, r *http.Request) {
+	_, _, lockout := loginLimits()
+	now := time.Now()
+	list := []loginThrottle{}
+	var live []string
+	loginMu.Lock()
+	for _, key := range lockoutIndex() {
+		if t := getThrottle(key, lockout, now); t != nil {
+			list = append(list, *t)
+			live = append(live, key)
+		}
+	}
+	saveLockoutIndex(live)
+	loginMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].LastFailure.After(list[j].LastFailure) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"lockouts": list})
+}
+
+// adminDeleteLockout handles DELETE /lockouts?key=account:<email>|ip:<addr>
+func adminDeleteLockout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	key := strings.TrimSpace(r.URL.Query().Get("key"))
+	if !strings.HasPrefix(key, "account:") && !strings.HasPrefix(key, "ip:") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "key must be account:<email> or ip:<address>"})
+		return
+	}
+	if strings.HasPrefix(key, "account:") {
+		key = accountKey(strings.TrimPrefix(key, "account:"))
+	}
+	unlockLogin(w, r, key)
+}
+
+// adminUnlockUser handles POST /users/:id/unlock
+func adminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !strings.HasSuffix(r.URL.Path, "/unlock") {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not found"})
+		return
+	}
+	u := StoreGetUser(firstSegment(r.URL.Path, "/users/"))
+	if u == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+	unlockLogin(w, r, accountKey(u.Email))
+}
+
+func unlockLogin(w http.ResponseWriter, r *http.Request, key string) {
+	_, _, lockout := loginLimits()
+	found := getThrottle(key, lockout, time.Now()) != nil
+	_ = getBroker().Del(lockoutKey(key))
+	userID, role, _ := GetSessionUser(r)
+	StoreAppendGlobalAudit(string(role), userID, "account_unlocked", map[string]interface{}{"key": key})
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "wasLocked": found})
+}
@@ -0,0 +1,264 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Each user's login session IDs are indexed in the broker so their logins can
+// be listed and revoked from any instance. Logins are shown and revoked by a
+// handle derived from the session ID, which is the cookie secret.
+
+const defaultLoginIdle = 60 * time.Minute
+
+// loginIndexMu serialises index updates on this instance; instances sharing a
+// broker may still race, which at worst leaves a stale entry that is pruned
+// on the next listing.
+var loginIndexMu sync.Mutex
+
+func loginIdleTimeout() time.Duration {
+	if m := StoreGetGlobalSettings().LoginIdleMinutes; m > 0 {
+		return time.Duration(m) * time.Minute
+	}
+	return defaultLoginIdle
+}
+
+func userLoginsKey(userID string) string { return "laplace:logins:" + userID }
+
+// loginHandle is the public ID of a login session
+func loginHandle(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// userLoginIDs returns the session IDs indexed for userID
+func userLoginIDs(userID string) []string {
+	b, ok, err := getBroker().Get(userLoginsKey(userID))
+	if err != nil || !ok {
+		return nil
+	}
+	var ids []string
+	json.Unmarshal(b, &ids)
+	return ids
+}
+
+func saveUserLoginIDs(userID string, ids []string) {
+	if len(ids) == 0 {
+		_ = getBroker().Del(userLoginsKey(userID))
+		return
+	}
+	b, _ := json.Marshal(ids)
+	if err := getBroker().Set(userLoginsKey(userID), b, time.Duration(maxAge)*time.Second); err != nil {
+		log.Printf("[auth] Failed to index login session: %v", err)
+	}
+}
+
+func addUserLogin(userID, sessionID string) {
+	loginIndexMu.Lock()
+	defer loginIndexMu.Unlock()
+	ids := userLoginIDs(userID)
+	for _, id := range ids {
+		if id == sessionID {
+			return
+		}
+	}
+	saveUserLoginIDs(userID, append(ids, sessionID))
+}
+
+func removeUserLogin(userID, sessionID string) {
+	loginIndexMu.Lock()
+	defer loginIndexMu.Unlock()
+	saveUserLoginIDs(userID, removeString(userLoginIDs(userID), sessionID))
+}
+
+// loginView is one login session as listed by the API
+type loginView struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"userId"`
+	Email     string    `json:"email"`
+	Role      Role      `json:"role"`
+	Method    string    `json:"method"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Expires   time.Time `json:"expires"` // when it ends if left idle
+	Current   bool      `json:"current,omitempty"`
+}
+
+// userLogins returns the live logins of userID, newest activity first, keyed
+// by handle, and drops ended ones from the index
+func userLogins(userID, currentSID string) ([]loginView, map[string]string) {
+	idle := loginIdleTimeout()
+	var views []loginView
+	sids := make(map[string]string)
+	var live []string
+	for _, sid := range userLoginIDs(userID) {
+		info := liveSession(sid)
+		if info == nil {
+			continue
+		}
+		live = append(live, sid)
+		sessionsMu.RLock()
+		v := loginView{
+			ID: loginHandle(sid), UserID: info.UserID, Email: info.Email, Role: info.Role,
+			Method: info.Method, IP: info.IP, UserAgent: info.UserAgent,
+			CreatedAt: info.CreatedAt, LastSeen: info.LastSeen, Expires: info.LastSeen.Add(idle),
+			Current: sid == currentSID,
+		}
+		sessionsMu.RUnlock()
+		if v.Expires.After(info.Expires) {
+			v.Expires = info.Expires
+		}
+		views = append(views, v)
+		sids[v.ID] = sid
+	}
+	loginIndexMu.Lock()
+	saveUserLoginIDs(userID, live)
+	loginIndexMu.Unlock()
+	sort.Slice(views, func(i, j int) bool { return views[i].LastSeen.After(views[j].LastSeen) })
+	return views, sids
+}
+
+// revokeUserLogins ends every login of userID except keepSID and returns how
+// many were ended
+func revokeUserLogins(userID, keepSID string) int {
+	n := 0
+	for _, sid := range userLoginIDs(userID) {
+		if sid != keepSID {
+			DestroySession(sid)
+			n++
+		}
+	}
+	return n
+}
+
+// revokeLogin ends one login of userID by handle and audits it. It returns
+// false for an unknown handle.
+func revokeLogin(r *http.Request, userID, handle, reason string) bool {
+	_, sids := userLogins(userID, "")
+	sid, ok := sids[handle]
+	if !ok {
+		return false
+	}
+	DestroySession(sid)
+	actorID, role, _ := GetSessionUser(r)
+	StoreAppendGlobalAudit(string(role), actorID, "login_revoked", map[string]interface{}{
+		"userId": userID, "loginId": handle, "count": 1, "reason": reason,
+	})
+	return true
+}
+
+// revokeLoginsFor ends every login of userID except keepSID and audits it
+// when any were ended
+func revokeLoginsFor(r *http.Request, userID, keepSID, reason string) {
+	actorID, role, _ := GetSessionUser(r)
+	if n := revokeUserLogins(userID, keepSID); n > 0 {
+		StoreAppendGlobalAudit(string(role), actorID, "login_revoked", map[string]interface{}{
+			"userId": userID, "count": n, "reason": reason,
+		})
+	}
+}
+
+// apiListLogins handles GET /api/logins: the caller's own logins
+func apiListLogins(w http.ResponseWriter, r *http.Request) {
+	userID, _, _ := GetSessionUser(r)
+	views, _ := userLogins(userID, getSessionFromRequest(r))
+	if views == nil {
+		views = []loginView{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"logins": views})
+}
+
+// apiRevokeLogins handles DELETE /api/logins/:id, and DELETE /api/logins to
+// sign out everywhere else
+func apiRevokeLogins(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID, _, _ := GetSessionUser(r)
+	handle := firstSegment(r.URL.Path, "/logins/")
+	if handle == "" {
+		revokeLoginsFor(r, userID, getSessionFromRequest(r), "self")
+	} else if !revokeLogin(r, userID, handle, "self") {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Login not found"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
+
+// adminListLogins handles GET /logins: every live login of the users on this
+// instance
+func adminListLogins(w http.ResponseWriter, r *http.Request) {
+	current := getSessionFromRequest(r)
+	list := []loginView{}
+	for _, u := range StoreListUsers("") {
+		views, _ := userLogins(u.ID, current)
+		list = append(list, views...)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].LastSeen.After(list[j].LastSeen) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"logins": list})
+}
+
+// adminUserLogins handles GET /users/:id/logins
+func adminUserLogins(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !strings.HasSuffix(r.URL.Path, "/logins") {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not found"})
+		return
+	}
+	u := StoreGetUser(firstSegment(r.URL.Path, "/users/"))
+	if u == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+	views, _ := userLogins(u.ID, getSessionFromRequest(r))
+	if views == nil {
+		views = []loginView{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"logins": views})
+}
+
+// adminUserDelete handles DELETE /users/:id/2fa and
+// DELETE /users/:id/logins[/:loginId]
+func adminUserDelete(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.URL.Path, "/logins") {
+		adminReset2FA(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	u := StoreGetUser(firstSegment(r.URL.Path, "/users/"))
+	if u == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+	_, role, _ := GetSessionUser(r)
+	if u.Role == RoleAdmin && role != RoleAdmin {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Only an admin can sign out an admin"})
+		return
+	}
+	handle := ""
+	if i := strings.Index(r.URL.Path, "/logins/"); i >= 0 {
+		handle = firstSegment(r.URL.Path[i:], "/logins/")
+	}
+	if handle == "" {
+		revokeLoginsFor(r, u.ID, "", "admin")
+	} else if !revokeLogin(r, u.ID, handle, "admin") {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Login not found"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
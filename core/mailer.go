@@ -0,0 +1,148 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends transactional email such as password reset links. SMTP is for
+// production; the log and file mailers stand in during development. There is
+// no mailer until one is configured, and password reset by email is off.
+type Mailer interface {
+	Send(m Mail) error
+}
+
+// Mail is one plain-text message
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+var (
+	mailerMu sync.RWMutex
+	mailer   Mailer
+)
+
+func getMailer() Mailer {
+	mailerMu.RLock()
+	defer mailerMu.RUnlock()
+	return mailer
+}
+
+// SetMailer replaces the process mailer
+func SetMailer(m Mailer) {
+	mailerMu.Lock()
+	mailer = m
+	mailerMu.Unlock()
+}
+
+// NewMailerFromURL returns the mailer for a -mail flag value: "" or "none"
+// for no mailer, "log" to write messages to the server log, file:///path to
+// append them to a file, smtp://[user:password@]host:port?from=address for an
+// SMTP relay. The relay is sent STARTTLS when it offers it.
+func NewMailerFromURL(raw string) (Mailer, error) {
+	raw = strings.TrimSpace(raw)
+	switch raw {
+	case "", "none":
+		return nil, nil
+	case "log":
+		return logMailer{}, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("mail: %v", err)
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("mail: file:// needs a path")
+		}
+		return &FileMailer{Path: u.Path}, nil
+	case "smtp":
+		from := u.Query().Get("from")
+		if u.Host == "" || from == "" {
+			return nil, fmt.Errorf("mail: want smtp://[user:password@]host:port?from=address")
+		}
+		m := &SMTPMailer{Addr: u.Host, From: from}
+		if u.User != nil {
+			m.Username = u.User.Username()
+			m.Password, _ = u.User.Password()
+		}
+		if _, _, err := net.SplitHostPort(m.Addr); err != nil {
+			m.Addr = net.JoinHostPort(m.Addr, "587")
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("mail: unsupported scheme %q", u.Scheme)
+}
+
+// IsDevMailer reports whether m only writes messages locally
+func IsDevMailer(m Mailer) bool {
+	_, isSMTP := m.(*SMTPMailer)
+	return !isSMTP
+}
+
+// SMTPMailer sends through an SMTP relay
+type SMTPMailer struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Mail) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, formatMail(m.From, msg))
+}
+
+// FileMailer appends each message to a file, for development and tests
+type FileMailer struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (m *FileMailer) Send(msg Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(formatMail("laplace", msg), "\r\n"...))
+	return err
+}
+
+// logMailer writes each message to the server log. Reset links in the log
+// work, so it is for development only.
+type logMailer struct{}
+
+func (logMailer) Send(msg Mail) error {
+	log.Printf("[mail] To: %s\nSubject: %s\n\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+func formatMail(from string, msg Mail) []byte {
+	// Header values come from the server, but strip line breaks regardless
+	clean := strings.NewReplacer("\r", "", "\n", "").Replace
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", clean(from))
+	fmt.Fprintf(&b, "To: %s\r\n", clean(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", clean(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
@@ -0,0 +1,572 @@
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenID Connect single sign-on for staff: authorization code flow with PKCE
+// (S256). The ID token is verified against the issuer's JWKS; the email claim
+// identifies the user, and a configurable claim maps to a role. Unknown users
+// are provisioned just in time.
+
+// OIDCConfig configures the identity provider. RoleMap maps values of
+// RoleClaim (a string or list of strings) to roles; DefaultRole applies when
+// nothing matches, and an empty DefaultRole refuses such users.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // e.g. https://cobrowse.example.com/api/oidc/callback
+	Scopes       []string
+	RoleClaim    string
+	RoleMap      map[string]Role
+	DefaultRole  Role
+	Label        string // login button text
+	// TrustIdPMFA accepts SSO logins for roles in require2faRoles without an
+	// amr claim showing a second factor, for IdPs that enforce MFA themselves
+	// but do not report it
+	TrustIdPMFA bool
+}
+
+const (
+	oidcStateTTL  = 10 * time.Minute
+	oidcClockSkew = 2 * time.Minute
+)
+
+var (
+	oidcMu     sync.Mutex
+	oidcConfig *OIDCConfig
+	oidcMeta   *oidcDiscovery
+	oidcKeys   map[string]crypto.PublicKey // kid -> key
+	oidcClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// SetOIDC enables SSO with cfg; a nil cfg or empty Issuer disables it
+func SetOIDC(cfg *OIDCConfig) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	oidcMeta, oidcKeys = nil, nil
+	if cfg == nil || cfg.Issuer == "" || cfg.ClientID == "" {
+		oidcConfig = nil
+		return
+	}
+	c := *cfg
+	c.Issuer = strings.TrimRight(c.Issuer, "/")
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "email", "profile"}
+	}
+	if c.RoleClaim == "" {
+		c.RoleClaim = "groups"
+	}
+	if c.Label == "" {
+		c.Label = "Sign in with SSO"
+	}
+	oidcConfig = &c
+}
+
+func getOIDC() *OIDCConfig {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	return oidcConfig
+}
+
+// ParseRoleMap parses "value=role,value=role" as used by -oidc-role-map
+func ParseRoleMap(s string) (map[string]Role, error) {
+	m := make(map[string]Role)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 || i == len(pair)-1 {
+			return nil, fmt.Errorf("oidc: bad role mapping %q", pair)
+		}
+		m[strings.TrimSpace(pair[:i])] = Role(strings.TrimSpace(pair[i+1:]))
+	}
+	return m, nil
+}
+
+// passwordLoginAllowed is false when settings disable passwords and SSO is on
+func passwordLoginAllowed() bool {
+	return !StoreGetGlobalSettings().PasswordLoginDisabled || getOIDC() == nil
+}
+
+func oidcDiscover(cfg *OIDCConfig) (*oidcDiscovery, error) {
+	oidcMu.Lock()
+	meta := oidcMeta
+	oidcMu.Unlock()
+	if meta != nil {
+		return meta, nil
+	}
+	meta = &oidcDiscovery{}
+	if err := oidcGetJSON(cfg.Issuer+"/.well-known/openid-configuration", meta); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(meta.Issuer, "/") != cfg.Issuer {
+		return nil, fmt.Errorf("oidc: discovery issuer %q does not match %q", meta.Issuer, cfg.Issuer)
+	}
+	oidcMu.Lock()
+	oidcMeta = meta
+	oidcMu.Unlock()
+	return meta, nil
+}
+
+func oidcGetJSON(u string, v interface{}) error {
+	resp, err := oidcClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// oidcKey returns the signing key kid, refetching the JWKS once for unknown kids
+func oidcKey(meta *oidcDiscovery, kid string) (crypto.PublicKey, error) {
+	oidcMu.Lock()
+	key, ok := oidcKeys[kid]
+	oidcMu.Unlock()
+	if ok {
+		return key, nil
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := oidcGetJSON(meta.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	oidcMu.Lock()
+	oidcKeys = keys
+	oidcMu.Unlock()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("oidc: no key %q in JWKS", kid)
+}
+
+// verifyIDToken checks the signature (RS256 or ES256), issuer, audience,
+// expiry and nonce of a compact JWT and returns its claims
+func verifyIDToken(cfg *OIDCConfig, meta *oidcDiscovery, token, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("oidc: malformed signature")
+	}
+	key, err := oidcKey(meta, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("oidc: bad ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("oidc: bad ID token signature")
+		}
+	default:
+		return nil, errors.New("oidc: unsupported key type")
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimRight(iss, "/") != cfg.Issuer {
+		return nil, errors.New("oidc: wrong issuer")
+	}
+	if !claimContains(claims["aud"], cfg.ClientID) {
+		return nil, errors.New("oidc: wrong audience")
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().Add(-oidcClockSkew).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("oidc: ID token expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("oidc: nonce mismatch")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("oidc: malformed ID token")
+	}
+	return json.Unmarshal(b, v)
+}
+
+// claimStrings returns a claim that is a string or a list of strings
+func claimStrings(v interface{}) []string {
+	switch x := v.(type) {
+	case string:
+		return []string{x}
+	case []interface{}:
+		var out []string
+		for _, e := range x {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func claimContains(v interface{}, want string) bool {
+	for _, s := range claimStrings(v) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+// mapOIDCRole picks the role for a user's claims. The first RoleClaim value
+// with a mapping wins, admin before anything else; otherwise DefaultRole.
+func mapOIDCRole(cfg *OIDCConfig, claims map[string]interface{}) Role {
+	var found []Role
+	for _, v := range claimStrings(claims[cfg.RoleClaim]) {
+		if role, ok := cfg.RoleMap[v]; ok {
+			if role == RoleAdmin {
+				return role
+			}
+			found = append(found, role)
+		}
+	}
+	if len(found) > 0 {
+		return found[0]
+	}
+	return cfg.DefaultRole
+}
+
+// oidcState is what the login keeps in the broker between redirect and
+// callback, so any instance can complete the flow
+type oidcState struct {
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	Next     string `json:"next"`
+}
+
+func oidcStateKey(state string) string { return "laplace:oidc:" + state }
+
+func randomURLToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// safeNext keeps post-login redirects on this site
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return ""
+	}
+	return next
+}
+
+// apiOIDCInfo handles GET /api/oidc, telling login pages whether to offer SSO
+func apiOIDCInfo(w http.ResponseWriter, r *http.Request) {
+	cfg := getOIDC()
+	resp := map[string]interface{}{"enabled": cfg != nil, "passwordLogin": passwordLoginAllowed()}
+	if cfg != nil {
+		resp["label"] = cfg.Label
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// apiOIDCLogin handles GET /api/oidc/login?next=, redirecting to the IdP
+func apiOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	cfg := getOIDC()
+	if cfg == nil {
+		http.NotFound(w, r)
+		return
+	}
+	meta, err := oidcDiscover(cfg)
+	if err != nil {
+		log.Println("[oidc] discovery:", err)
+		oidcFail(w, r, "Single sign-on is unavailable")
+		return
+	}
+	state := randomURLToken(24)
+	st := oidcState{Verifier: randomURLToken(32), Nonce: randomURLToken(16), Next: safeNext(r.URL.Query().Get("next"))}
+	b, _ := json.Marshal(st)
+	if err := getBroker().Set(oidcStateKey(state), b, oidcStateTTL); err != nil {
+		oidcFail(w, r, "Single sign-on is unavailable")
+		return
+	}
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", cfg.ClientID)
+	q.Set("redirect_uri", cfg.RedirectURL)
+	q.Set("scope", strings.Join(cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", st.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, meta.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// oidcFail sends the browser back to the login page with an error message
+func oidcFail(w http.ResponseWriter, r *http.Request, msg string) {
+	http.Redirect(w, r, "/srm/login?sso_error="+url.QueryEscape(msg), http.StatusFound)
+}
+
+// apiOIDCCallback handles GET /api/oidc/callback?code=&state=
+func apiOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	cfg := getOIDC()
+	if cfg == nil {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	state := q.Get("state")
+	b, ok, err := getBroker().Get(oidcStateKey(state))
+	if state == "" || err != nil || !ok {
+		oidcFail(w, r, "Sign-in expired, try again")
+		return
+	}
+	getBroker().Del(oidcStateKey(state))
+	var st oidcState
+	if json.Unmarshal(b, &st) != nil {
+		oidcFail(w, r, "Sign-in expired, try again")
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		log.Println("[oidc] provider error:", e, q.Get("error_description"))
+		oidcFail(w, r, "Sign-in was cancelled or refused")
+		return
+	}
+	meta, err := oidcDiscover(cfg)
+	if err != nil {
+		oidcFail(w, r, "Single sign-on is unavailable")
+		return
+	}
+	claims, err := oidcExchange(cfg, meta, q.Get("code"), st)
+	if err != nil {
+		log.Println("[oidc]", err)
+		StoreAppendGlobalAudit("", "", "login_failed", map[string]interface{}{"method": "oidc", "reason": err.Error(), "ip": requestIP(r)})
+		oidcFail(w, r, "Single sign-on failed")
+		return
+	}
+	u, msg := oidcUser(cfg, claims)
+	if u == nil {
+		email, _ := claims["email"].(string)
+		StoreAppendGlobalAudit("", "", "login_failed", map[string]interface{}{"method": "oidc", "email": email, "reason": msg, "ip": requestIP(r)})
+		oidcFail(w, r, msg)
+		return
+	}
+	redirect := startLogin(w, r, u, "oidc")
+	if st.Next != "" && redirect == homePath(u.Role) {
+		redirect = st.Next
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// oidcExchange trades the authorization code for tokens and verifies the ID token
+func oidcExchange(cfg *OIDCConfig, meta *oidcDiscovery, code string, st oidcState) (map[string]interface{}, error) {
+	if code == "" {
+		return nil, errors.New("oidc: missing code")
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", cfg.RedirectURL)
+	form.Set("client_id", cfg.ClientID)
+	form.Set("code_verifier", st.Verifier)
+	if cfg.ClientSecret != "" {
+		form.Set("client_secret", cfg.ClientSecret)
+	}
+	resp, err := oidcClient.PostForm(meta.TokenEndpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("oidc: token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return nil, fmt.Errorf("oidc: token endpoint: %s %s", resp.Status, tok.Error)
+	}
+	return verifyIDToken(cfg, meta, tok.IDToken, st.Nonce)
+}
+
+// oidcMFAValues are amr claim values (RFC 8176) showing more than a password.
+// hwk and swk only prove a key was used, which may be the sole factor (a
+// passkey without user verification), so they do not count.
+var oidcMFAValues = []string{"mfa", "otp", "sc", "fpt", "face", "iris", "retina", "vbm"}
+
+// oidcMFA reports whether the ID token says the user signed in with a second factor
+func oidcMFA(claims map[string]interface{}) bool {
+	for _, v := range oidcMFAValues {
+		if claimContains(claims["amr"], v) {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcUser finds or provisions the local user for verified claims and keeps
+// their role in sync with the IdP. It returns a user-facing reason on refusal.
+// An existing local account is only linked by email when the IdP asserts
+// email_verified; after that the account is matched on the IdP subject. SSO
+// users never need a local password change, and roles in require2faRoles must
+// show a second factor in the amr claim instead of enrolling TOTP here.
+func oidcUser(cfg *OIDCConfig, claims map[string]interface{}) (*User, string) {
+	email, _ := claims["email"].(string)
+	email = normalizeEmail(email)
+	sub, _ := claims["sub"].(string)
+	if email == "" || sub == "" {
+		return nil, "Your identity provider did not supply an email address"
+	}
+	verified, _ := claims["email_verified"].(bool)
+	if v, ok := claims["email_verified"].(bool); ok && !v {
+		return nil, "Your email address is not verified"
+	}
+	role := mapOIDCRole(cfg, claims)
+	if role == "" || role == RoleClient || StoreGetRole(role) == nil {
+		return nil, "Your account is not allowed to use this application"
+	}
+	needMFA := func(r Role) bool { return role2FARequired(r) && !cfg.TrustIdPMFA && !oidcMFA(claims) }
+	mfaRefused := "Your role requires multi-factor sign-in at your identity provider"
+	u := StoreGetUserByEmail(email)
+	if u == nil {
+		if needMFA(role) {
+			return nil, mfaRefused
+		}
+		h, err := HashPassword(randomURLToken(32)) // unusable; SSO users sign in through the IdP
+		if err != nil {
+			return nil, "Single sign-on failed"
+		}
+		if u, _ = StoreCreateUser(email, role, h); u == nil {
+			return nil, "Single sign-on failed"
+		}
+		StoreUpdateUser(u.ID, func(x *User) bool {
+			x.OIDCSubject = sub
+			return true
+		})
+		StoreAppendGlobalAudit("oidc", u.ID, "user_provisioned", map[string]interface{}{"email": email, "role": role})
+		return u, ""
+	}
+	if u.Service {
+		return nil, "Your account is not allowed to use this application"
+	}
+	if !u.Active {
+		return nil, "Account is disabled"
+	}
+	switch {
+	case u.OIDCSubject == sub:
+	case u.OIDCSubject != "":
+		return nil, "This email address is linked to a different single sign-on account"
+	case !verified:
+		return nil, "Your identity provider did not confirm this email address, so it cannot be linked to the existing account"
+	}
+	finalRole := u.Role
+	if len(cfg.RoleMap) > 0 {
+		finalRole = role
+	}
+	if needMFA(finalRole) {
+		return nil, mfaRefused
+	}
+	if u.OIDCSubject == "" {
+		StoreUpdateUser(u.ID, func(x *User) bool {
+			x.OIDCSubject = sub
+			return true
+		})
+		StoreAppendGlobalAudit("oidc", u.ID, "user_linked", map[string]interface{}{"email": email})
+	}
+	// With a role map the IdP is the source of truth, so a user removed from
+	// a group loses its role at next login; without one, roles are local.
+	if len(cfg.RoleMap) > 0 && u.Role != role {
+		from := u.Role
+		StoreUpdateUser(u.ID, func(x *User) bool {
+			x.Role = role
+			return true
+		})
+		u.Role = role
+		StoreAppendGlobalAudit("oidc", u.ID, "user_role_change", map[string]interface{}{"agentId": u.ID, "from": from, "to": role})
+	}
+	return u, ""
+}
@@ -0,0 +1,406 @@
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIdP is an httptest OpenID provider: discovery, a JWKS with one RSA and
+// one P-256 key, an authorization endpoint that approves at once and a token
+// endpoint that enforces PKCE (S256) before issuing an ID token.
+type fakeIdP struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu sync.Mutex
+	// alg is RS256 or ES256; claims are merged into the next ID tokens
+	alg    string
+	claims map[string]interface{}
+	// forge signs with a key the JWKS does not hold
+	forge bool
+	// codes issued by /authorize, with the PKCE challenge and nonce
+	codes map[string]fakeIdPCode
+}
+
+type fakeIdPCode struct {
+	challenge, nonce, redirectURI string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeIdP{t: t, rsaKey: rk, ecKey: ek, alg: "RS256", codes: make(map[string]fakeIdPCode)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.srv.URL,
+			"authorization_endpoint": f.srv.URL + "/authorize",
+			"token_endpoint":         f.srv.URL + "/token",
+			"jwks_uri":               f.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kid": "rsa1", "kty": "RSA", "use": "sig", "n": b64(rk.N.Bytes()), "e": b64(big.NewInt(int64(rk.E)).Bytes())},
+			{"kid": "ec1", "kty": "EC", "use": "sig", "crv": "P-256", "x": b64(ek.X.FillBytes(make([]byte, 32))), "y": b64(ek.Y.FillBytes(make([]byte, 32)))},
+			{"kid": "enc1", "kty": "RSA", "use": "enc", "n": b64(rk.N.Bytes()), "e": "AQAB"},
+		}})
+	})
+	mux.HandleFunc("/authorize", f.authorize)
+	mux.HandleFunc("/token", f.token)
+	f.srv = httptest.NewServer(mux)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeIdP) set(alg string, claims map[string]interface{}) {
+	f.mu.Lock()
+	f.alg, f.claims, f.forge = alg, claims, false
+	f.mu.Unlock()
+}
+
+func (f *fakeIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != "cobrowse" || q.Get("code_challenge_method") != "S256" ||
+		q.Get("code_challenge") == "" || q.Get("state") == "" || q.Get("nonce") == "" {
+		f.t.Errorf("authorize: bad request %s", r.URL.RawQuery)
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	code := randomURLToken(12)
+	f.mu.Lock()
+	f.codes[code] = fakeIdPCode{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), redirectURI: q.Get("redirect_uri")}
+	f.mu.Unlock()
+	http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+}
+
+func (f *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	f.mu.Lock()
+	c, ok := f.codes[r.PostForm.Get("code")]
+	delete(f.codes, r.PostForm.Get("code"))
+	alg, extra, forge := f.alg, f.claims, f.forge
+	f.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !ok, r.PostForm.Get("grant_type") != "authorization_code", r.PostForm.Get("redirect_uri") != c.redirectURI:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	case base64.RawURLEncoding.EncodeToString(sum[:]) != c.challenge:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+	claims := map[string]interface{}{
+		"iss": f.srv.URL, "aud": "cobrowse", "exp": time.Now().Add(time.Minute).Unix(), "iat": time.Now().Unix(), "nonce": c.nonce,
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": f.sign(alg, claims, forge), "token_type": "Bearer"})
+}
+
+func (f *fakeIdP) sign(alg string, claims map[string]interface{}, forge bool) string {
+	kid := "rsa1"
+	if alg == "ES256" {
+		kid = "ec1"
+	}
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(input))
+	var sig []byte
+	if alg == "ES256" {
+		key := f.ecKey
+		if forge {
+			key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	} else {
+		key := f.rsaKey
+		if forge {
+			key, _ = rsa.GenerateKey(rand.Reader, 2048)
+		}
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// oidcTestSetup points SSO at a new fake IdP and restores settings afterwards
+func oidcTestSetup(t *testing.T, cfg OIDCConfig) *fakeIdP {
+	t.Helper()
+	idp := newFakeIdP(t)
+	cfg.Issuer, cfg.ClientID, cfg.RedirectURL = idp.srv.URL, "cobrowse", "https://cobrowse.test/api/oidc/callback"
+	SetOIDC(&cfg)
+	gs := StoreGetGlobalSettings()
+	t.Cleanup(func() {
+		SetOIDC(nil)
+		StoreSetGlobalSettings(gs)
+	})
+	return idp
+}
+
+// oidcLogin runs the browser's side of a sign-in: /api/oidc/login, the IdP's
+// authorization endpoint, then /api/oidc/callback. It returns the callback's
+// redirect and login session ID, and the callback URL so it can be replayed.
+func oidcLogin(t *testing.T, idp *fakeIdP, next string) (location, sid, callback string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	apiOIDCLogin(rec, httptest.NewRequest(http.MethodGet, "/api/oidc/login?next="+url.QueryEscape(next), nil))
+	authURL := rec.Header().Get("Location")
+	if rec.Code != http.StatusFound || !strings.HasPrefix(authURL, idp.srv.URL+"/authorize?") {
+		t.Fatalf("login: %d %s", rec.Code, authURL)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback = resp.Header.Get("Location")
+	location, sid = oidcCallback(t, callback)
+	return location, sid, callback
+}
+
+func oidcCallback(t *testing.T, callback string) (location, sid string) {
+	t.Helper()
+	u, err := url.Parse(callback)
+	if err != nil || !strings.HasPrefix(callback, "https://cobrowse.test/api/oidc/callback?") {
+		t.Fatalf("IdP redirected to %q", callback)
+	}
+	rec := httptest.NewRecorder()
+	apiOIDCCallback(rec, httptest.NewRequest(http.MethodGet, "/api/oidc/callback?"+u.RawQuery, nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("callback: %d", rec.Code)
+	}
+	if cookies := rec.Result().Cookies(); len(cookies) > 0 {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		sid = getSessionFromRequest(r)
+	}
+	return rec.Header().Get("Location"), sid
+}
+
+func ssoError(location string) string {
+	if !strings.HasPrefix(location, "/srm/login?sso_error=") {
+		return ""
+	}
+	u, _ := url.Parse(location)
+	return u.Query().Get("sso_error")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := oidcTestSetup(t, OIDCConfig{RoleMap: map[string]Role{"cobrowse-admins": RoleAdmin}, DefaultRole: RoleSRM})
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		email := strings.ToLower(alg) + "@oidc.test"
+		idp.set(alg, map[string]interface{}{"sub": "sub-" + alg, "email": email, "email_verified": true})
+		loc, cookie, callback := oidcLogin(t, idp, "/srm/sessions")
+		if loc != "/srm/sessions" || cookie == "" {
+			t.Fatalf("%s: redirected to %q, cookie %q", alg, loc, cookie)
+		}
+		u := StoreGetUserByEmail(email)
+		if u == nil || u.Role != RoleSRM || u.OIDCSubject != "sub-"+alg {
+			t.Fatalf("%s: provisioned %+v", alg, u)
+		}
+		if info := validSession(cookie); info == nil || info.UserID != u.ID || info.awaitingPasswordChange() {
+			t.Fatalf("%s: login session %+v", alg, info)
+		}
+		// The state is single use
+		if loc, cookie := oidcCallback(t, callback); ssoError(loc) == "" || cookie != "" {
+			t.Fatalf("%s: replayed callback: %q %q", alg, loc, cookie)
+		}
+	}
+
+	// Off-site next is ignored; the admin group maps to admin
+	idp.set("RS256", map[string]interface{}{"sub": "sub-boss", "email": "boss@oidc.test", "groups": []string{"staff", "cobrowse-admins"}})
+	if loc, _, _ := oidcLogin(t, idp, "//evil.test/"); loc != homePath(RoleAdmin) {
+		t.Fatalf("admin redirected to %q", loc)
+	}
+	if u := StoreGetUserByEmail("boss@oidc.test"); u == nil || u.Role != RoleAdmin {
+		t.Fatalf("admin provisioned as %+v", u)
+	}
+	// and leaving the group demotes at next login
+	idp.set("RS256", map[string]interface{}{"sub": "sub-boss", "email": "boss@oidc.test", "groups": []string{"staff"}})
+	oidcLogin(t, idp, "")
+	if u := StoreGetUserByEmail("boss@oidc.test"); u.Role != RoleSRM {
+		t.Fatalf("role after leaving the admin group: %s", u.Role)
+	}
+}
+
+func TestOIDCLoginRejects(t *testing.T) {
+	idp := oidcTestSetup(t, OIDCConfig{DefaultRole: RoleSRM})
+	rec := httptest.NewRecorder()
+	apiOIDCCallback(rec, httptest.NewRequest(http.MethodGet, "/api/oidc/callback?code=x&state=unknown", nil))
+	if ssoError(rec.Header().Get("Location")) == "" {
+		t.Fatalf("unknown state: %s", rec.Header().Get("Location"))
+	}
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		idp.set(alg, map[string]interface{}{"sub": "sub-forged", "email": "forged@oidc.test"})
+		idp.mu.Lock()
+		idp.forge = true
+		idp.mu.Unlock()
+		if loc, cookie, _ := oidcLogin(t, idp, ""); ssoError(loc) == "" || cookie != "" {
+			t.Fatalf("%s token with a key outside the JWKS: %q", alg, loc)
+		}
+	}
+	for name, claims := range map[string]map[string]interface{}{
+		"nonce":    {"sub": "s", "email": "n@oidc.test", "nonce": "other"},
+		"audience": {"sub": "s", "email": "a@oidc.test", "aud": "someone-else"},
+		"issuer":   {"sub": "s", "email": "i@oidc.test", "iss": "https://evil.test"},
+		"expired":  {"sub": "s", "email": "e@oidc.test", "exp": time.Now().Add(-time.Hour).Unix()},
+		"no email": {"sub": "s"},
+	} {
+		idp.set("RS256", claims)
+		if loc, cookie, _ := oidcLogin(t, idp, ""); ssoError(loc) == "" || cookie != "" {
+			t.Errorf("%s: signed in (%q)", name, loc)
+		}
+	}
+	if StoreGetUserByEmail("forged@oidc.test") != nil || StoreGetUserByEmail("n@oidc.test") != nil {
+		t.Fatal("a rejected login provisioned a user")
+	}
+
+	// PKCE: the token endpoint refuses a verifier that does not match the
+	// challenge sent with the authorization request
+	idp.set("RS256", map[string]interface{}{"sub": "s-pkce", "email": "pkce@oidc.test"})
+	rec = httptest.NewRecorder()
+	apiOIDCLogin(rec, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+	q, _ := url.ParseQuery(strings.SplitN(rec.Header().Get("Location"), "?", 2)[1])
+	var st oidcState
+	b, _, _ := getBroker().Get(oidcStateKey(q.Get("state")))
+	json.Unmarshal(b, &st)
+	sum := sha256.Sum256([]byte(st.Verifier))
+	if q.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(sum[:]) || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("challenge %q does not match the stored verifier", q.Get("code_challenge"))
+	}
+	st.Verifier = randomURLToken(32)
+	b, _ = json.Marshal(st)
+	getBroker().Set(oidcStateKey(q.Get("state")), b, time.Minute)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if loc, cookie := oidcCallback(t, resp.Header.Get("Location")); ssoError(loc) == "" || cookie != "" {
+		t.Fatalf("wrong PKCE verifier signed in: %q", loc)
+	}
+}
+
+func TestOIDCLinking(t *testing.T) {
+	idp := oidcTestSetup(t, OIDCConfig{DefaultRole: RoleSRM})
+	local, err := StoreCreateUser("local@oidc.test", RoleSRM, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, verified := range []interface{}{nil, false, "true"} {
+		claims := map[string]interface{}{"sub": "idp-local", "email": "LOCAL@oidc.test"}
+		if verified != nil {
+			claims["email_verified"] = verified
+		}
+		idp.set("RS256", claims)
+		if loc, cookie, _ := oidcLogin(t, idp, ""); ssoError(loc) == "" || cookie != "" {
+			t.Fatalf("email_verified %v linked the account: %q", verified, loc)
+		}
+	}
+	if u := StoreGetUser(local.ID); u.OIDCSubject != "" {
+		t.Fatalf("linked without a verified email: %q", u.OIDCSubject)
+	}
+
+	idp.set("RS256", map[string]interface{}{"sub": "idp-local", "email": "local@oidc.test", "email_verified": true})
+	if loc, cookie, _ := oidcLogin(t, idp, ""); cookie == "" || ssoError(loc) != "" {
+		t.Fatalf("verified email not linked: %q", loc)
+	}
+	if u := StoreGetUser(local.ID); u.OIDCSubject != "idp-local" {
+		t.Fatalf("subject after linking: %q", u.OIDCSubject)
+	}
+	// Once linked, the subject decides: unverified is fine for it, and
+	// another subject with the same email is refused
+	idp.set("RS256", map[string]interface{}{"sub": "idp-local", "email": "local@oidc.test"})
+	if _, cookie, _ := oidcLogin(t, idp, ""); cookie == "" {
+		t.Fatal("linked subject refused")
+	}
+	idp.set("RS256", map[string]interface{}{"sub": "idp-other", "email": "local@oidc.test", "email_verified": true})
+	if loc, cookie, _ := oidcLogin(t, idp, ""); ssoError(loc) == "" || cookie != "" {
+		t.Fatalf("second subject took over the account: %q", loc)
+	}
+}
+
+func TestOIDCRequiresMFA(t *testing.T) {
+	idp := oidcTestSetup(t, OIDCConfig{DefaultRole: RoleSRM})
+	gs := StoreGetGlobalSettings()
+	gs.Require2FARoles = []Role{RoleSRM}
+	StoreSetGlobalSettings(gs)
+
+	for i, c := range []struct {
+		amr  interface{}
+		want bool
+	}{
+		{nil, false},
+		{[]string{"pwd"}, false},
+		{[]string{"pwd", "hwk"}, false},
+		{[]string{"swk"}, false},
+		{"mfa", true},
+		{[]string{"pwd", "otp"}, true},
+		{[]string{"hwk", "fpt"}, true},
+	} {
+		claims := map[string]interface{}{"sub": "mfa-sub", "email": "mfa@oidc.test", "email_verified": true}
+		if c.amr != nil {
+			claims["amr"] = c.amr
+		}
+		idp.set("ES256", claims)
+		loc, cookie, _ := oidcLogin(t, idp, "")
+		if got := cookie != ""; got != c.want {
+			t.Errorf("case %d amr %v: signed in %v (%q)", i, c.amr, got, loc)
+		}
+		if cookie != "" {
+			if info := validSession(cookie); info == nil || info.awaiting2FAEnrollment() {
+				t.Errorf("case %d: SSO login must not have to enroll TOTP: %+v", i, info)
+			}
+		}
+	}
+
+	cfg := *getOIDC()
+	cfg.TrustIdPMFA = true
+	SetOIDC(&cfg)
+	idp.set("RS256", map[string]interface{}{"sub": "mfa-sub", "email": "mfa@oidc.test", "email_verified": true})
+	if loc, cookie, _ := oidcLogin(t, idp, ""); cookie == "" {
+		t.Fatalf("TrustIdPMFA refused a login without amr: %q", loc)
+	}
+}
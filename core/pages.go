@@ -0,0 +1,140 @@
+package core
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HTML page handlers. Access and cache headers come from the route table.
+
+// firstSegment returns the first path segment after prefix, trimmed
+func firstSegment(path, prefix string) string {
+	id := strings.TrimPrefix(path, prefix)
+	if idx := strings.Index(id, "/"); idx >= 0 {
+		id = id[:idx]
+	}
+	return strings.TrimSpace(id)
+}
+
+// rootPage sends / to the SRM landing; anything else unmatched is a 404
+func rootPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		http.Redirect(w, r, "/srm", http.StatusFound)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func connectPage(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "files/connect.html")
+}
+
+func joinPage(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "files/join.html")
+}
+
+// roomRedirect sends /room/:id to the client stream page
+func roomRedirect(w http.ResponseWriter, r *http.Request) {
+	roomID := firstSegment(r.URL.Path, "/room/")
+	if roomID == "" {
+		http.Redirect(w, r, "/join", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/stream.html?stream=1&room="+url.QueryEscape(roomID), http.StatusFound)
+}
+
+func streamPage(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "files/main.html")
+}
+
+// isClientStream reports whether /stream.html is opened by a client sharing
+// (stream=1&room=) rather than an SRM viewing (id=)
+func isClientStream(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Get("stream") == "1" && q.Get("room") != ""
+}
+
+func srmLoginPage(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "files/agent-login.html")
+}
+
+func adminLoginPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	http.ServeFile(w, r, "files/admin-login.html")
+}
+
+// twoFactorPage is TOTP enrollment and management; it also works while a
+// required enrollment is pending
+func twoFactorPage(w http.ResponseWriter, r *http.Request) {
+	if loginUser(r) == nil {
+		http.Redirect(w, r, "/srm/login", http.StatusFound)
+		return
+	}
+	http.ServeFile(w, r, "files/2fa.html")
+}
+
+// passwordPage is the change-password form; it also works while a required
+// change is pending
+func passwordPage(w http.ResponseWriter, r *http.Request) {
+	if loginUser(r) == nil {
+		http.Redirect(w, r, "/srm/login", http.StatusFound)
+		return
+	}
+	http.ServeFile(w, r, "files/password.html")
+}
+
+// passwordResetPage asks for the account email, or with ?token= for the new
+// password
+func passwordResetPage(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "files/reset-password.html")
+}
+
+// redirectTo returns a handler that permanently redirects to target
+func redirectTo(target string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	}
+}
+
+// agentRedirect maps the legacy /agent/* paths onto /srm/*
+func agentRedirect(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "/srm"+strings.TrimPrefix(r.URL.Path, "/agent"), http.StatusMovedPermanently)
+}
+
+// srmHome is the landing page when logged out and the SRM dashboard when logged in
+func srmHome(w http.ResponseWriter, r *http.Request) {
+	if !IsAuthenticated(r) {
+		http.ServeFile(w, r, "files/landing.html")
+		return
+	}
+	http.ServeFile(w, r, "files/agent.html")
+}
+
+// srmPages serves /srm/*, redirecting /srm/session/:roomId and /viewer/:roomId
+// to the viewer stream page
+func srmPages(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if path == "/srm/" {
+		srmHome(w, r)
+		return
+	}
+	for _, prefix := range []string{"/viewer/", "/srm/session/"} {
+		if strings.HasPrefix(path, prefix) {
+			if roomID := firstSegment(path, prefix); roomID != "" {
+				http.Redirect(w, r, "/stream.html?id="+url.QueryEscape(roomID), http.StatusFound)
+				return
+			}
+		}
+	}
+	if strings.HasPrefix(path, "/srm/") {
+		http.ServeFile(w, r, "files/agent.html")
+		return
+	}
+	http.Redirect(w, r, "/srm", http.StatusFound)
+}
+
+// adminPage serves the admin SPA for /admin and /admin/*
+func adminPage(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, "files/admin.html")
+}
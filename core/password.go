@@ -0,0 +1,272 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Password policy defaults, used while the matching setting is zero
+const (
+	defaultPasswordMinLength  = 10
+	defaultPasswordMinClasses = 3
+	defaultPasswordHistory    = 5
+)
+
+// breachedPasswordsFile is a bundled list of common and leaked passwords, one
+// per line; lines starting with # are comments. Matching is case-insensitive.
+const breachedPasswordsFile = "files/breached-passwords.txt"
+
+var (
+	breachedOnce sync.Once
+	breached     map[string]bool
+)
+
+// passwordPolicy is the effective policy, as returned by GET /api/password
+type passwordPolicy struct {
+	MinLength  int `json:"minLength"`
+	MinClasses int `json:"minClasses"` // of lowercase, uppercase, digit, symbol
+	ExpiryDays int `json:"expiryDays"` // 0 = passwords never expire
+	History    int `json:"history"`    // previous passwords that cannot be reused
+}
+
+func currentPasswordPolicy() passwordPolicy {
+	gs := StoreGetGlobalSettings()
+	p := passwordPolicy{
+		MinLength:  gs.PasswordMinLength,
+		MinClasses: gs.PasswordMinClasses,
+		ExpiryDays: gs.PasswordExpiryDays,
+		History:    gs.PasswordHistory,
+	}
+	if p.MinLength <= 0 {
+		p.MinLength = defaultPasswordMinLength
+	}
+	if p.MinClasses <= 0 {
+		p.MinClasses = defaultPasswordMinClasses
+	}
+	if p.MinClasses > 4 {
+		p.MinClasses = 4
+	}
+	if p.History <= 0 {
+		p.History = defaultPasswordHistory
+	}
+	return p
+}
+
+func loadBreachedPasswords() {
+	breached = make(map[string]bool)
+	f, err := os.Open(breachedPasswordsFile)
+	if err != nil {
+		log.Printf("[password] Breached password list not loaded: %v", err)
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			breached[strings.ToLower(line)] = true
+		}
+	}
+}
+
+func breachedPassword(pw string) bool {
+	breachedOnce.Do(loadBreachedPasswords)
+	return breached[strings.ToLower(pw)]
+}
+
+// check returns why pw does not meet the policy for the account email, or ""
+func (p passwordPolicy) check(pw, email string) string {
+	if len([]rune(pw)) < p.MinLength {
+		return fmt.Sprintf("Password must be at least %d characters", p.MinLength)
+	}
+	var lower, upper, digit, symbol bool
+	for _, c := range pw {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	classes := 0
+	for _, ok := range []bool{lower, upper, digit, symbol} {
+		if ok {
+			classes++
+		}
+	}
+	if classes < p.MinClasses {
+		return fmt.Sprintf("Password must mix at least %d of lowercase, uppercase, digits and symbols", p.MinClasses)
+	}
+	if local := strings.SplitN(normalizeEmail(email), "@", 2)[0]; len(local) >= 3 && strings.Contains(strings.ToLower(pw), local) {
+		return "Password must not contain your email name"
+	}
+	if breachedPassword(pw) {
+		return "This password is too common or has appeared in a data breach"
+	}
+	return ""
+}
+
+// passwordReused reports whether pw is the current password or one of the
+// last history passwords of u
+func passwordReused(u *User, pw string, history int) bool {
+	if u.Password != "" && checkPassword(u.Password, pw) {
+		return true
+	}
+	for i, h := range u.PasswordHistory {
+		if i >= history {
+			break
+		}
+		if checkPassword(h, pw) {
+			return true
+		}
+	}
+	return false
+}
+
+// setPassword replaces the password hash of u, keeping the old one in the
+// reuse history. Call it inside StoreUpdateUser, with history read before
+// taking the store lock.
+func setPassword(u *User, hash string, history int) {
+	if u.Password != "" {
+		u.PasswordHistory = append([]string{u.Password}, u.PasswordHistory...)
+		if len(u.PasswordHistory) > history {
+			u.PasswordHistory = u.PasswordHistory[:history]
+		}
+	}
+	u.Password = hash
+	u.PasswordChangedAt = time.Now()
+}
+
+// passwordExpiresAt returns when the password of u expires, or the zero time
+func passwordExpiresAt(u *User, p passwordPolicy) time.Time {
+	if p.ExpiryDays <= 0 {
+		return time.Time{}
+	}
+	set := u.PasswordChangedAt
+	if set.IsZero() {
+		set = u.CreatedAt
+	}
+	return set.AddDate(0, 0, p.ExpiryDays)
+}
+
+// needsPasswordChange reports whether the user must set a new password before
+// using the app: after creation or an admin reset, or once it has expired
+func needsPasswordChange(userID string) bool {
+	u := StoreGetUser(userID)
+	if u == nil {
+		return false
+	}
+	if u.MustChangePassword {
+		return true
+	}
+	exp := passwordExpiresAt(u, currentPasswordPolicy())
+	return !exp.IsZero() && time.Now().After(exp)
+}
+
+// apiPasswordStatus handles GET /api/password: the policy and whether a change
+// is due. It also works while a forced change is pending.
+func apiPasswordStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	u := loginUser(r)
+	if u == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+	p := currentPasswordPolicy()
+	resp := map[string]interface{}{
+		"policy":     p,
+		"mustChange": needsPasswordChange(u.ID),
+		"expired":    !u.MustChangePassword && needsPasswordChange(u.ID),
+		"home":       homePath(u.Role),
+	}
+	if exp := passwordExpiresAt(u, p); !exp.IsZero() {
+		resp["expiresAt"] = exp
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// apiPasswordChange handles POST /api/password {currentPassword, newPassword}
+func apiPasswordChange(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	info := validSession(getSessionFromRequest(r))
+	var u *User
+	if info != nil {
+		u = StoreGetUser(info.UserID)
+	}
+	if u == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized"})
+		return
+	}
+	var body struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	current := strings.TrimSpace(body.CurrentPassword)
+	next := strings.TrimSpace(body.NewPassword)
+	ip := loginIP(r)
+	if wait, locked := loginWait(u.Email, ip); wait > 0 {
+		writeLoginThrottled(w, wait, locked)
+		return
+	}
+	if !checkPassword(u.Password, current) {
+		recordLoginFailure(u.Email, ip, "Invalid current password")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Current password is incorrect"})
+		return
+	}
+	p := currentPasswordPolicy()
+	if msg := p.check(next, u.Email); msg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+	if passwordReused(u, next, p.History) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Choose a password you have not used recently"})
+		return
+	}
+	h, err := HashPassword(next)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to change password"})
+		return
+	}
+	reason := "self"
+	if u.MustChangePassword {
+		reason = "required"
+	} else if needsPasswordChange(u.ID) {
+		reason = "expired"
+	}
+	StoreUpdateUser(u.ID, func(usr *User) bool {
+		setPassword(usr, h, p.History)
+		usr.MustChangePassword = false
+		return true
+	})
+	StoreAppendGlobalAudit(string(u.Role), u.ID, "password_change", map[string]interface{}{"reason": reason})
+	// Other devices signed in with the old password are signed out
+	revokeLoginsFor(r, u.ID, getSessionFromRequest(r), "password_change")
+	redirect := homePath(u.Role)
+	if info.awaiting2FAEnrollment() {
+		redirect = "/2fa"
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "redirect": redirect})
+}
@@ -0,0 +1,301 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A forgotten password is reset through a single-use link emailed to the
+// account. The link token is kept in the broker only as a SHA-256 hash, and
+// stops working once used, once a newer link is sent, once the password
+// changes by any other means, or after PasswordResetMinutes. Requests are
+// answered the same way whether or not the email belongs to an account.
+
+const (
+	defaultPasswordResetTTL = 30 * time.Minute
+	resetRequestsPerIP      = 10 // per hour
+	resetRequestsPerEmail   = 3  // per hour
+)
+
+// passwordResetToken is the broker record of an emailed reset link
+type passwordResetToken struct {
+	Email  string    `json:"email"`
+	Issued time.Time `json:"issued"`
+}
+
+var (
+	publicURLMu sync.RWMutex
+	publicURL   string
+
+	resetLimitMu sync.Mutex
+	resetLimits  = make(map[string]*guidanceBucket) // "ip:<addr>" or "email:<addr>" -> token bucket
+)
+
+// SetPublicURL sets the external base URL used in emailed links, e.g.
+// https://cobrowse.example.com. Without one, links use the request's host,
+// which is only safe in development.
+func SetPublicURL(u string) {
+	publicURLMu.Lock()
+	publicURL = strings.TrimRight(u, "/")
+	publicURLMu.Unlock()
+}
+
+func linkBase(r *http.Request) string {
+	publicURLMu.RLock()
+	base := publicURL
+	publicURLMu.RUnlock()
+	if base != "" {
+		return base
+	}
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host
+}
+
+func passwordResetTTL() time.Duration {
+	if m := StoreGetGlobalSettings().PasswordResetMinutes; m > 0 {
+		return time.Duration(m) * time.Minute
+	}
+	return defaultPasswordResetTTL
+}
+
+func passwordResetKey(hash string) string      { return "laplace:pwreset:" + hash }
+func passwordResetUserKey(email string) string { return "laplace:pwreset-user:" + email }
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// allowResetRequest takes one request from key's hourly bucket on this instance
+func allowResetRequest(key string, perHour float64) bool {
+	resetLimitMu.Lock()
+	defer resetLimitMu.Unlock()
+	now := time.Now()
+	if len(resetLimits) > 1000 {
+		// An hour idle refills any bucket, so those entries carry nothing
+		for k, b := range resetLimits {
+			if now.Sub(b.last) > time.Hour {
+				delete(resetLimits, k)
+			}
+		}
+	}
+	b := resetLimits[key]
+	if b == nil {
+		b = &guidanceBucket{tokens: perHour, last: now}
+		resetLimits[key] = b
+	}
+	b.tokens += now.Sub(b.last).Hours() * perHour
+	if b.tokens > perHour {
+		b.tokens = perHour
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// resettableUser returns the account a reset link may be sent to or used for
+func resettableUser(email string) *User {
+	u := StoreGetUserByEmail(normalizeEmail(email))
+	if u == nil || u.Service || !u.Active || u.Role == RoleClient {
+		return nil
+	}
+	return u
+}
+
+// issuePasswordReset stores a new reset token for u, replacing any earlier
+// one, and returns it
+func issuePasswordReset(u *User, ttl time.Duration) (string, error) {
+	token := randomURLToken(32)
+	hash := hashResetToken(token)
+	b, _ := json.Marshal(passwordResetToken{Email: u.Email, Issued: time.Now()})
+	if old, ok, _ := getBroker().Get(passwordResetUserKey(u.Email)); ok {
+		_ = getBroker().Del(passwordResetKey(string(old)))
+	}
+	if err := getBroker().Set(passwordResetKey(hash), b, ttl); err != nil {
+		return "", err
+	}
+	_ = getBroker().Set(passwordResetUserKey(u.Email), []byte(hash), ttl)
+	return token, nil
+}
+
+// lookupPasswordReset returns the account a reset token is valid for
+func lookupPasswordReset(token string) (*User, string) {
+	if token == "" {
+		return nil, ""
+	}
+	hash := hashResetToken(token)
+	b, ok, err := getBroker().Get(passwordResetKey(hash))
+	if err != nil || !ok {
+		return nil, ""
+	}
+	var t passwordResetToken
+	if json.Unmarshal(b, &t) != nil {
+		return nil, ""
+	}
+	u := resettableUser(t.Email)
+	if u == nil || u.PasswordChangedAt.After(t.Issued) {
+		return nil, ""
+	}
+	return u, hash
+}
+
+// sendPasswordReset emails a reset link when email belongs to an account
+// that may reset its password, and audits the request either way
+func sendPasswordReset(email, ip, base string) {
+	audit := map[string]interface{}{"email": email, "ip": ip}
+	defer func() { StoreAppendGlobalAudit("", "", "password_reset_requested", audit) }()
+	u := resettableUser(email)
+	if u == nil {
+		audit["sent"], audit["reason"] = false, "unknown or inactive account"
+		return
+	}
+	m := getMailer()
+	if m == nil {
+		audit["sent"], audit["reason"] = false, "no mailer"
+		return
+	}
+	if !allowResetRequest("email:"+u.Email, resetRequestsPerEmail) {
+		audit["sent"], audit["reason"] = false, "rate limited"
+		return
+	}
+	ttl := passwordResetTTL()
+	token, err := issuePasswordReset(u, ttl)
+	if err != nil {
+		log.Printf("[password] Failed to store reset token: %v", err)
+		audit["sent"], audit["reason"] = false, "error"
+		return
+	}
+	company := StoreGetGlobalSettings().CompanyName
+	err = m.Send(Mail{
+		To:      u.Email,
+		Subject: "Reset your " + company + " password",
+		Body: fmt.Sprintf("Someone asked to reset the password for your %s co-browse account.\n\n"+
+			"Open this link within %d minutes to choose a new password:\n\n%s/password/reset?token=%s\n\n"+
+			"The link works once. If you did not ask for this, ignore this email; your password has not changed.\n",
+			company, int(ttl.Minutes()), base, token),
+	})
+	if err != nil {
+		log.Printf("[password] Failed to send reset email: %v", err)
+		audit["sent"], audit["reason"] = false, "mail error"
+		return
+	}
+	audit["sent"] = true
+}
+
+// apiPasswordForgot handles POST /api/password/forgot {email}. The answer does
+// not depend on whether the email belongs to an account; the email is sent in
+// the background so timing does not tell either.
+func apiPasswordForgot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !passwordLoginAllowed() {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Password login is disabled; use single sign-on"})
+		return
+	}
+	if getMailer() == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Password reset by email is not set up. Ask an administrator to reset your password."})
+		return
+	}
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || normalizeEmail(body.Email) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Email required"})
+		return
+	}
+	ip := loginIP(r)
+	if !allowResetRequest("ip:"+ip, resetRequestsPerIP) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Too many reset requests. Try again later."})
+		return
+	}
+	go sendPasswordReset(normalizeEmail(body.Email), ip, linkBase(r))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":      true,
+		"message": "If the address belongs to an account, a reset link is on its way.",
+	})
+}
+
+// apiPasswordResetStatus handles GET /api/password/reset?token=: whether the
+// link is still valid, and the password policy for the form
+func apiPasswordResetStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	u, _ := lookupPasswordReset(r.URL.Query().Get("token"))
+	if u == nil {
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(map[string]string{"error": "This reset link is invalid or has expired"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"valid": true, "email": u.Email, "policy": currentPasswordPolicy()})
+}
+
+// apiPasswordReset handles POST /api/password/reset {token, newPassword}. It
+// uses up the token and signs the account out everywhere.
+func apiPasswordReset(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	u, hash := lookupPasswordReset(body.Token)
+	if u == nil {
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(map[string]string{"error": "This reset link is invalid or has expired"})
+		return
+	}
+	next := strings.TrimSpace(body.NewPassword)
+	p := currentPasswordPolicy()
+	if msg := p.check(next, u.Email); msg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+	if passwordReused(u, next, p.History) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Choose a password you have not used recently"})
+		return
+	}
+	h, err := HashPassword(next)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to reset password"})
+		return
+	}
+	_ = getBroker().Del(passwordResetKey(hash))
+	_ = getBroker().Del(passwordResetUserKey(u.Email))
+	StoreUpdateUser(u.ID, func(usr *User) bool {
+		setPassword(usr, h, p.History)
+		usr.MustChangePassword = false
+		return true
+	})
+	clearLoginFailures(u.Email)
+	StoreAppendGlobalAudit(string(u.Role), u.ID, "password_change", map[string]interface{}{"reason": "reset", "ip": loginIP(r)})
+	if n := revokeUserLogins(u.ID, ""); n > 0 {
+		StoreAppendGlobalAudit(string(u.Role), u.ID, "login_revoked", map[string]interface{}{
+			"userId": u.ID, "count": n, "reason": "password_reset",
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "redirect": homePath(u.Role) + "/login"})
+}
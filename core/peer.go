@@ -0,0 +1,100 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// serverPeer is an in-process participant in a room, such as the recorder.
+// It receives the caller's signaling in place of a viewer WebSocket.
+type serverPeer interface {
+	HandleSignal(msg WSMessage)
+}
+
+// newPeerAPI returns a WebRTC API limited to VP8 video and Opus audio so
+// server-side peers can write and forward media without transcoding.
+func newPeerAPI() (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		PayloadType:        96,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return nil, err
+	}
+	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		PayloadType:        111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m)), nil
+}
+
+// serverICEServers returns the STUN servers configured in GlobalSettings
+func serverICEServers() []webrtc.ICEServer {
+	urls := StoreGetGlobalSettings().StunURLs
+	if len(urls) == 0 {
+		urls = []string{defaultStunURL}
+	}
+	return []webrtc.ICEServer{{URLs: urls}}
+}
+
+// answerPeer answers offers from the caller for one StreamSession as if it were
+// a viewer. Its own candidates are sent inside the answer rather than trickled:
+// pion fires candidate callbacks on its own goroutines, and the caller's
+// WebSocket must not be written concurrently.
+type answerPeer struct {
+	pc      *webrtc.PeerConnection
+	session *StreamSession
+}
+
+func newAnswerPeer(s *StreamSession) (*answerPeer, error) {
+	api, err := newPeerAPI()
+	if err != nil {
+		return nil, err
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{ICEServers: serverICEServers()})
+	if err != nil {
+		return nil, err
+	}
+	return &answerPeer{pc: pc, session: s}, nil
+}
+
+// handleCallerSignal applies an offer or ICE candidate from the caller
+func (p *answerPeer) handleCallerSignal(msg WSMessage) {
+	switch msg.Type {
+	case "gotOffer":
+		var offer webrtc.SessionDescription
+		if err := json.Unmarshal([]byte(msg.Value), &offer); err != nil {
+			log.Println("peer: bad offer.", err)
+			return
+		}
+		if err := p.pc.SetRemoteDescription(offer); err != nil {
+			log.Println("peer: set remote description.", err)
+			return
+		}
+		answer, err := p.pc.CreateAnswer(nil)
+		if err != nil {
+			log.Println("peer: create answer.", err)
+			return
+		}
+		gathered := webrtc.GatheringCompletePromise(p.pc)
+		if err := p.pc.SetLocalDescription(answer); err != nil {
+			log.Println("peer: set local description.", err)
+			return
+		}
+		<-gathered
+		b, _ := json.Marshal(p.pc.LocalDescription())
+		_ = p.session.WriteCaller(WSMessage{SessionID: p.session.ID, Type: "gotAnswer", Value: string(b)})
+	case "addCallerIceCandidate":
+		var c webrtc.ICECandidateInit
+		if err := json.Unmarshal([]byte(msg.Value), &c); err != nil {
+			return
+		}
+		if err := p.pc.AddICECandidate(c); err != nil {
+			log.Println("peer: add ICE candidate.", err)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Permission is a named capability granted to roles
+type Permission string
+
+const (
+	PermSessionCreate   Permission = "session.create"   // create and run own co-browse sessions
+	PermSessionReview   Permission = "session.review"   // see all sessions, review and terminate them
+	PermDocumentsManage Permission = "documents.manage" // edit the document library
+	PermSettingsEdit    Permission = "settings.edit"    // change global settings and onboarding flow
+	PermAuditRead       Permission = "audit.read"       // read-only access to sessions, evidence and audit logs
+	PermUsersManage     Permission = "users.manage"     // manage staff accounts and roles
+)
+
+// AllPermissions lists every permission known to the server
+var AllPermissions = []Permission{
+	PermSessionCreate, PermSessionReview, PermDocumentsManage,
+	PermSettingsEdit, PermAuditRead, PermUsersManage,
+}
+
+// adminConsolePermissions are the permissions that give access to /admin
+var adminConsolePermissions = []Permission{
+	PermSessionReview, PermDocumentsManage, PermSettingsEdit, PermAuditRead, PermUsersManage,
+}
+
+// RoleDef is a named set of permissions. Built-in roles cannot be deleted and
+// the admin role always holds every permission.
+type RoleDef struct {
+	Name        Role         `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Permissions []Permission `json:"permissions"`
+	BuiltIn     bool         `json:"builtIn"`
+	UpdatedAt   time.Time    `json:"updatedAt"`
+}
+
+func defaultRoles() map[Role]*RoleDef {
+	now := time.Now()
+	return map[Role]*RoleDef{
+		RoleAdmin:  {Name: RoleAdmin, Description: "Full access", Permissions: AllPermissions, BuiltIn: true, UpdatedAt: now},
+		RoleSRM:    {Name: RoleSRM, Description: "Sales Relationship Manager", Permissions: []Permission{PermSessionCreate}, BuiltIn: true, UpdatedAt: now},
+		RoleClient: {Name: RoleClient, Description: "Client (no login)", Permissions: []Permission{}, BuiltIn: true, UpdatedAt: now},
+	}
+}
+
+func isKnownPermission(p Permission) bool {
+	for _, k := range AllPermissions {
+		if k == p {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleHasPermission reports whether role currently grants perm
+func RoleHasPermission(role Role, perm Permission) bool {
+	if role == RoleAdmin {
+		return true
+	}
+	def := StoreGetRole(role)
+	if def == nil {
+		return false
+	}
+	for _, p := range def.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleHasAnyPermission reports whether role grants at least one of perms
+func RoleHasAnyPermission(role Role, perms ...Permission) bool {
+	for _, p := range perms {
+		if RoleHasPermission(role, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// rolePermissions lists the permissions role currently grants
+func rolePermissions(role Role) []Permission {
+	perms := []Permission{}
+	for _, p := range AllPermissions {
+		if RoleHasPermission(role, p) {
+			perms = append(perms, p)
+		}
+	}
+	return perms
+}
+
+// RequestCan returns the logged-in user when their role grants any of perms.
+// A request made with an API key is further limited to the key's scopes.
+func RequestCan(r *http.Request, perms ...Permission) (string, Role, bool) {
+	userID, role, ok := GetSessionUser(r)
+	if !ok || !RoleHasAnyPermission(role, scopedPermissions(r, perms)...) {
+		return userID, role, false
+	}
+	return userID, role, true
+}
+
+// homePath is where a user with role lands after login
+func homePath(role Role) string {
+	if role == RoleAdmin || (!RoleHasPermission(role, PermSessionCreate) && RoleHasAnyPermission(role, adminConsolePermissions...)) {
+		return "/admin"
+	}
+	return "/srm"
+}
+
+// assignableRole checks that actor may give role to a staff account: the role
+// must exist, must not be admin or client, and may not grant permissions the
+// actor lacks. It returns an error message or "".
+func assignableRole(actor, role Role) string {
+	def := StoreGetRole(role)
+	if def == nil {
+		return "Unknown role: " + string(role)
+	}
+	if role == RoleAdmin || role == RoleClient {
+		return "Role cannot be assigned: " + string(role)
+	}
+	for _, p := range def.Permissions {
+		if !RoleHasPermission(actor, p) {
+			return "Cannot assign a role with permission " + string(p)
+		}
+	}
+	return ""
+}
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+
+// roleBody is the JSON accepted by the role endpoints
+type roleBody struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// validatePermissions checks perms are known and held by actor (so nobody can
+// grant more than they have) and returns them sorted without duplicates
+func validatePermissions(actor Role, perms []Permission) ([]Permission, string) {
+	seen := make(map[Permission]bool)
+	out := []Permission{}
+	for _, p := range perms {
+		if !isKnownPermission(p) {
+			return nil, "Unknown permission: " + string(p)
+		}
+		if !RoleHasPermission(actor, p) {
+			return nil, "Cannot grant permission " + string(p)
+		}
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out, ""
+}
+
+func adminListRoles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"roles":       StoreListRoles(),
+		"permissions": AllPermissions,
+	})
+}
+
+func adminCreateRole(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body roleBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	name := Role(strings.ToLower(strings.TrimSpace(body.Name)))
+	if !roleNamePattern.MatchString(string(name)) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Role name must be 2-32 lowercase letters, digits, - or _"})
+		return
+	}
+	userID, actorRole, _ := GetSessionUser(r)
+	perms, msg := validatePermissions(actorRole, body.Permissions)
+	if msg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+	def := &RoleDef{Name: name, Description: strings.TrimSpace(body.Description), Permissions: perms, UpdatedAt: time.Now()}
+	if !StoreCreateRole(def) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Role already exists"})
+		return
+	}
+	StoreAppendGlobalAudit(string(actorRole), userID, "role_create", map[string]interface{}{"role": name, "permissions": perms})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(def)
+}
+
+// adminRole handles PUT and DELETE /roles/:name
+func adminRole(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	path := strings.TrimPrefix(r.URL.Path, "/roles/")
+	name := Role(strings.Split(path, "/")[0])
+	existing := StoreGetRole(name)
+	if existing == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Role not found"})
+		return
+	}
+	if name == RoleAdmin {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "The admin role cannot be changed"})
+		return
+	}
+	userID, actorRole, _ := GetSessionUser(r)
+	switch r.Method {
+	case http.MethodPut, http.MethodPatch:
+		var body roleBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+			return
+		}
+		perms, msg := validatePermissions(actorRole, body.Permissions)
+		if msg != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": msg})
+			return
+		}
+		existing.Permissions = perms
+		if d := strings.TrimSpace(body.Description); d != "" {
+			existing.Description = d
+		}
+		existing.UpdatedAt = time.Now()
+		StoreSaveRole(existing)
+		StoreAppendGlobalAudit(string(actorRole), userID, "role_update", map[string]interface{}{"role": name, "permissions": perms})
+		json.NewEncoder(w).Encode(existing)
+	case http.MethodDelete:
+		if existing.BuiltIn {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Built-in roles cannot be deleted"})
+			return
+		}
+		if len(StoreListUsers(name)) > 0 {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Role is assigned to users"})
+			return
+		}
+		StoreDeleteRole(name)
+		StoreAppendGlobalAudit(string(actorRole), userID, "role_delete", map[string]interface{}{"role": name})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,378 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// Recording status values
+const (
+	RecordingActive    = "recording"
+	RecordingCompleted = "completed"
+	RecordingFailed    = "failed"
+)
+
+// Recording is a server-side WebM capture of the client's screen track
+type Recording struct {
+	ID              string     `json:"id"`
+	SessionID       string     `json:"sessionId"`
+	StreamSessionID string     `json:"streamSessionId"`
+	Status          string     `json:"status"`
+	ContentType     string     `json:"contentType"`
+	SizeBytes       int64      `json:"sizeBytes"`
+	Path            string     `json:"-"`
+	StartedAt       time.Time  `json:"startedAt"`
+	EndedAt         *time.Time `json:"endedAt,omitempty"`
+}
+
+const (
+	recordingPLIInterval = 3 * time.Second
+	recordingJanitorTick = time.Hour
+)
+
+var (
+	recordingDir = "recordings"
+	recordersMu  sync.Mutex
+	recorders    = make(map[string]*sessionRecorder) // roomID -> active recorder
+)
+
+// SetRecordingDir sets where WebM files are written
+func SetRecordingDir(dir string) {
+	recordingDir = dir
+}
+
+// sessionRecorder joins a Room as an in-process viewer and writes the client's
+// video track to a WebM file. In SFU rooms it taps the forwarded track instead
+// of asking the client for another upload.
+type sessionRecorder struct {
+	*answerPeer // nil when fed by the room's SFU
+	sfu         *sfuRoom
+	roomID      string
+	rec         *Recording
+
+	mu      sync.Mutex
+	writer  webm.BlockWriteCloser
+	closed  bool
+	builder *samplebuilder.SampleBuilder
+	elapsed time.Duration
+}
+
+// MaybeStartRecording starts recording roomID when recording is enabled, the
+// room is hosted on this instance and the client has given consent.
+func MaybeStartRecording(roomID string) {
+	if !StoreGetGlobalSettings().RecordingEnabled {
+		return
+	}
+	s := StoreGetSession(roomID)
+	if s == nil || !s.ConsentGiven {
+		return
+	}
+	room := GetRoom(roomID)
+	if room == nil {
+		return
+	}
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+	if recorders[roomID] != nil {
+		return
+	}
+	r, err := newSessionRecorder(room)
+	if err != nil {
+		log.Println("[recording] start failed:", roomID, err)
+		return
+	}
+	recorders[roomID] = r
+}
+
+// StopRecording stops any active recording for roomID
+func StopRecording(roomID, reason string) {
+	recordersMu.Lock()
+	r := recorders[roomID]
+	delete(recorders, roomID)
+	recordersMu.Unlock()
+	if r != nil {
+		r.stop(reason)
+	}
+}
+
+func newSessionRecorder(room *Room) (*sessionRecorder, error) {
+	if err := os.MkdirAll(recordingDir, 0o700); err != nil {
+		return nil, err
+	}
+	id := GetRandomName(1)
+	r := &sessionRecorder{
+		roomID:  room.ID,
+		builder: samplebuilder.New(128, &codecs.VP8Packet{}, 90000),
+		rec: &Recording{
+			ID:          id,
+			SessionID:   room.ID,
+			Status:      RecordingActive,
+			ContentType: "video/webm",
+			Path:        filepath.Join(recordingDir, fmt.Sprintf("%s-%s.webm", room.ID, id)),
+			StartedAt:   time.Now(),
+		},
+	}
+	if room.sfu != nil {
+		r.sfu = room.sfu
+		StoreSaveRecording(r.rec)
+		StoreAppendAudit(room.ID, "system", "recorder", "recording_started", map[string]interface{}{"recordingId": id})
+		room.sfu.addSink(id, r.push)
+		go r.requestKeyframes(0)
+		return r, nil
+	}
+	stream := room.NewSession(nil)
+	p, err := newAnswerPeer(stream)
+	if err != nil {
+		room.RemoveSession(stream.ID)
+		return nil, err
+	}
+	r.answerPeer = p
+	r.rec.StreamSessionID = stream.ID
+	stream.peer = r
+	p.pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if track.Kind() != webrtc.RTPCodecTypeVideo {
+			return
+		}
+		go r.requestKeyframes(track.SSRC())
+		r.readTrack(track)
+	})
+	p.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			StopRecording(r.roomID, "peer_"+state.String())
+		}
+	})
+	StoreSaveRecording(r.rec)
+	StoreAppendAudit(room.ID, "system", "recorder", "recording_started", map[string]interface{}{"recordingId": id})
+	// Ask the client to offer to the recorder like any new viewer
+	if err := stream.WriteCaller(WSMessage{SessionID: stream.ID, Type: "newSession", Value: stream.ID}); err != nil {
+		r.stop("signal_failed")
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *sessionRecorder) HandleSignal(msg WSMessage) {
+	if msg.Type == "roomClosed" {
+		go StopRecording(r.roomID, "room_closed")
+		return
+	}
+	r.handleCallerSignal(msg)
+}
+
+// requestKeyframes sends periodic PLIs so the file starts (and can be seeked)
+// on a keyframe
+func (r *sessionRecorder) requestKeyframes(ssrc webrtc.SSRC) {
+	ticker := time.NewTicker(recordingPLIInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.mu.Lock()
+		closed := r.closed
+		r.mu.Unlock()
+		if closed {
+			return
+		}
+		if r.sfu != nil {
+			r.sfu.requestKeyframe()
+			continue
+		}
+		if err := r.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}}); err != nil {
+			return
+		}
+	}
+}
+
+func (r *sessionRecorder) readTrack(track *webrtc.TrackRemote) {
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		r.push(pkt)
+	}
+}
+
+// push feeds one VP8 RTP packet into the WebM file
+func (r *sessionRecorder) push(pkt *rtp.Packet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	// Keep our own copy; the SFU forwards the same packet to viewers
+	cp := *pkt
+	cp.Payload = append([]byte(nil), pkt.Payload...)
+	r.builder.Push(&cp)
+	for sample := r.builder.Pop(); sample != nil; sample = r.builder.Pop() {
+		r.elapsed += sample.Duration
+		keyframe := len(sample.Data) > 0 && sample.Data[0]&0x1 == 0
+		if err := r.writeSample(keyframe, sample.Data, r.elapsed); err != nil {
+			log.Println("[recording] write failed:", r.rec.ID, err)
+			go StopRecording(r.roomID, "write_failed")
+			return
+		}
+	}
+}
+
+// writeSample lazily opens the WebM writer on the first keyframe, when the
+// frame size is known, and drops frames until then. Called with r.mu held.
+func (r *sessionRecorder) writeSample(keyframe bool, data []byte, ts time.Duration) error {
+	if r.writer == nil {
+		if !keyframe || len(data) < 10 {
+			return nil
+		}
+		raw := uint(data[6]) | uint(data[7])<<8 | uint(data[8])<<16 | uint(data[9])<<24
+		width, height := raw&0x3FFF, (raw>>16)&0x3FFF
+		f, err := os.OpenFile(r.rec.Path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		ws, err := webm.NewSimpleBlockWriter(f, []webm.TrackEntry{{
+			Name:        "Screen",
+			TrackNumber: 1,
+			TrackUID:    1,
+			CodecID:     "V_VP8",
+			TrackType:   1,
+			Video:       &webm.Video{PixelWidth: uint64(width), PixelHeight: uint64(height)},
+		}})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		r.writer = ws[0]
+	}
+	_, err := r.writer.Write(keyframe, int64(ts/time.Millisecond), data)
+	return err
+}
+
+func (r *sessionRecorder) stop(reason string) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	var werr error
+	if r.writer != nil {
+		werr = r.writer.Close()
+	}
+	r.mu.Unlock()
+	if r.sfu != nil {
+		r.sfu.removeSink(r.rec.ID)
+	} else {
+		_ = r.pc.Close()
+		if room := GetRoom(r.roomID); room != nil {
+			room.RemoveSession(r.rec.StreamSessionID)
+		}
+	}
+
+	now := time.Now()
+	r.rec.EndedAt = &now
+	r.rec.Status = RecordingCompleted
+	if fi, err := os.Stat(r.rec.Path); err == nil {
+		r.rec.SizeBytes = fi.Size()
+	} else {
+		r.rec.Status = RecordingFailed
+	}
+	if werr != nil {
+		r.rec.Status = RecordingFailed
+	}
+	StoreSaveRecording(r.rec)
+	StoreAppendAudit(r.roomID, "system", "recorder", "recording_stopped", map[string]interface{}{
+		"recordingId": r.rec.ID, "reason": reason, "status": r.rec.Status, "sizeBytes": r.rec.SizeBytes,
+	})
+}
+
+// StartRecordingJanitor deletes recordings older than RecordingRetentionDays
+func StartRecordingJanitor() {
+	go func() {
+		for {
+			purgeExpiredRecordings()
+			time.Sleep(recordingJanitorTick)
+		}
+	}()
+}
+
+func purgeExpiredRecordings() {
+	days := StoreGetGlobalSettings().RecordingRetentionDays
+	if days <= 0 {
+		return
+	}
+	cut := time.Now().AddDate(0, 0, -days)
+	for _, rec := range StoreListRecordings("") {
+		if rec.EndedAt == nil || rec.EndedAt.After(cut) {
+			continue
+		}
+		if err := os.Remove(rec.Path); err != nil && !os.IsNotExist(err) {
+			log.Println("[recording] purge failed:", rec.ID, err)
+			continue
+		}
+		StoreDeleteRecording(rec.ID)
+		StoreAppendGlobalAudit("system", "retention", "recording_purge", map[string]interface{}{
+			"recordingId": rec.ID, "sessionId": rec.SessionID,
+		})
+	}
+}
+
+func adminListRecordings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	list := StoreListRecordings(r.URL.Query().Get("sessionId"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recordings": list})
+}
+
+// adminRecording handles GET (download) and DELETE /recordings/:id
+func adminRecording(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/recordings/")
+	id := strings.Split(path, "/")[0]
+	rec := StoreGetRecording(id)
+	if rec == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Recording not found"})
+		return
+	}
+	userID, _, _ := GetSessionUser(r)
+	switch r.Method {
+	case http.MethodGet:
+		if rec.Status == RecordingActive {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Recording in progress"})
+			return
+		}
+		StoreAppendGlobalAudit("admin", userID, "recording_download", map[string]interface{}{"recordingId": id, "sessionId": rec.SessionID})
+		w.Header().Set("Content-Type", rec.ContentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(rec.Path)))
+		http.ServeFile(w, r, rec.Path)
+	case http.MethodDelete:
+		if rec.Status == RecordingActive {
+			StopRecording(rec.SessionID, "admin_delete")
+		}
+		if err := os.Remove(rec.Path); err != nil && !os.IsNotExist(err) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		StoreDeleteRecording(id)
+		StoreAppendGlobalAudit("admin", userID, "recording_delete", map[string]interface{}{"recordingId": id, "sessionId": rec.SessionID})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
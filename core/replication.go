@@ -0,0 +1,98 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// State fan-out between instances: CoBrowseSession snapshots, session audit
+// events, live dashboard events, logouts and telemetry samples are published on one broker
+// channel and applied by every other instance.
+
+const stateChannel = "laplace:state"
+
+const (
+	stateSession = "session"
+	stateAudit   = "audit"
+	stateEvent   = "event"
+	stateLogout  = "logout"
+	stateStats   = "stats"
+)
+
+type stateMessage struct {
+	Instance string           `json:"instance"`
+	Kind     string           `json:"kind"`
+	Session  *CoBrowseSession `json:"session,omitempty"`
+	Audit    *AuditEvent      `json:"audit,omitempty"`
+	Event    *LiveEvent       `json:"event,omitempty"`
+	LoginID  string           `json:"loginId,omitempty"`
+	Stats    *ConnStatsSample `json:"stats,omitempty"`
+}
+
+var (
+	stateSubMu sync.Mutex
+	stateSub   Subscription
+)
+
+func publishState(msg stateMessage) {
+	msg.Instance = instanceID
+	b, err := json.Marshal(msg)
+	if err != nil {
+		log.Println("broker: state encode failed.", err)
+		return
+	}
+	if err := getBroker().Publish(stateChannel, b); err != nil {
+		log.Println("broker: state publish failed.", err)
+	}
+}
+
+// startStateReplication subscribes to state published by other instances on b
+func startStateReplication(b Broker) {
+	stateSubMu.Lock()
+	defer stateSubMu.Unlock()
+	if stateSub != nil {
+		_ = stateSub.Close()
+		stateSub = nil
+	}
+	sub, err := b.Subscribe(stateChannel)
+	if err != nil {
+		log.Println("broker: state subscribe failed.", err)
+		return
+	}
+	stateSub = sub
+	go func() {
+		for payload := range sub.C() {
+			var msg stateMessage
+			if err := json.Unmarshal(payload, &msg); err != nil || msg.Instance == instanceID {
+				continue
+			}
+			applyState(msg)
+		}
+	}()
+}
+
+func applyState(msg stateMessage) {
+	switch msg.Kind {
+	case stateSession:
+		if msg.Session != nil {
+			storeApplySession(msg.Session)
+		}
+	case stateAudit:
+		if msg.Audit != nil {
+			storeApplyAudit(msg.Audit)
+		}
+	case stateEvent:
+		if msg.Event != nil {
+			publishLocalEvent(*msg.Event)
+		}
+	case stateLogout:
+		if msg.LoginID != "" {
+			forgetSession(msg.LoginID)
+		}
+	case stateStats:
+		if msg.Stats != nil {
+			storeApplyConnStats(msg.Stats)
+		}
+	}
+}
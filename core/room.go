@@ -2,43 +2,90 @@ package core
 
 import (
     "fmt"
+    "sync"
+    "time"
+
     "github.com/gorilla/websocket"
 )
 
+// Room handlers run on the caller's and each viewer's WebSocket goroutines as
+// well as broker and pion callbacks, so Sessions is only touched under mu and
+// every WebSocket write goes through a wsConn.
 type Room struct {
     ID         string
-    Sessions   map[string]*StreamSession
-    CallerConn *websocket.Conn
+    Sessions   map[string]*StreamSession // guarded by mu
+    CallerConn *wsConn
+    sfu        *sfuRoom // set when the room was opened in SFU mode
+    mu         sync.Mutex
+}
+
+// wsConn serializes writes to a WebSocket: gorilla/websocket allows only one
+// concurrent writer per connection
+type wsConn struct {
+    *websocket.Conn
+    writeMu sync.Mutex
+}
+
+func newWSConn(conn *websocket.Conn) *wsConn {
+    return &wsConn{Conn: conn}
+}
+
+func (c *wsConn) WriteJSON(v interface{}) error {
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+    return c.Conn.WriteJSON(v)
 }
 
 type StreamSession struct {
     ID                  string
+    RoomID              string
     Offer               string
     Answer              string
     CallerIceCandidates []string
     CalleeIceCandidates []string
-    CallerConn          *websocket.Conn
-    CalleeConn          *websocket.Conn
+    CallerConn          *wsConn
+    CalleeConn          *wsConn
+    ViewerID            string
+    ViewerRole          Role
+    guidance            *guidanceLimiter
+    remoteCaller        bool // client is connected to another instance
+    remoteCallee        bool // viewer is connected to another instance
+    remoteSub           Subscription
+    peer                serverPeer // in-process viewer (recorder) instead of CalleeConn
+    sfuSub              *sfuSubscriber // server forwards media to this viewer in SFU mode
+    clientStatsAt       time.Time      // last telemetry sample from each side
+    viewerStatsAt       time.Time
 }
 
-var roomMap = make(map[string]*Room)
+var (
+    roomMapMu sync.RWMutex
+    roomMap   = make(map[string]*Room)
+)
 
 func GetRoom(id string) *Room {
+    roomMapMu.RLock()
+    defer roomMapMu.RUnlock()
     return roomMap[id]
 }
 
-func NewRoom(callerConn *websocket.Conn) *Room {
-    room := Room{
-        ID:         newRoomID(),
-        Sessions:   make(map[string]*StreamSession),
-        CallerConn: callerConn,
+func NewRoom(callerConn *wsConn) *Room {
+    roomMapMu.Lock()
+    defer roomMapMu.Unlock()
+    id := GetRandomName(0)
+    for roomMap[id] != nil {
+        id = GetRandomName(0)
     }
-    roomMap[room.ID] = &room
-    return &room
+    return newRoomLocked(callerConn, id)
 }
 
 // NewRoomWithID creates a room with a specific ID (for agent-created sessions)
-func NewRoomWithID(callerConn *websocket.Conn, id string) *Room {
+func NewRoomWithID(callerConn *wsConn, id string) *Room {
+    roomMapMu.Lock()
+    defer roomMapMu.Unlock()
+    return newRoomLocked(callerConn, id)
+}
+
+func newRoomLocked(callerConn *wsConn, id string) *Room {
     room := Room{
         ID:         id,
         Sessions:   make(map[string]*StreamSession),
@@ -48,38 +95,61 @@ func NewRoomWithID(callerConn *websocket.Conn, id string) *Room {
     return &room
 }
 
-func newRoomID() string {
-    id := GetRandomName(0)
-    for GetRoom(id) != nil {
-        id = GetRandomName(0)
-    }
-    return id
-}
-
 func RemoveRoom(id string) {
-    roomMap[id] = nil
+    roomMapMu.Lock()
+    delete(roomMap, id)
+    roomMapMu.Unlock()
 }
 
 func (room *Room) GetSession(id string) *StreamSession {
+    room.mu.Lock()
+    defer room.mu.Unlock()
     return room.Sessions[id]
 }
 
-func (room *Room) NewSession(calleeConn *websocket.Conn) *StreamSession {
+// AddSession adds s unless the room already has a session with its ID
+func (room *Room) AddSession(s *StreamSession) bool {
+    room.mu.Lock()
+    defer room.mu.Unlock()
+    if room.Sessions[s.ID] != nil {
+        return false
+    }
+    room.Sessions[s.ID] = s
+    return true
+}
+
+func (room *Room) RemoveSession(id string) {
+    room.mu.Lock()
+    delete(room.Sessions, id)
+    room.mu.Unlock()
+}
+
+// SessionList returns a snapshot of the room's sessions
+func (room *Room) SessionList() []*StreamSession {
+    room.mu.Lock()
+    defer room.mu.Unlock()
+    list := make([]*StreamSession, 0, len(room.Sessions))
+    for _, s := range room.Sessions {
+        list = append(list, s)
+    }
+    return list
+}
+
+func (room *Room) NewSession(calleeConn *wsConn) *StreamSession {
     session := StreamSession{
-        ID:                  room.newSessionID(),
+        RoomID:              room.ID,
         CallerIceCandidates: []string{},
         CalleeIceCandidates: []string{},
         CallerConn:          room.CallerConn,
         CalleeConn:          calleeConn,
+        guidance:            newGuidanceLimiter(),
+    }
+    room.mu.Lock()
+    defer room.mu.Unlock()
+    session.ID = fmt.Sprintf("%s$%s", room.ID, GetRandomName(0))
+    for room.Sessions[session.ID] != nil {
+        session.ID = fmt.Sprintf("%s$%s", room.ID, GetRandomName(0))
     }
     room.Sessions[session.ID] = &session
     return &session
 }
-
-func (room *Room) newSessionID() string {
-    id := fmt.Sprintf("%s$%s", room.ID, GetRandomName(0))
-    for GetRoom(id) != nil {
-        id = fmt.Sprintf("%s$%s", room.ID, GetRandomName(0))
-    }
-    return id
-}
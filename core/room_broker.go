@@ -0,0 +1,215 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Rooms live on the instance holding the client's /ws/serve connection. The
+// room is advertised in the broker so a viewer whose /ws/connect lands on a
+// different instance can still join: viewer → client messages go through the
+// room's caller channel, client → viewer messages through the session channel.
+
+const roomKeyTTL = 30 * time.Second
+
+// viewerLeftType tells the instance hosting a room that a remote viewer
+// disconnected, so it drops the session
+const viewerLeftType = "viewerLeft"
+
+func roomKey(id string) string           { return "laplace:room:" + id }
+func roomCallerChannel(id string) string { return "laplace:room:" + id + ":caller" }
+func sessionChannel(id string) string    { return "laplace:session:" + id }
+
+// roomExists reports whether a room is open on this or any other instance
+func roomExists(id string) bool {
+	if GetRoom(id) != nil {
+		return true
+	}
+	_, ok, err := getBroker().Get(roomKey(id))
+	if err != nil {
+		log.Println("broker: room lookup failed.", err)
+		return false
+	}
+	return ok
+}
+
+// attachBroker advertises the room until quit is closed and relays messages
+// from viewers connected to other instances to the caller.
+func (room *Room) attachBroker(quit <-chan struct{}) {
+	b := getBroker()
+	if err := b.Set(roomKey(room.ID), []byte(instanceID), roomKeyTTL); err != nil {
+		log.Println("broker: room advertise failed.", err)
+	}
+	sub, err := b.Subscribe(roomCallerChannel(room.ID))
+	if err != nil {
+		log.Println("broker: room subscribe failed.", err)
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(roomKeyTTL / 3)
+		defer ticker.Stop()
+		defer sub.Close()
+		for {
+			select {
+			case <-quit:
+				_ = b.Del(roomKey(room.ID))
+				return
+			case <-ticker.C:
+				_ = b.Set(roomKey(room.ID), []byte(instanceID), roomKeyTTL)
+			case payload, ok := <-sub.C():
+				if !ok {
+					return
+				}
+				var msg WSMessage
+				if err := json.Unmarshal(payload, &msg); err != nil {
+					continue
+				}
+				room.handleRemoteViewerMessage(msg)
+			}
+		}
+	}()
+}
+
+func (room *Room) handleRemoteViewerMessage(msg WSMessage) {
+	if msg.Type == "newSession" {
+		if !strings.HasPrefix(msg.SessionID, room.ID+"$") {
+			return
+		}
+		s := &StreamSession{
+			ID:                  msg.SessionID,
+			RoomID:              room.ID,
+			CallerIceCandidates: []string{},
+			CalleeIceCandidates: []string{},
+			CallerConn:          room.CallerConn,
+			remoteCallee:        true,
+			guidance:            newGuidanceLimiter(),
+		}
+		if !room.AddSession(s) {
+			return
+		}
+		if room.sfu != nil {
+			sub, err := room.sfu.subscribe(s)
+			if err != nil {
+				log.Println("sfu: subscribe failed.", err)
+				return
+			}
+			s.sfuSub = sub
+			return
+		}
+		if err := room.CallerConn.WriteJSON(msg); err != nil {
+			log.Println("callerWriteJsonError.", err)
+		}
+		return
+	}
+	s := room.GetSession(msg.SessionID)
+	if s == nil || !s.remoteCallee {
+		return
+	}
+	if msg.Type == viewerLeftType {
+		room.RemoveSession(s.ID)
+		s.Close()
+		return
+	}
+	if s.sfuSub != nil && (msg.Type == "gotAnswer" || msg.Type == "addCalleeIceCandidate") {
+		s.sfuSub.handleViewerSignal(msg)
+		return
+	}
+	if msg.Type == "addCalleeIceCandidate" {
+		s.CalleeIceCandidates = append(s.CalleeIceCandidates, msg.Value)
+	} else if msg.Type == "gotAnswer" {
+		s.Answer = msg.Value
+	}
+	if err := room.CallerConn.WriteJSON(msg); err != nil {
+		log.Println("connectEchoWriteJsonError.", err)
+	}
+}
+
+// newRemoteViewerSession joins a viewer to a room hosted on another instance
+func newRemoteViewerSession(roomID string, calleeConn *wsConn) (*StreamSession, error) {
+	s := &StreamSession{
+		ID:                  fmt.Sprintf("%s$%s", roomID, GetRandomName(0)),
+		RoomID:              roomID,
+		CallerIceCandidates: []string{},
+		CalleeIceCandidates: []string{},
+		CalleeConn:          calleeConn,
+		remoteCaller:        true,
+		guidance:            newGuidanceLimiter(),
+	}
+	sub, err := getBroker().Subscribe(sessionChannel(s.ID))
+	if err != nil {
+		return nil, err
+	}
+	s.remoteSub = sub
+	go func() {
+		for payload := range sub.C() {
+			var msg WSMessage
+			if err := json.Unmarshal(payload, &msg); err != nil {
+				continue
+			}
+			if msg.Type == "addCallerIceCandidate" {
+				s.CallerIceCandidates = append(s.CallerIceCandidates, msg.Value)
+			} else if msg.Type == "gotOffer" {
+				s.Offer = msg.Value
+			}
+			if err := calleeConn.WriteJSON(msg); err != nil {
+				log.Println("serveEchoWriteJsonError.", err)
+			}
+		}
+	}()
+	return s, nil
+}
+
+func publishWSMessage(channel string, msg WSMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return getBroker().Publish(channel, b)
+}
+
+// WriteCaller sends msg to the client sharing the screen, locally or via the broker
+func (s *StreamSession) WriteCaller(msg WSMessage) error {
+	if s.remoteCaller {
+		return publishWSMessage(roomCallerChannel(s.RoomID), msg)
+	}
+	return s.CallerConn.WriteJSON(msg)
+}
+
+// WriteCallee sends msg to the viewer, locally, via the broker or to an
+// in-process server peer
+func (s *StreamSession) WriteCallee(msg WSMessage) error {
+	if s.peer != nil {
+		s.peer.HandleSignal(msg)
+		return nil
+	}
+	if s.remoteCallee {
+		return publishWSMessage(sessionChannel(s.ID), msg)
+	}
+	return s.CalleeConn.WriteJSON(msg)
+}
+
+// leave ends a viewer session when its connection closes: the room forgets it
+// on whichever instance hosts it
+func (s *StreamSession) leave() {
+	if s.remoteCaller {
+		if err := publishWSMessage(roomCallerChannel(s.RoomID), WSMessage{SessionID: s.ID, Type: viewerLeftType}); err != nil {
+			log.Println("broker: viewer leave publish failed.", err)
+		}
+	} else if room := GetRoom(s.RoomID); room != nil {
+		room.RemoveSession(s.ID)
+	}
+	s.Close()
+}
+
+// Close releases broker and SFU resources held by a viewer session
+func (s *StreamSession) Close() {
+	if s.remoteSub != nil {
+		_ = s.remoteSub.Close()
+	}
+	if s.sfuSub != nil {
+		s.sfuSub.close()
+	}
+}
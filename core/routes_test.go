@@ -0,0 +1,450 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The route table is the access policy of the server. These tests pin every
+// entry of Routes(), so changing who may reach a route, its CSRF, API key or
+// cache rules, or adding a route, must be reflected here.
+
+// routeFlags are the per-route rules a case expects
+type routeFlags int
+
+const (
+	flagPublicIf routeFlags = 1 << iota
+	flagNoCSRF
+	flagAPIKeys
+	flagNoStore
+)
+
+// outcomes is the expected result for each principal, in the order of
+// routeTestPrincipals: anonymous, SRM, admin, custom role, API key. "ok" means
+// the route's handler ran; "302 <path>" is a redirect.
+type outcomes [5]string
+
+const routeReached = "ok"
+
+// routeCase is the expectation for one method of a route; Methods nil is
+// written "*" and exercised with GET and POST
+type routeCase struct {
+	key   string // "METHOD pattern"
+	want  outcomes
+	flags routeFlags
+}
+
+type routePrincipal struct {
+	name   string
+	cookie string // login session ID
+	bearer string // API key token
+}
+
+// routeTestPrincipals logs in an SRM, an admin and a user with a custom
+// audit-only role, and issues an API key scoped to session.create for a
+// service account with the SRM role
+func routeTestPrincipals(t *testing.T) []routePrincipal {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	login := func(email string, role Role) string {
+		u, err := StoreCreateUser(email, role, "")
+		if err != nil || u == nil {
+			t.Fatalf("create %s: %v", email, err)
+		}
+		return CreateSession(r, u.Email, u.ID, role, "password")
+	}
+	custom := Role("routes-auditor")
+	if !StoreCreateRole(&RoleDef{Name: custom, Permissions: []Permission{PermAuditRead}}) {
+		t.Fatalf("create role %s", custom)
+	}
+	svc, err := StoreCreateUser("routes-crm"+serviceEmailDomain, RoleSRM, "")
+	if err != nil || svc == nil {
+		t.Fatalf("create service account: %v", err)
+	}
+	StoreUpdateUser(svc.ID, func(u *User) bool {
+		u.Service = true
+		return true
+	})
+	id, token, hash := newAPIKeyToken()
+	StoreSaveAPIKey(&APIKey{ID: id, UserID: svc.ID, Hash: hash, Scopes: []Permission{PermSessionCreate}, RateLimit: maxAPIKeyRate})
+
+	return []routePrincipal{
+		{name: "anonymous"},
+		{name: "srm", cookie: login("routes-srm@example.com", RoleSRM)},
+		{name: "admin", cookie: login("routes-admin@example.com", RoleAdmin)},
+		{name: "custom", cookie: login("routes-auditor@example.com", custom)},
+		{name: "apikey", bearer: token},
+	}
+}
+
+func routeTestCases() []routeCase {
+	const ok = routeReached
+	var (
+		anyone    = outcomes{ok, ok, ok, ok, "401"}
+		loggedIn  = outcomes{"401", ok, ok, ok, "401"}
+		srms      = outcomes{"401", ok, ok, "403", "401"}
+		keySRMs   = outcomes{"401", ok, ok, "403", ok}
+		preflight = outcomes{ok, ok, ok, ok, ok}
+		auditors  = outcomes{"401", "403", ok, ok, "401"}
+		managers  = outcomes{"401", "403", ok, "403", "401"}
+		srmPage   = outcomes{"302 /srm/login", ok, ok, ok, "401"}
+		adminPage = outcomes{"302 /admin/login", "302 /srm", ok, ok, "401"}
+	)
+	const (
+		noStore   = flagNoStore
+		noCSRF    = flagNoCSRF
+		createAPI = flagPublicIf | flagAPIKeys | flagNoStore
+	)
+	return []routeCase{
+		{"* /static/", anyone, 0},
+		{"* /", anyone, 0},
+
+		{"* /connect", anyone, 0},
+		{"* /connect/", anyone, 0},
+		{"* /start", anyone, 0},
+		{"* /start/", anyone, 0},
+		{"* /join", anyone, 0},
+		{"* /room/", anyone, 0},
+		{"* /stream.html", srmPage, flagPublicIf},
+		{"* /logout", anyone, 0},
+		{"* /2fa", anyone, noStore},
+		{"* /password", anyone, noStore},
+		{"* /password/reset", anyone, noStore},
+
+		{"* /srm/login", anyone, noStore},
+		{"* /srm/login/", anyone, 0},
+		{"* /srm", anyone, noStore},
+		{"* /srm/", srmPage, flagPublicIf | noStore},
+		{"* /viewer/", srmPage, noStore},
+		{"* /agent", anyone, 0},
+		{"* /agent/", anyone, 0},
+
+		{"* /admin/login", anyone, noStore},
+		{"* /admin/login/", anyone, 0},
+		{"* /admin", adminPage, noStore},
+		{"* /admin/", adminPage, noStore},
+
+		{"GET /ws/serve", anyone, 0},
+		{"GET /ws/connect", anyone, 0},
+
+		{"* /api/health", anyone, 0},
+		{"GET /api/auth-check", anyone, noStore},
+		{"POST /api/login", anyone, noCSRF},
+		{"POST /api/login/2fa", anyone, noStore | noCSRF},
+		{"GET /api/oidc", anyone, noStore},
+		{"GET /api/oidc/login", anyone, noStore},
+		{"GET /api/oidc/callback", anyone, noStore},
+		{"GET /api/2fa", anyone, noStore},
+		{"POST /api/2fa/enroll", anyone, noStore},
+		{"POST /api/2fa/verify", anyone, noStore},
+		{"POST /api/2fa/recovery-codes", anyone, noStore},
+		{"POST /api/2fa/disable", anyone, noStore},
+		{"GET /api/password", anyone, noStore},
+		{"POST /api/password", anyone, noStore},
+		{"POST /api/password/forgot", anyone, noStore | noCSRF},
+		{"GET /api/password/reset", anyone, noStore},
+		{"POST /api/password/reset", anyone, noStore | noCSRF},
+		{"* /api/logout", anyone, 0},
+		{"GET /api/logins", loggedIn, noStore},
+		{"DELETE /api/logins", loggedIn, noStore},
+		{"DELETE /api/logins/", loggedIn, noStore},
+		{"GET /api/validate", anyone, 0},
+		{"GET /api/ice-servers", anyone, noStore},
+		{"POST /api/create-session", keySRMs, createAPI},
+		{"OPTIONS /api/create-session", preflight, createAPI},
+		{"GET /api/events", loggedIn, noStore},
+
+		{"POST /api/session/validate", anyone, noCSRF},
+		{"POST /api/session/consent", anyone, noCSRF},
+		{"POST /api/session/upload", anyone, noStore | noCSRF},
+		{"GET /api/session/uploads", anyone, noStore},
+		{"POST /api/session/submit", anyone, noStore | noCSRF},
+		{"POST /api/session/checklist", srms, noStore},
+		{"POST /api/session/create", keySRMs, createAPI},
+		{"OPTIONS /api/session/create", preflight, createAPI},
+		{"GET /api/session/list", keySRMs, flagAPIKeys | noStore},
+		{"GET /api/session/status", keySRMs, flagAPIKeys | noStore},
+		{"POST /api/session/snapshot", srms, noStore},
+		{"POST /api/session/reassign", srms, noStore},
+
+		{"GET /api/admin/dashboard", auditors, noStore},
+		{"GET /api/admin/agents", managers, noStore},
+		{"POST /api/admin/agents", managers, noStore},
+		{"PUT /api/admin/agents/", managers, noStore},
+		{"PATCH /api/admin/agents/", managers, noStore},
+		{"GET /api/admin/srms", managers, noStore},
+		{"POST /api/admin/srms", managers, noStore},
+		{"PUT /api/admin/srms/", managers, noStore},
+		{"PATCH /api/admin/srms/", managers, noStore},
+		{"GET /api/admin/roles", managers, noStore},
+		{"POST /api/admin/roles", managers, noStore},
+		{"PUT /api/admin/roles/", managers, noStore},
+		{"PATCH /api/admin/roles/", managers, noStore},
+		{"DELETE /api/admin/roles/", managers, noStore},
+		{"GET /api/admin/teams", auditors, noStore},
+		{"POST /api/admin/teams", managers, noStore},
+		{"PUT /api/admin/teams/", managers, noStore},
+		{"PATCH /api/admin/teams/", managers, noStore},
+		{"DELETE /api/admin/teams/", managers, noStore},
+		{"GET /api/admin/users/", auditors, noStore},
+		{"DELETE /api/admin/users/", managers, noStore},
+		{"GET /api/admin/logins", auditors, noStore},
+		{"GET /api/admin/service-accounts", managers, noStore},
+		{"POST /api/admin/service-accounts", managers, noStore},
+		{"PUT /api/admin/service-accounts/", managers, noStore},
+		{"PATCH /api/admin/service-accounts/", managers, noStore},
+		{"POST /api/admin/service-accounts/", managers, noStore},
+		{"DELETE /api/admin/service-accounts/", managers, noStore},
+		{"POST /api/admin/users/", managers, noStore},
+		{"GET /api/admin/lockouts", auditors, noStore},
+		{"DELETE /api/admin/lockouts", managers, noStore},
+		{"GET /api/admin/settings", auditors, noStore},
+		{"PUT /api/admin/settings", managers, noStore},
+		{"POST /api/admin/settings", managers, noStore},
+		{"GET /api/admin/documents", auditors, noStore},
+		{"POST /api/admin/documents", managers, noStore},
+		{"PUT /api/admin/documents/", managers, noStore},
+		{"PATCH /api/admin/documents/", managers, noStore},
+		{"GET /api/admin/documents/", auditors, noStore},
+		{"POST /api/admin/documents/", managers, noStore},
+		{"DELETE /api/admin/documents/", managers, noStore},
+		{"GET /api/admin/onboarding-flow", auditors, noStore},
+		{"PUT /api/admin/onboarding-flow", managers, noStore},
+		{"POST /api/admin/onboarding-flow", managers, noStore},
+		{"GET /api/admin/sessions", auditors, noStore},
+		{"GET /api/admin/sessions/", auditors, noStore},
+		{"POST /api/admin/sessions/", managers, noStore},
+		{"DELETE /api/admin/sessions/", managers, noStore},
+		{"PUT /api/admin/review/", managers, noStore},
+		{"POST /api/admin/review/", managers, noStore},
+		{"GET /api/admin/audit", auditors, noStore},
+		{"GET /api/admin/recordings", auditors, noStore},
+		{"GET /api/admin/recordings/", auditors, noStore},
+		{"DELETE /api/admin/recordings/", managers, noStore},
+		{"GET /api/admin/snapshots/", auditors, noStore},
+		{"GET /api/admin/uploads/", auditors, noStore},
+		{"GET /api/admin/connection-stats", auditors, noStore},
+	}
+}
+
+// routeKeys lists the case keys of rt, one per method
+func routeKeys(rt Route) []string {
+	if rt.Methods == nil {
+		return []string{"* " + rt.Pattern}
+	}
+	keys := make([]string, len(rt.Methods))
+	for i, m := range rt.Methods {
+		keys[i] = m + " " + rt.Pattern
+	}
+	return keys
+}
+
+// routeTestPath is a request path served by pattern
+func routeTestPath(pattern string) string {
+	if pattern != "/" && strings.HasSuffix(pattern, "/") {
+		return pattern + "x"
+	}
+	return pattern
+}
+
+// stubMux builds the mux the way GetHttp does, with handlers that record
+// which route ran and the path it saw, and answer 418
+func stubMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	byPattern := make(map[string][]Route)
+	var patterns []string
+	for _, rt := range Routes() {
+		rt := rt
+		rt.Handler = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Route", strings.Join(routeKeys(rt), ","))
+			w.Header().Set("X-Route-Path", r.URL.Path)
+			w.WriteHeader(http.StatusTeapot)
+		}
+		if _, ok := byPattern[rt.Pattern]; !ok {
+			patterns = append(patterns, rt.Pattern)
+		}
+		byPattern[rt.Pattern] = append(byPattern[rt.Pattern], rt)
+	}
+	for _, p := range patterns {
+		mux.Handle(p, routeHandler(byPattern[p]))
+	}
+	return mux
+}
+
+func routeRequest(mux http.Handler, p routePrincipal, method, target string, withCSRF bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if p.cookie != "" {
+		r.AddCookie(&http.Cookie{Name: cookieName, Value: p.cookie})
+		if withCSRF {
+			r.Header.Set(csrfHeader, csrfToken(p.cookie))
+		}
+	}
+	if p.bearer != "" {
+		r.Header.Set("Authorization", "Bearer "+p.bearer)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// routeOutcome summarizes a response in the notation of outcomes
+func routeOutcome(w *httptest.ResponseRecorder) string {
+	switch w.Code {
+	case http.StatusTeapot:
+		return routeReached
+	case http.StatusFound:
+		return "302 " + w.Header().Get("Location")
+	}
+	return strconv.Itoa(w.Code)
+}
+
+func csrfDenied(w *httptest.ResponseRecorder) bool {
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code == http.StatusForbidden && body["csrf"] == true
+}
+
+func TestRoutes(t *testing.T) {
+	principals := routeTestPrincipals(t)
+	mux := stubMux()
+
+	cases := make(map[string]routeCase)
+	for _, c := range routeTestCases() {
+		if _, dup := cases[c.key]; dup {
+			t.Fatalf("duplicate case %s", c.key)
+		}
+		cases[c.key] = c
+	}
+	seen := make(map[string]bool)
+
+	for _, rt := range Routes() {
+		for _, key := range routeKeys(rt) {
+			c, found := cases[key]
+			if !found {
+				t.Errorf("%s: no expectation; add it to routeTestCases", key)
+				continue
+			}
+			if seen[key] {
+				t.Errorf("%s: declared twice in Routes()", key)
+			}
+			seen[key] = true
+
+			if got := rt.PublicIf != nil; got != (c.flags&flagPublicIf != 0) {
+				t.Errorf("%s: PublicIf set = %v", key, got)
+			}
+			if rt.NoCSRF != (c.flags&flagNoCSRF != 0) {
+				t.Errorf("%s: NoCSRF = %v", key, rt.NoCSRF)
+			}
+			if rt.APIKeys != (c.flags&flagAPIKeys != 0) {
+				t.Errorf("%s: APIKeys = %v", key, rt.APIKeys)
+			}
+			if got := rt.Cache == CacheNoStore; got != (c.flags&flagNoStore != 0) {
+				t.Errorf("%s: no-store = %v", key, got)
+			}
+
+			methods := rt.Methods
+			if methods == nil {
+				methods = []string{http.MethodGet, http.MethodPost}
+			}
+			path := routeTestPath(rt.Pattern)
+			for _, m := range methods {
+				if !strings.HasPrefix(key, "* ") && !strings.HasPrefix(key, m+" ") {
+					continue
+				}
+				for i, p := range principals {
+					w := routeRequest(mux, p, m, path, true)
+					got := routeOutcome(w)
+					if got != c.want[i] {
+						t.Errorf("%s %s as %s: got %s, want %s", m, path, p.name, got, c.want[i])
+						continue
+					}
+					if got == routeReached {
+						if route := w.Header().Get("X-Route"); route != strings.Join(routeKeys(rt), ",") {
+							t.Errorf("%s %s as %s: dispatched to %s", m, path, p.name, route)
+						}
+						if want := strings.TrimPrefix(path, rt.Strip); w.Header().Get("X-Route-Path") != want {
+							t.Errorf("%s %s: handler saw path %q, want %q", m, path, w.Header().Get("X-Route-Path"), want)
+						}
+					}
+					noStore := strings.Contains(w.Header().Get("Cache-Control"), "no-store")
+					if noStore != (c.flags&flagNoStore != 0) {
+						t.Errorf("%s %s as %s: Cache-Control %q", m, path, p.name, w.Header().Get("Cache-Control"))
+					}
+				}
+
+				// A login cookie without the CSRF token is refused unless
+				// the route opts out
+				if unsafeMethod(m) {
+					w := routeRequest(mux, principals[2], m, path, false)
+					if denied := csrfDenied(w); denied == (c.flags&flagNoCSRF != 0) {
+						t.Errorf("%s %s without CSRF token: refused = %v", m, path, denied)
+					}
+				}
+			}
+		}
+	}
+	for key := range cases {
+		if !seen[key] {
+			t.Errorf("%s: expected but not in Routes()", key)
+		}
+	}
+}
+
+// TestRoutesPublicIf checks the requests that PublicIf lets through
+// anonymously, next to the same routes' protected requests
+func TestRoutesPublicIf(t *testing.T) {
+	mux := stubMux()
+	anonymous := routePrincipal{name: "anonymous"}
+	for _, c := range []struct {
+		method, target, want string
+	}{
+		{http.MethodGet, "/stream.html?stream=1&room=abc", routeReached},
+		{http.MethodGet, "/stream.html?stream=1", "302 /srm/login"},
+		{http.MethodGet, "/stream.html", "302 /srm/login"},
+		{http.MethodGet, "/srm/", routeReached},
+		{http.MethodGet, "/srm/sessions", "302 /srm/login"},
+		{http.MethodOptions, "/api/create-session", routeReached},
+		{http.MethodPost, "/api/create-session", "401"},
+		{http.MethodOptions, "/api/session/create", routeReached},
+		{http.MethodPost, "/api/session/create", "401"},
+	} {
+		if got := routeOutcome(routeRequest(mux, anonymous, c.method, c.target, false)); got != c.want {
+			t.Errorf("%s %s: got %s, want %s", c.method, c.target, got, c.want)
+		}
+	}
+}
+
+// TestRoutesMethodNotAllowed checks that each pattern refuses other methods
+// and lists the ones it allows
+func TestRoutesMethodNotAllowed(t *testing.T) {
+	mux := stubMux()
+	byPattern := make(map[string][]Route)
+	for _, rt := range Routes() {
+		byPattern[rt.Pattern] = append(byPattern[rt.Pattern], rt)
+	}
+	for pattern, routes := range byPattern {
+		var allow []string
+		anyMethod := false
+		for _, rt := range routes {
+			anyMethod = anyMethod || rt.Methods == nil
+			allow = append(allow, rt.Methods...)
+		}
+		if anyMethod {
+			continue
+		}
+		sort.Strings(allow)
+		w := routeRequest(mux, routePrincipal{}, "BREW", routeTestPath(pattern), false)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("BREW %s: got %d, want 405", pattern, w.Code)
+			continue
+		}
+		if got, want := w.Header().Get("Allow"), strings.Join(allow, ", "); got != want {
+			t.Errorf("BREW %s: Allow = %q, want %q", pattern, got, want)
+		}
+	}
+}
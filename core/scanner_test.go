@@ -0,0 +1,197 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd accepts one INSTREAM scan per connection, checks its framing and
+// answers with reply(body). Received bodies and chunk sizes are sent on scans.
+type fakeClamd struct {
+	ln    net.Listener
+	reply func(body []byte) string
+	scans chan clamdScan
+}
+
+type clamdScan struct {
+	command string
+	chunks  []int
+	body    []byte
+	err     string
+}
+
+func newFakeClamd(t *testing.T, reply func(body []byte) string) *fakeClamd {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeClamd{ln: ln, reply: reply, scans: make(chan clamdScan, 8)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	var scan clamdScan
+	defer func() { f.scans <- scan }()
+	cmd, err := rd.ReadString(0)
+	if err != nil {
+		scan.err = "command: " + err.Error()
+		return
+	}
+	scan.command = cmd
+	if cmd != "zINSTREAM\x00" {
+		scan.err = "unexpected command"
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(rd, size[:]); err != nil {
+			scan.err = "chunk size: " + err.Error()
+			return
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n == 0 {
+			break
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(rd, chunk); err != nil {
+			scan.err = "chunk: " + err.Error()
+			return
+		}
+		scan.chunks = append(scan.chunks, int(n))
+		scan.body = append(scan.body, chunk...)
+	}
+	conn.Write([]byte(f.reply(scan.body) + "\x00"))
+}
+
+func TestClamdScanner(t *testing.T) {
+	f := newFakeClamd(t, func(body []byte) string {
+		switch {
+		case bytes.Contains(body, []byte(eicar)):
+			return "stream: Win.Test.EICAR_HDB-1 FOUND"
+		case bytes.HasPrefix(body, []byte("too big")):
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+		return "stream: OK"
+	})
+	sc, err := NewScannerFromURL("clamd://" + f.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.(*ClamdScanner).Timeout = 5 * time.Second
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), (clamdChunkSize*2+100)/16)
+	cases := []struct {
+		name     string
+		body     []byte
+		want     ScanResult
+		wantErr  string
+		chunks   []int
+		checkLen bool
+	}{
+		{name: "clean", body: []byte("%PDF-1.4 hello"), chunks: []int{14}},
+		{name: "eicar", body: []byte(eicar), want: ScanResult{Infected: true, Signature: "Win.Test.EICAR_HDB-1"}},
+		{name: "error", body: []byte("too big"), wantErr: "INSTREAM size limit exceeded. ERROR"},
+		{name: "empty", body: nil, chunks: nil},
+		{name: "chunked", body: large, checkLen: true},
+	}
+	for _, c := range cases {
+		got, err := sc.Scan(bytes.NewReader(c.body))
+		scan := <-f.scans
+		if scan.err != "" {
+			t.Fatalf("%s: clamd saw bad framing: %s (command %q)", c.name, scan.err, scan.command)
+		}
+		if !bytes.Equal(scan.body, c.body) {
+			t.Fatalf("%s: clamd received %d bytes, want %d", c.name, len(scan.body), len(c.body))
+		}
+		if c.chunks != nil && len(scan.chunks) != len(c.chunks) {
+			t.Fatalf("%s: chunks %v, want %v", c.name, scan.chunks, c.chunks)
+		}
+		if c.checkLen {
+			for _, n := range scan.chunks {
+				if n > clamdChunkSize {
+					t.Fatalf("%s: chunk of %d bytes exceeds %d", c.name, n, clamdChunkSize)
+				}
+			}
+			if len(scan.chunks) < 3 {
+				t.Fatalf("%s: %d chunks for %d bytes", c.name, len(scan.chunks), len(c.body))
+			}
+		}
+		if c.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("%s: err = %v, want %q", c.name, err, c.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Fatalf("%s: Scan = %+v, %v; want %+v", c.name, got, err, c.want)
+		}
+	}
+
+	down := &ClamdScanner{Network: "tcp", Addr: "127.0.0.1:1", Timeout: time.Second}
+	if _, err := down.Scan(strings.NewReader("x")); err == nil {
+		t.Fatal("Scan with clamd down succeeded")
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	for _, c := range []struct {
+		reply   string
+		want    ScanResult
+		wantErr bool
+	}{
+		{reply: "stream: OK"},
+		{reply: "OK"},
+		{reply: "stream: Eicar-Test-Signature FOUND", want: ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}},
+		{reply: "INSTREAM size limit exceeded. ERROR", wantErr: true},
+		{reply: "stream: Can't allocate memory ERROR", wantErr: true},
+		{reply: "", wantErr: true},
+	} {
+		got, err := parseClamdReply(c.reply)
+		if (err != nil) != c.wantErr || got != c.want {
+			t.Errorf("parseClamdReply(%q) = %+v, %v", c.reply, got, err)
+		}
+	}
+}
+
+func TestNewScannerFromURL(t *testing.T) {
+	if sc, err := NewScannerFromURL(""); sc != nil || err != nil {
+		t.Fatalf(`"" = %v, %v; want no scanner, so uploads are refused`, sc, err)
+	}
+	if sc, _ := NewScannerFromURL("none"); sc == nil || !IsNoopScanner(sc) {
+		t.Fatalf(`"none" = %v, want the explicit no-op scanner`, sc)
+	}
+	if sc, _ := NewScannerFromURL("fake"); sc == nil || sc.Name() != "fake" {
+		t.Fatalf(`"fake" = %v`, sc)
+	}
+	if sc, _ := NewScannerFromURL("clamd://clamav"); sc.(*ClamdScanner).Addr != "clamav:3310" {
+		t.Fatalf("default port: %+v", sc)
+	}
+	if sc, _ := NewScannerFromURL("clamd:///run/clamav/clamd.ctl"); sc.(*ClamdScanner).Network != "unix" {
+		t.Fatalf("socket: %+v", sc)
+	}
+	for _, raw := range []string{"clamd://", "http://clamav:3310", "clam"} {
+		if _, err := NewScannerFromURL(raw); err == nil {
+			t.Errorf("%q accepted", raw)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package core
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"math/big"
+	"net"
+	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -53,7 +57,7 @@ func (s *inMemoryStore) Validate(token string) bool {
 	defer s.mu.Unlock()
 	ps, ok := s.sessions[token]
 	if !ok || ps == nil {
-		return GetRoom(token) != nil
+		return roomExists(token)
 	}
 	if time.Now().After(ps.ExpiresAt) {
 		delete(s.sessions, token)
@@ -68,8 +72,53 @@ func (s *inMemoryStore) Delete(token string) {
 	s.mu.Unlock()
 }
 
+// brokerSessionStore keeps pending codes in the Broker so a code created on one
+// instance can be validated on another
+type brokerSessionStore struct {
+	b Broker
+}
+
+func pendingKey(token string) string { return "laplace:pending:" + token }
+
+func (s *brokerSessionStore) Create(token string, ttl time.Duration) error {
+	now := time.Now()
+	b, err := json.Marshal(&PendingSession{
+		Token:     token,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+	return s.b.Set(pendingKey(token), b, ttl)
+}
+
+func (s *brokerSessionStore) Get(token string) (*PendingSession, bool) {
+	b, ok, err := s.b.Get(pendingKey(token))
+	if err != nil || !ok {
+		return nil, false
+	}
+	var ps PendingSession
+	if err := json.Unmarshal(b, &ps); err != nil {
+		return nil, false
+	}
+	return &ps, true
+}
+
+func (s *brokerSessionStore) Validate(token string) bool {
+	ps, ok := s.Get(token)
+	if !ok {
+		return roomExists(token)
+	}
+	return time.Now().Before(ps.ExpiresAt)
+}
+
+func (s *brokerSessionStore) Delete(token string) {
+	_ = s.b.Del(pendingKey(token))
+}
+
 var (
-	defaultStore = &inMemoryStore{sessions: make(map[string]*PendingSession)}
+	defaultStore SessionStore = &inMemoryStore{sessions: make(map[string]*PendingSession)}
 	sessionTTL   = 15 * time.Minute
 	connectRate   = make(map[string][]time.Time)
 	rateMu        sync.Mutex
@@ -91,7 +140,7 @@ func CreatePendingSession() string {
 	var token string
 	for {
 		token = GenerateNumericSessionCode()
-		if GetRoom(token) == nil {
+		if !roomExists(token) {
 			if _, exists := defaultStore.Get(token); !exists {
 				break
 			}
@@ -108,6 +157,14 @@ func ValidateAndClaimToken(token string) bool {
 }
 
 func ValidateAndClaimTokenFromIP(token string, ip string) bool {
+	if !allowConnectAttempt(ip) {
+		return false
+	}
+	return defaultStore.Validate(token)
+}
+
+// allowConnectAttempt applies the per-IP limit on session code lookups
+func allowConnectAttempt(ip string) bool {
 	rateMu.Lock()
 	if ip != "" {
 		now := time.Now()
@@ -128,8 +185,110 @@ func ValidateAndClaimTokenFromIP(token string, ip string) bool {
 		connectRate[ip] = append(times, now)
 	}
 	rateMu.Unlock()
+	return true
+}
 
-	return defaultStore.Validate(token)
+// connectBlocked reports whether ip has used up its session code lookups,
+// without counting this check as one
+func connectBlocked(ip string) bool {
+	if ip == "" {
+		return false
+	}
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	cut := time.Now().Add(-rateWindow)
+	n := 0
+	for _, t := range connectRate[ip] {
+		if t.After(cut) {
+			n++
+		}
+	}
+	return n >= rateLimit
+}
+
+var (
+	trustedProxiesMu sync.RWMutex
+	trustedProxies   []*net.IPNet
+)
+
+// ParseIPNets parses comma-separated IPs or CIDRs, as in TRUSTED_PROXIES
+func ParseIPNets(raw string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q: not an IP or CIDR", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", entry, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// SetTrustedProxies sets the proxies whose X-Forwarded-For is believed
+func SetTrustedProxies(nets []*net.IPNet) {
+	trustedProxiesMu.Lock()
+	trustedProxies = nets
+	trustedProxiesMu.Unlock()
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	trustedProxiesMu.RLock()
+	defer trustedProxiesMu.RUnlock()
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestIP returns the client IP without the port. X-Forwarded-For is only
+// read when the connection comes from a trusted proxy, and then from the
+// right: the first hop that is not a trusted proxy is the client, since
+// anything left of it was written by the client itself.
+func requestIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
 }
 
 // ClaimPendingSession removes from pending when client connects (creates room)
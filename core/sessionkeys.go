@@ -0,0 +1,209 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With a session key ring configured, the login cookie carries the session
+// sealed with AES-256-GCM instead of a bare ID. A login that this instance
+// and the broker have forgotten, after a deploy for example, is restored from
+// the cookie, so SRMs and admins stay signed in across restarts. Revoked
+// logins are remembered in the broker until their cookie would have expired,
+// so sealed cookies need a broker that outlives the process (see
+// BrokerPersistent): with the in-process one a restart would forget every
+// logout and revocation.
+
+// SessionKey is one key of the session cookie key ring
+type SessionKey struct {
+	ID  string
+	Key []byte // 32 bytes
+}
+
+type sessionClaims struct {
+	SID     string    `json:"sid"`
+	Email   string    `json:"email"`
+	Method  string    `json:"method"`
+	Issued  time.Time `json:"iat"`
+	Expires time.Time `json:"exp"`
+}
+
+var (
+	sessionKeysMu sync.RWMutex
+	sessionKeys   []SessionKey // the first seals new cookies
+	sessionKeyID  = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+)
+
+// ParseSessionKeys parses SESSION_KEYS: comma-separated id:base64key entries,
+// newest first. To rotate, prepend a new key and drop the old one once every
+// cookie sealed with it has expired (7 days).
+func ParseSessionKeys(raw string) ([]SessionKey, error) {
+	var keys []SessionKey
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || !sessionKeyID.MatchString(parts[0]) {
+			return nil, fmt.Errorf("session key %q: want id:base64key", entry)
+		}
+		if seen[parts[0]] {
+			return nil, fmt.Errorf("session key %q: duplicate id", parts[0])
+		}
+		seen[parts[0]] = true
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("session key %q: key must be 32 bytes, base64 encoded", parts[0])
+		}
+		keys = append(keys, SessionKey{ID: parts[0], Key: key})
+	}
+	return keys, nil
+}
+
+// SetSessionKeys enables sealed session cookies; nil keeps bare session IDs
+func SetSessionKeys(keys []SessionKey) {
+	sessionKeysMu.Lock()
+	sessionKeys = keys
+	sessionKeysMu.Unlock()
+}
+
+// NewSessionKey returns a new key ring entry for SESSION_KEYS
+func NewSessionKey() string {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return fmt.Sprintf("k%s:%s", time.Now().UTC().Format("20060102"), base64.StdEncoding.EncodeToString(key))
+}
+
+func sessionKeyRing() []SessionKey {
+	sessionKeysMu.RLock()
+	defer sessionKeysMu.RUnlock()
+	return sessionKeys
+}
+
+func sessionAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealSession returns the cookie value for a login: <key id>.<nonce+ciphertext>,
+// or the bare session ID when no key ring is configured
+func sealSession(sessionID string, info *sessionInfo) string {
+	keys := sessionKeyRing()
+	if len(keys) == 0 || info == nil {
+		return sessionID
+	}
+	aead, err := sessionAEAD(keys[0].Key)
+	if err != nil {
+		return sessionID
+	}
+	plain, _ := json.Marshal(sessionClaims{
+		SID: sessionID, Email: info.Email, Method: info.Method, Issued: info.CreatedAt, Expires: info.Expires,
+	})
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	sealed := aead.Seal(nonce, nonce, plain, []byte(keys[0].ID))
+	return keys[0].ID + "." + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// openSession decrypts a sealed cookie value with any key in the ring
+func openSession(value string) *sessionClaims {
+	dot := strings.IndexByte(value, '.')
+	if dot < 0 {
+		return nil
+	}
+	kid := value[:dot]
+	sealed, err := base64.RawURLEncoding.DecodeString(value[dot+1:])
+	if err != nil {
+		return nil
+	}
+	for _, k := range sessionKeyRing() {
+		if k.ID != kid {
+			continue
+		}
+		aead, err := sessionAEAD(k.Key)
+		if err != nil || len(sealed) < aead.NonceSize() {
+			return nil
+		}
+		n := aead.NonceSize()
+		plain, err := aead.Open(nil, sealed[:n], sealed[n:], []byte(kid))
+		if err != nil {
+			return nil
+		}
+		c := &sessionClaims{}
+		if json.Unmarshal(plain, c) != nil || c.SID == "" {
+			return nil
+		}
+		return c
+	}
+	return nil
+}
+
+func revokedLoginKey(sessionID string) string { return "laplace:login-revoked:" + sessionID }
+
+// markRevoked keeps a destroyed login from being restored from its cookie
+func markRevoked(sessionID string, until time.Time) {
+	if len(sessionKeyRing()) == 0 {
+		return
+	}
+	ttl := time.Until(until)
+	if until.IsZero() || ttl > time.Duration(maxAge)*time.Second {
+		ttl = time.Duration(maxAge) * time.Second
+	}
+	if ttl > 0 {
+		_ = getBroker().Set(revokedLoginKey(sessionID), []byte("1"), ttl)
+	}
+}
+
+// restoreSession recreates a login from its cookie when neither this instance
+// nor the broker knows it. The user is looked up again by email, since users
+// are re-seeded on restart, and must still be active. The idle timeout starts
+// over from the restore.
+func restoreSession(r *http.Request, c *sessionClaims) {
+	now := time.Now()
+	if now.After(c.Expires) || lookupSession(c.SID) != nil {
+		return
+	}
+	if _, revoked, err := getBroker().Get(revokedLoginKey(c.SID)); revoked || err != nil {
+		return
+	}
+	u := StoreGetUserByEmail(c.Email)
+	if u == nil || !u.Active {
+		return
+	}
+	// A password change ends every earlier login. Re-seeded users start with
+	// PasswordChangedAt == CreatedAt, which says nothing about old cookies.
+	if u.PasswordChangedAt.After(u.CreatedAt) && c.Issued.Before(u.PasswordChangedAt) {
+		return
+	}
+	info := &sessionInfo{
+		Email:     u.Email,
+		UserID:    u.ID,
+		Role:      u.Role,
+		Method:    c.Method,
+		Expires:   c.Expires,
+		CreatedAt: c.Issued,
+		LastSeen:  now,
+		IP:        loginIP(r),
+		UserAgent: r.UserAgent(),
+		savedSeen: now,
+	}
+	sessionsMu.Lock()
+	sessions[c.SID] = info
+	sessionsMu.Unlock()
+	saveSession(c.SID, info)
+	addUserLogin(u.ID, c.SID)
+}
@@ -0,0 +1,296 @@
+package core
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// In SFU mode the client publishes its screen once to a server-side peer in
+// the Room, and the server forwards the tracks to every viewer over a
+// per-viewer subscriber connection. Viewers see the server as the caller: it
+// sends them the offer and receives their answer and ICE candidates.
+
+const sfuPublishTimeout = 30 * time.Second
+
+type sfuRoom struct {
+	room      *Room
+	publisher *answerPeer
+
+	mu          sync.Mutex
+	tracks      []*webrtc.TrackLocalStaticRTP
+	videoSSRC   webrtc.SSRC
+	sinks       map[string]func(*rtp.Packet) // video packet taps, e.g. the recorder
+	subscribers map[string]*sfuSubscriber
+	channel     *webrtc.DataChannel // the client's "ping" channel, bridged to every viewer
+	ready       chan struct{}
+	readyOnce   sync.Once
+	closed      bool
+}
+
+type sfuSubscriber struct {
+	sfu     *sfuRoom
+	session *StreamSession
+	pc      *webrtc.PeerConnection
+	channel *webrtc.DataChannel
+}
+
+// startSFU adds the publishing server peer to room and asks the client to offer to it
+func startSFU(room *Room) error {
+	stream := room.NewSession(nil)
+	p, err := newAnswerPeer(stream)
+	if err != nil {
+		room.RemoveSession(stream.ID)
+		return err
+	}
+	sfu := &sfuRoom{
+		room:        room,
+		publisher:   p,
+		sinks:       make(map[string]func(*rtp.Packet)),
+		subscribers: make(map[string]*sfuSubscriber),
+		ready:       make(chan struct{}),
+	}
+	stream.peer = sfu
+	room.sfu = sfu
+	p.pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		sfu.forward(track)
+	})
+	p.pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		sfu.mu.Lock()
+		sfu.channel = dc
+		sfu.mu.Unlock()
+		dc.OnMessage(func(m webrtc.DataChannelMessage) {
+			sfu.mu.Lock()
+			subs := make([]*sfuSubscriber, 0, len(sfu.subscribers))
+			for _, sub := range sfu.subscribers {
+				subs = append(subs, sub)
+			}
+			sfu.mu.Unlock()
+			for _, sub := range subs {
+				sendChannel(sub.channel, m)
+			}
+		})
+	})
+	return stream.WriteCaller(WSMessage{SessionID: stream.ID, Type: "newSession", Value: stream.ID})
+}
+
+// HandleSignal receives the caller's signaling for the publisher session
+func (sfu *sfuRoom) HandleSignal(msg WSMessage) {
+	if msg.Type == "roomClosed" {
+		sfu.close()
+		return
+	}
+	sfu.publisher.handleCallerSignal(msg)
+}
+
+func (sfu *sfuRoom) forward(track *webrtc.TrackRemote) {
+	local, err := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, track.ID(), track.StreamID())
+	if err != nil {
+		log.Println("sfu: local track.", err)
+		return
+	}
+	isVideo := track.Kind() == webrtc.RTPCodecTypeVideo
+	sfu.mu.Lock()
+	sfu.tracks = append(sfu.tracks, local)
+	if isVideo {
+		sfu.videoSSRC = track.SSRC()
+	}
+	sfu.mu.Unlock()
+	if isVideo {
+		sfu.readyOnce.Do(func() { close(sfu.ready) })
+	}
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		if isVideo {
+			sfu.mu.Lock()
+			for _, sink := range sfu.sinks {
+				sink(pkt)
+			}
+			sfu.mu.Unlock()
+		}
+		if err := local.WriteRTP(pkt); err != nil && err != io.ErrClosedPipe {
+			return
+		}
+	}
+}
+
+func sendChannel(dc *webrtc.DataChannel, m webrtc.DataChannelMessage) {
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return
+	}
+	if m.IsString {
+		_ = dc.SendText(string(m.Data))
+	} else {
+		_ = dc.Send(m.Data)
+	}
+}
+
+// requestKeyframe asks the client for a new keyframe, e.g. when a viewer joins
+func (sfu *sfuRoom) requestKeyframe() {
+	sfu.mu.Lock()
+	ssrc := sfu.videoSSRC
+	sfu.mu.Unlock()
+	if ssrc == 0 {
+		return
+	}
+	_ = sfu.publisher.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}})
+}
+
+func (sfu *sfuRoom) addSink(id string, fn func(*rtp.Packet)) {
+	sfu.mu.Lock()
+	sfu.sinks[id] = fn
+	sfu.mu.Unlock()
+	sfu.requestKeyframe()
+}
+
+func (sfu *sfuRoom) removeSink(id string) {
+	sfu.mu.Lock()
+	delete(sfu.sinks, id)
+	sfu.mu.Unlock()
+}
+
+// subscribe creates the forwarding connection for a viewer session. The offer
+// is sent once the client's video track is published.
+func (sfu *sfuRoom) subscribe(s *StreamSession) (*sfuSubscriber, error) {
+	api, err := newPeerAPI()
+	if err != nil {
+		return nil, err
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{ICEServers: serverICEServers()})
+	if err != nil {
+		return nil, err
+	}
+	dc, err := pc.CreateDataChannel("ping", nil)
+	if err != nil {
+		_ = pc.Close()
+		return nil, err
+	}
+	sub := &sfuSubscriber{sfu: sfu, session: s, pc: pc, channel: dc}
+	dc.OnMessage(func(m webrtc.DataChannelMessage) {
+		sfu.mu.Lock()
+		client := sfu.channel
+		sfu.mu.Unlock()
+		sendChannel(client, m)
+	})
+	// Viewers on other instances never say goodbye; drop them when ICE fails
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed {
+			sub.close()
+		}
+	})
+	sfu.mu.Lock()
+	sfu.subscribers[s.ID] = sub
+	sfu.mu.Unlock()
+	go sub.offer()
+	return sub, nil
+}
+
+func (sub *sfuSubscriber) offer() {
+	select {
+	case <-sub.sfu.ready:
+	case <-time.After(sfuPublishTimeout):
+		log.Println("sfu: client did not publish in time.", sub.session.ID)
+		return
+	}
+	sub.sfu.mu.Lock()
+	tracks := append([]*webrtc.TrackLocalStaticRTP(nil), sub.sfu.tracks...)
+	sub.sfu.mu.Unlock()
+	for _, t := range tracks {
+		sender, err := sub.pc.AddTrack(t)
+		if err != nil {
+			log.Println("sfu: add track.", err)
+			return
+		}
+		go sub.readRTCP(sender)
+	}
+	offer, err := sub.pc.CreateOffer(nil)
+	if err != nil {
+		log.Println("sfu: create offer.", err)
+		return
+	}
+	// Candidates travel inside the offer; see answerPeer for why nothing is trickled
+	gathered := webrtc.GatheringCompletePromise(sub.pc)
+	if err := sub.pc.SetLocalDescription(offer); err != nil {
+		log.Println("sfu: set local description.", err)
+		return
+	}
+	<-gathered
+	b, _ := json.Marshal(sub.pc.LocalDescription())
+	if err := sub.session.WriteCallee(WSMessage{SessionID: sub.session.ID, Type: "gotOffer", Value: string(b)}); err != nil {
+		log.Println("sfu: send offer.", err)
+	}
+	sub.sfu.requestKeyframe()
+}
+
+// readRTCP forwards viewer keyframe requests to the client
+func (sub *sfuSubscriber) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, p := range pkts {
+			switch p.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				sub.sfu.requestKeyframe()
+			}
+		}
+	}
+}
+
+// handleViewerSignal applies the viewer's answer or ICE candidate
+func (sub *sfuSubscriber) handleViewerSignal(msg WSMessage) {
+	switch msg.Type {
+	case "gotAnswer":
+		var answer webrtc.SessionDescription
+		if err := json.Unmarshal([]byte(msg.Value), &answer); err != nil {
+			return
+		}
+		if err := sub.pc.SetRemoteDescription(answer); err != nil {
+			log.Println("sfu: set remote description.", err)
+		}
+	case "addCalleeIceCandidate":
+		var c webrtc.ICECandidateInit
+		if err := json.Unmarshal([]byte(msg.Value), &c); err != nil {
+			return
+		}
+		if err := sub.pc.AddICECandidate(c); err != nil {
+			log.Println("sfu: add ICE candidate.", err)
+		}
+	}
+}
+
+func (sub *sfuSubscriber) close() {
+	sub.sfu.mu.Lock()
+	delete(sub.sfu.subscribers, sub.session.ID)
+	sub.sfu.mu.Unlock()
+	_ = sub.pc.Close()
+}
+
+func (sfu *sfuRoom) close() {
+	sfu.mu.Lock()
+	if sfu.closed {
+		sfu.mu.Unlock()
+		return
+	}
+	sfu.closed = true
+	subs := make([]*sfuSubscriber, 0, len(sfu.subscribers))
+	for _, sub := range sfu.subscribers {
+		subs = append(subs, sub)
+	}
+	sfu.mu.Unlock()
+	for _, sub := range subs {
+		sub.close()
+	}
+	go StopRecording(sfu.room.ID, "room_closed")
+	_ = sfu.publisher.pc.Close()
+}
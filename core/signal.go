@@ -43,14 +43,7 @@ func apiValidate(w http.ResponseWriter, r *http.Request) {
             return
         }
     }
-    ip := r.RemoteAddr
-    if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-        if idx := strings.Index(xff, ","); idx >= 0 {
-            ip = strings.TrimSpace(xff[:idx])
-        } else {
-            ip = strings.TrimSpace(xff)
-        }
-    }
+    ip := loginIP(r)
     if !ValidateAndClaimTokenFromIP(token, ip) {
         w.WriteHeader(http.StatusNotFound)
         return
@@ -92,14 +85,7 @@ func apiSessionValidate(w http.ResponseWriter, r *http.Request) {
             return
         }
     }
-    ip := r.RemoteAddr
-    if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-        if idx := strings.Index(xff, ","); idx >= 0 {
-            ip = strings.TrimSpace(xff[:idx])
-        } else {
-            ip = strings.TrimSpace(xff)
-        }
-    }
+    ip := loginIP(r)
     if !ValidateAndClaimTokenFromIP(token, ip) {
         w.Header().Set("Content-Type", "application/json")
         w.WriteHeader(http.StatusNotFound)
@@ -107,13 +93,17 @@ func apiSessionValidate(w http.ResponseWriter, r *http.Request) {
         return
     }
     userAgent := r.Header.Get("User-Agent")
+    // Look up the agent before StoreUpdateSession: the callback runs under the store lock
+    var agent *User
+    if ses := StoreGetSession(token); ses != nil {
+        agent = StoreGetUser(ses.AgentID)
+    }
     StoreUpdateSession(token, func(s *CoBrowseSession) bool {
         s.ClientIPAtConnect = ip
         s.ClientUserAgent = userAgent
         s.Status = StatusConnected
         now := time.Now()
         s.ClientConnectedAt = &now
-        agent := StoreGetUser(s.AgentID)
         if agent != nil {
             s.AgentNameSnapshot = agent.Email
         }
@@ -122,6 +112,7 @@ func apiSessionValidate(w http.ResponseWriter, r *http.Request) {
     StoreAppendAudit(token, "client", ip, "client_connect", map[string]interface{}{
         "ip": ip, "userAgent": userAgent,
     })
+    PublishSessionEvent(token, EventClientConnected, map[string]interface{}{"ip": ip})
     ses := StoreGetSession(token)
     agentName := ""
     if ses != nil {
@@ -173,35 +164,41 @@ func apiSessionConsent(w http.ResponseWriter, r *http.Request) {
         json.NewEncoder(w).Encode(map[string]string{"error": "Session not found"})
         return
     }
+    PublishSessionEvent(token, EventConsent, map[string]interface{}{"consent": consent})
+    if consent {
+        MaybeStartRecording(token)
+    } else {
+        StopRecording(token, "consent_withdrawn")
+    }
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusOK)
     json.NewEncoder(w).Encode(map[string]bool{"ok": true})
 }
 
 func apiSessionCreate(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPost && r.Method != http.MethodGet && r.Method != http.MethodOptions {
+    if r.Method != http.MethodPost && r.Method != http.MethodOptions {
         w.Header().Set("Content-Type", "application/json")
         w.WriteHeader(http.StatusMethodNotAllowed)
         json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
         return
     }
+    setCORSHeaders(w, r, "POST, OPTIONS")
     if r.Method == http.MethodOptions {
-        w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
         w.WriteHeader(http.StatusOK)
         return
     }
-    userID, role, authed := GetSessionUser(r)
-    if !authed || (role != RoleSRM && role != RoleAdmin) {
+    userID, role, authed := RequestCan(r, PermSessionCreate)
+    if !authed {
         w.Header().Set("Content-Type", "application/json")
         w.WriteHeader(http.StatusUnauthorized)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Agent or Admin login required"})
+        json.NewEncoder(w).Encode(map[string]string{"error": "session.create permission required"})
         return
     }
     w.Header().Set("Content-Type", "application/json")
-    w.Header().Set("Access-Control-Allow-Origin", "*")
     token := CreatePendingSession()
     StoreCreateSession(token, userID)
-    StoreAppendGlobalAudit(string(role), userID, "session_create", map[string]interface{}{"token": token})
+    StoreAppendGlobalAudit(string(role), userID, "session_create", withAPIKey(r, map[string]interface{}{"token": token}))
+    PublishSessionEvent(token, EventSessionCreated, nil)
     log.Println("session/create: roomId=", token, "agentId=", userID)
     scheme := "https"
     if r.TLS == nil {
@@ -233,39 +230,69 @@ func apiAgentSessions(w http.ResponseWriter, r *http.Request) {
         json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
         return
     }
-    userID, role, authed := GetSessionUser(r)
-    if !authed || (role != RoleSRM && role != RoleAdmin) {
+    userID, _, authed := RequestCan(r, PermSessionCreate)
+    if !authed {
         w.Header().Set("Content-Type", "application/json")
         w.WriteHeader(http.StatusUnauthorized)
         json.NewEncoder(w).Encode(map[string]string{"error": "login required"})
         return
     }
+    // ?scope=team lists the whole team's sessions for a supervisor
+    if r.URL.Query().Get("scope") == "team" {
+        team := supervisedTeam(userID)
+        if team == nil {
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(http.StatusForbidden)
+            json.NewEncoder(w).Encode(map[string]string{"error": "Not a team supervisor"})
+            return
+        }
+        list := StoreListSessionsByTeam(team.ID)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{"sessions": list, "team": teamView{Team: *team, Members: teamMembers(team.ID)}})
+        return
+    }
     list := StoreListSessionsByAgent(userID)
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(map[string]interface{}{"sessions": list})
 }
 
+// apiSessionStatus returns one session by ?id= to its owner, a supervisor of
+// the owner's team or a reviewer. An API key without the session.review scope
+// only sees its own account's sessions.
+func apiSessionStatus(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    userID, role, _ := RequestCan(r, PermSessionCreate, PermSessionReview)
+    s := StoreGetSession(strings.TrimSpace(r.URL.Query().Get("id")))
+    if !canActOnSession(r, userID, role, s) {
+        w.WriteHeader(http.StatusNotFound)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Session not found"})
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]interface{}{"session": s})
+}
+
 func apiCreateSession(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
-    w.Header().Set("Access-Control-Allow-Origin", "*")
-    if r.Method != http.MethodPost && r.Method != http.MethodGet && r.Method != http.MethodOptions {
+    if r.Method != http.MethodPost && r.Method != http.MethodOptions {
         w.WriteHeader(http.StatusMethodNotAllowed)
         json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
         return
     }
+    setCORSHeaders(w, r, "POST, OPTIONS")
     if r.Method == http.MethodOptions {
-        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
         w.WriteHeader(http.StatusOK)
         return
     }
-    userID, role, authed := GetSessionUser(r)
-    if !authed || (role != RoleSRM && role != RoleAdmin) {
+    userID, role, authed := RequestCan(r, PermSessionCreate)
+    if !authed {
         w.WriteHeader(http.StatusUnauthorized)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Agent or Admin login required"})
+        json.NewEncoder(w).Encode(map[string]string{"error": "session.create permission required"})
         return
     }
     token := CreatePendingSession()
     StoreCreateSession(token, userID)
+    StoreAppendGlobalAudit(string(role), userID, "session_create", withAPIKey(r, map[string]interface{}{"token": token}))
+    PublishSessionEvent(token, EventSessionCreated, nil)
     log.Println("create-session: created token=", token)
     w.WriteHeader(http.StatusOK)
     resp := map[string]string{"token": token, "sessionId": token, "sessionCode": token}
@@ -279,7 +306,7 @@ var upgrader = websocket.Upgrader{
     WriteBufferSize: 1024,
 }
 
-func sendHeartBeatWS(ticker *time.Ticker, conn *websocket.Conn, quit chan struct{}) {
+func sendHeartBeatWS(ticker *time.Ticker, conn *wsConn, quit chan struct{}) {
     for {
         select {
         case <- ticker.C:
@@ -293,312 +320,132 @@ func sendHeartBeatWS(ticker *time.Ticker, conn *websocket.Conn, quit chan struct
     }
 }
 
-func GetHttp() *http.ServeMux {
-    server := http.NewServeMux()
-
-    server.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("files/static"))))
-
-    // Register /api/auth-check first so it reliably matches
-    server.HandleFunc("/api/auth-check", ApiAuthCheck)
-
-    // API sub-mux: /api/*
-    apiMux := http.NewServeMux()
-    apiMux.HandleFunc("/health", ApiHealth)
-    apiMux.HandleFunc("/validate", apiValidate)
-    apiMux.HandleFunc("/create-session", apiCreateSession)
-    sessionApi := http.NewServeMux()
-    sessionApi.HandleFunc("/create", apiSessionCreate)
-    sessionApi.HandleFunc("/list", apiAgentSessions)
-    sessionApi.HandleFunc("/validate", apiSessionValidate)
-    sessionApi.HandleFunc("/consent", apiSessionConsent)
-    apiMux.Handle("/session/", http.StripPrefix("/session", sessionApi))
-    apiMux.HandleFunc("/login", apiLogin)
-    apiMux.HandleFunc("/logout", apiLogout)
-    apiMux.HandleFunc("/auth-check", ApiAuthCheck)
-
-    // Admin API (RBAC enforced)
-    adminApi := http.NewServeMux()
-    adminApi.HandleFunc("/dashboard", RequireAdmin(adminDashboard))
-    adminApi.HandleFunc("/agents/", RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
-        if r.Method == http.MethodPut || r.Method == http.MethodPatch {
-            adminUpdateAgent(w, r)
-        } else {
-            w.WriteHeader(http.StatusMethodNotAllowed)
-        }
-    }))
-    adminApi.HandleFunc("/agents", RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
-        if r.Method == http.MethodGet {
-            adminListAgents(w, r)
-        } else if r.Method == http.MethodPost {
-            adminCreateAgent(w, r)
-        } else {
-            w.WriteHeader(http.StatusMethodNotAllowed)
-        }
-    }))
-    adminApi.HandleFunc("/srms/", RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
-        if r.Method == http.MethodPut || r.Method == http.MethodPatch {
-            adminUpdateAgent(w, r)
-        } else {
-            w.WriteHeader(http.StatusMethodNotAllowed)
-        }
-    }))
-    adminApi.HandleFunc("/srms", RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
-        if r.Method == http.MethodGet {
-            adminListAgents(w, r)
-        } else if r.Method == http.MethodPost {
-            adminCreateAgent(w, r)
-        } else {
-            w.WriteHeader(http.StatusMethodNotAllowed)
-        }
-    }))
-    adminApi.HandleFunc("/settings", RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
-        if r.Method == http.MethodGet {
-            adminGetSettings(w, r)
-        } else {
-            adminSetSettings(w, r)
-        }
-    }))
-    adminApi.HandleFunc("/documents", RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
-        if r.Method == http.MethodGet {
-            adminListDocuments(w, r)
-        } else if r.Method == http.MethodPost {
-            adminCreateDocument(w, r)
-        } else {
-            w.WriteHeader(http.StatusMethodNotAllowed)
-        }
-    }))
-    adminApi.HandleFunc("/documents/", RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
-        if r.Method == http.MethodPut || r.Method == http.MethodPatch {
-            adminUpdateDocument(w, r)
-        } else if r.Method == http.MethodDelete {
-            adminDeleteDocument(w, r)
-        } else {
-            w.WriteHeader(http.StatusMethodNotAllowed)
-        }
-    }))
-    adminApi.HandleFunc("/onboarding-flow", RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
-        if r.Method == http.MethodGet {
-            adminGetOnboardingFlow(w, r)
-        } else {
-            adminSetOnboardingFlow(w, r)
-        }
-    }))
-    adminApi.HandleFunc("/sessions", RequireAdmin(adminListSessions))
-    adminApi.HandleFunc("/sessions/", RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
-        path := strings.TrimPrefix(r.URL.Path, "/sessions/")
-        id := strings.Split(path, "/")[0]
-        if id == "" {
-            http.Error(w, "session id required", http.StatusBadRequest)
-            return
-        }
-        if r.Method == http.MethodPost || r.Method == http.MethodDelete {
-            adminTerminateSession(w, r)
-        } else {
-            adminGetSession(w, r)
-        }
-    }))
-    adminApi.HandleFunc("/audit", RequireAdmin(adminListAudit))
-    adminApi.HandleFunc("/review/", RequireAdmin(func(w http.ResponseWriter, r *http.Request) {
-        if r.Method == http.MethodPut || r.Method == http.MethodPost {
-            adminReviewSession(w, r)
-        } else {
-            w.WriteHeader(http.StatusMethodNotAllowed)
-        }
-    }))
-    apiMux.Handle("/admin/", http.StripPrefix("/admin", adminApi))
-
-    server.Handle("/api/", http.StripPrefix("/api", apiMux))
-
-    server.HandleFunc("/logout", apiLogout)
-
-    connectHandler := func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "files/connect.html") }
-    server.HandleFunc("/connect", connectHandler)
-    server.HandleFunc("/connect/", connectHandler)
-    server.HandleFunc("/start", connectHandler)
-    server.HandleFunc("/start/", connectHandler)
-
-    server.HandleFunc("/join", func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "files/join.html") })
-
-    server.HandleFunc("/room/", func(w http.ResponseWriter, r *http.Request) {
-        roomId := strings.TrimPrefix(r.URL.Path, "/room/")
-        if idx := strings.Index(roomId, "/"); idx >= 0 {
-            roomId = roomId[:idx]
-        }
-        roomId = strings.TrimSpace(roomId)
-        if roomId == "" {
-            http.Redirect(w, r, "/join", http.StatusFound)
-            return
+// wsServe is the WebSocket of the client sharing its screen (the caller)
+func wsServe(writer http.ResponseWriter, request *http.Request) {
+    ws, err := upgrader.Upgrade(writer, request, nil)
+    if err != nil {
+        return
+    }
+    conn := newWSConn(ws)
+    claim := request.URL.Query().Get("claim")
+    var room *Room
+    if claim != "" && ValidateAndClaimToken(claim) && !roomExists(claim) {
+        ClaimPendingSession(claim)
+        room = NewRoomWithID(conn, claim)
+    } else {
+        room = NewRoom(conn)
+    }
+    if err := conn.WriteJSON(WSMessage{
+        SessionID: "",
+        Type:      "newRoom",
+        Value:     room.ID,
+    }); err != nil {
+        log.Println("newSessionWriteJsonError.", err)
+        return
+    }
+    if StoreGetGlobalSettings().SFUEnabled {
+        if err := startSFU(room); err != nil {
+            log.Println("sfuStartError.", err)
         }
-        http.Redirect(w, r, "/stream.html?stream=1&room="+url.QueryEscape(roomId), http.StatusFound)
-    })
-
-    server.HandleFunc("/stream.html", func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "files/main.html") })
+    }
+    MaybeStartRecording(room.ID)
+
+    go func(r *Room) {
+        ticker := time.NewTicker(10 * time.Second)
+        quit := make(chan struct{})
+        r.attachBroker(quit)
+        defer func() {
+            ticker.Stop()
+            _ = room.CallerConn.Close()
+            close(quit)
+            RemoveRoom(r.ID)
+            if StoreGetSession(r.ID) != nil {
+                PublishSessionEvent(r.ID, EventClientDisconnected, nil)
+            }
+            for _, s := range r.SessionList() {
+                _ = s.WriteCallee(WSMessage{
+                    Type: "roomClosed",
+                    SessionID: s.ID,
+                })
+            }
+        }()
 
-    // SRM login (only /srm/login — /agent/* redirects handled in middleware)
-    serveSRMLogin := func(w http.ResponseWriter, r *http.Request) {
-        w.Header().Set("Cache-Control", "no-store, no-cache")
-        http.ServeFile(w, r, "files/agent-login.html")
-    }
-    server.HandleFunc("/srm/login", serveSRMLogin)
-    server.HandleFunc("/srm/login/", func(w http.ResponseWriter, r *http.Request) {
-        http.Redirect(w, r, "/srm/login", http.StatusMovedPermanently)
-        return
-    })
+        go sendHeartBeatWS(ticker, conn, quit)
 
-    // SRM routes: /srm, /srm/session/:roomId, /viewer/:roomId
-    srmRoutes := func(w http.ResponseWriter, r *http.Request) {
-        path := r.URL.Path
-        w.Header().Set("Cache-Control", "no-store, no-cache")
-        if strings.HasPrefix(path, "/viewer/") {
-            roomId := strings.TrimPrefix(path, "/viewer/")
-            if idx := strings.Index(roomId, "/"); idx >= 0 {
-                roomId = roomId[:idx]
-            }
-            roomId = strings.TrimSpace(roomId)
-            if roomId != "" {
-                http.Redirect(w, r, "/stream.html?id="+url.QueryEscape(roomId), http.StatusFound)
+        //noinspection ALL
+        defer room.CallerConn.Close()
+        for {
+            var msg WSMessage
+            if err := room.CallerConn.ReadJSON(&msg); err != nil {
+                log.Println("websocketError.", err)
                 return
             }
-        }
-        if strings.HasPrefix(path, "/srm/session/") {
-            roomId := strings.TrimPrefix(path, "/srm/session/")
-            if idx := strings.Index(roomId, "/"); idx >= 0 {
-                roomId = roomId[:idx]
+            //log.Println(msg)
+            s := room.GetSession(msg.SessionID)
+            if s == nil {
+                log.Println("session nil.", msg.SessionID)
+                continue
             }
-            roomId = strings.TrimSpace(roomId)
-            if roomId != "" {
-                http.Redirect(w, r, "/stream.html?id="+url.QueryEscape(roomId), http.StatusFound)
-                return
+            if msg.Type == StatsMessageType {
+                recordConnStats(s, statsPeerClient, msg)
+                continue
+            }
+            if msg.Type == "addCallerIceCandidate" {
+                s.CallerIceCandidates = append(s.CallerIceCandidates, msg.Value)
+            } else if msg.Type == "gotOffer" {
+                s.Offer = msg.Value
+            } else if msg.Type == GuidanceRequestClickResponse {
+                recordGuidanceResponse(s, msg)
+            }
+            if err := s.WriteCallee(msg); err != nil {
+                log.Println("serveEchoWriteJsonError.", err)
             }
         }
-        if path == "/srm" || path == "/srm/" || strings.HasPrefix(path, "/srm/") {
-            http.ServeFile(w, r, "files/agent.html")
-            return
-        }
-        http.Redirect(w, r, "/srm", http.StatusFound)
-    }
-    server.HandleFunc("/srm", srmRoutes)
-    server.HandleFunc("/srm/", srmRoutes)
-    server.HandleFunc("/viewer/", srmRoutes)
-
-    // Redirect /agent/* → /srm/* (permanent — middleware does this before mux; fallback here)
-    server.HandleFunc("/agent", func(w http.ResponseWriter, r *http.Request) {
-        http.Redirect(w, r, "/srm", http.StatusMovedPermanently)
-    })
-    server.HandleFunc("/agent/", func(w http.ResponseWriter, r *http.Request) {
-        srmPath := "/srm" + strings.TrimPrefix(r.URL.Path, "/agent")
-        http.Redirect(w, r, srmPath, http.StatusMovedPermanently)
-    })
+    }(room)
+}
 
-    // /admin/login: explicit route (must come before /admin/ to take precedence)
-    server.HandleFunc("/admin/login", func(w http.ResponseWriter, r *http.Request) {
-        w.Header().Set("Cache-Control", "no-store, no-cache")
-        w.Header().Set("Content-Type", "text/html; charset=utf-8")
-        http.ServeFile(w, r, "files/admin-login.html")
-    })
-    server.HandleFunc("/admin/login/", func(w http.ResponseWriter, r *http.Request) {
-        http.Redirect(w, r, "/admin/login", http.StatusMovedPermanently)
+// wsConnect is the WebSocket of a viewer joining a room (the callee)
+func wsConnect(writer http.ResponseWriter, request *http.Request) {
+    ws, err := upgrader.Upgrade(writer, request, nil)
+    if err != nil {
         return
-    })
-
-    // Admin SPA: /admin, /admin/agents, /admin/settings, etc. all serve admin.html
-    adminRoutes := func(w http.ResponseWriter, r *http.Request) {
-        path := r.URL.Path
-        if path == "/admin/login" || strings.HasPrefix(path, "/admin/login/") {
-            http.ServeFile(w, r, "files/admin-login.html")
-            return
-        }
-        w.Header().Set("Cache-Control", "no-store, no-cache")
-        http.ServeFile(w, r, "files/admin.html")
     }
-    server.HandleFunc("/admin", adminRoutes)
-    server.HandleFunc("/admin/", adminRoutes)
+    conn := newWSConn(ws)
 
-    wsServe := func(writer http.ResponseWriter, request *http.Request) {
-        conn, _ := upgrader.Upgrade(writer, request, nil)
-        claim := request.URL.Query().Get("claim")
-        var room *Room
-        if claim != "" && ValidateAndClaimToken(claim) && GetRoom(claim) == nil {
-            ClaimPendingSession(claim)
-            room = NewRoomWithID(conn, claim)
-        } else {
-            room = NewRoom(conn)
-        }
-        if err := conn.WriteJSON(WSMessage{
-            SessionID: "",
-            Type:      "newRoom",
-            Value:     room.ID,
-        }); err != nil {
-            log.Println("newSessionWriteJsonError.", err)
+    ids, ok := request.URL.Query()["id"]
+    if !ok || len(ids) == 0 || ids[0] == "" {
+        ids, ok = request.URL.Query()["room"]
+        if !ok || len(ids) == 0 || ids[0] == "" {
             return
         }
-
-        go func(r *Room) {
-            ticker := time.NewTicker(10 * time.Second)
-            quit := make(chan struct{})
-            defer func() {
-                ticker.Stop()
-                _ = room.CallerConn.Close()
-                close(quit)
-                RemoveRoom(r.ID)
-                for sID, s := range r.Sessions {
-                    _ = s.CalleeConn.WriteJSON(WSMessage{
-                        Type: "roomClosed",
-                        SessionID: sID,
-                    })
-                }
-            }()
-
-            go sendHeartBeatWS(ticker, conn, quit)
-
-            //noinspection ALL
-            defer room.CallerConn.Close()
-            for {
-                var msg WSMessage
-                if err := room.CallerConn.ReadJSON(&msg); err != nil {
-                    log.Println("websocketError.", err)
-                    return
-                }
-                //log.Println(msg)
-                s := room.GetSession(msg.SessionID)
-                if s == nil {
-                    log.Println("session nil.", msg.SessionID)
-                    continue
-                }
-                if msg.Type == "addCallerIceCandidate" {
-                    s.CallerIceCandidates = append(s.CallerIceCandidates, msg.Value)
-                } else if msg.Type == "gotOffer" {
-                    s.Offer = msg.Value
-                }
-                if err := s.CalleeConn.WriteJSON(msg); err != nil {
-                    log.Println("serveEchoWriteJsonError.", err)
-                }
-            }
-        }(room)
     }
-    server.HandleFunc("/ws/serve", wsServe)
-
-    wsConnect := func(writer http.ResponseWriter, request *http.Request) {
-        conn, _ := upgrader.Upgrade(writer, request, nil)
 
-        ids, ok := request.URL.Query()["id"]
-        if !ok || len(ids) == 0 || ids[0] == "" {
-            ids, ok = request.URL.Query()["room"]
-            if !ok || len(ids) == 0 || ids[0] == "" {
-                return
-            }
-        }
-
-        room := GetRoom(ids[0])
-        if room == nil {
-            _ = conn.WriteJSON(WSMessage{
-                Type: "roomNotFound",
-            })
+    var session *StreamSession
+    var sfu *sfuRoom
+    if room := GetRoom(ids[0]); room != nil {
+        session = room.NewSession(conn)
+        sfu = room.sfu
+    } else if roomExists(ids[0]) {
+        s, err := newRemoteViewerSession(ids[0], conn)
+        if err != nil {
+            log.Println("remoteSessionError.", err)
             return
         }
-        session := room.NewSession(conn)
+        session = s
+    } else {
+        _ = conn.WriteJSON(WSMessage{
+            Type: "roomNotFound",
+        })
+        return
+    }
+    if viewerID, viewerRole, authed := GetSessionUser(request); authed && RoleHasAnyPermission(viewerRole, PermSessionCreate, PermSessionReview) {
+        session.ViewerID = viewerID
+        session.ViewerRole = viewerRole
+    }
 
-        if err := room.CallerConn.WriteJSON(WSMessage{
+    // In SFU mode the server, not the client, offers to the viewer
+    if sfu == nil {
+        if err := session.WriteCaller(WSMessage{
             SessionID: session.ID,
             Type:      "newSession",
             Value:     session.ID,
@@ -606,45 +453,58 @@ func GetHttp() *http.ServeMux {
             log.Println("callerWriteJsonError.", err)
             return
         }
+    }
 
-        if err := conn.WriteJSON(WSMessage{
-            SessionID: session.ID,
-            Type:      "newSession",
-            Value:     session.ID,
-        }); err != nil {
-            log.Println("calleeWriteJsonError.", err)
+    if err := conn.WriteJSON(WSMessage{
+        SessionID: session.ID,
+        Type:      "newSession",
+        Value:     session.ID,
+    }); err != nil {
+        log.Println("calleeWriteJsonError.", err)
+        return
+    }
+    if sfu != nil {
+        sub, err := sfu.subscribe(session)
+        if err != nil {
+            log.Println("sfuSubscribeError.", err)
             return
         }
+        session.sfuSub = sub
+    }
 
-        go func(s *StreamSession) {
-            //noinspection ALL
-            defer s.CalleeConn.Close()
-            for {
-                var msg WSMessage
-                if err := conn.ReadJSON(&msg); err != nil {
-                    log.Println("websocketError.", err)
-                    return
+    go func(s *StreamSession) {
+        //noinspection ALL
+        defer s.CalleeConn.Close()
+        defer s.leave()
+        for {
+            var msg WSMessage
+            if err := conn.ReadJSON(&msg); err != nil {
+                log.Println("websocketError.", err)
+                return
+            }
+            //log.Println(msg)
+            if msg.SessionID == s.ID {
+                if IsGuidanceType(msg.Type) {
+                    relayGuidance(s, msg)
+                    continue
+                }
+                if msg.Type == StatsMessageType {
+                    recordConnStats(s, statsPeerViewer, msg)
+                    continue
+                }
+                if msg.Type == "addCalleeIceCandidate" {
+                    s.CalleeIceCandidates = append(s.CalleeIceCandidates, msg.Value)
+                } else if msg.Type == "gotAnswer" {
+                    s.Answer = msg.Value
                 }
-                //log.Println(msg)
-                if msg.SessionID == s.ID {
-                    if msg.Type == "addCalleeIceCandidate" {
-                        s.CalleeIceCandidates = append(s.CalleeIceCandidates, msg.Value)
-                    } else if msg.Type == "gotAnswer" {
-                        s.Answer = msg.Value
-                    }
-                    if err := s.CallerConn.WriteJSON(msg); err != nil {
-                        log.Println("connectEchoWriteJsonError.", err)
-                    }
+                if s.sfuSub != nil && (msg.Type == "gotAnswer" || msg.Type == "addCalleeIceCandidate") {
+                    s.sfuSub.handleViewerSignal(msg)
+                    continue
+                }
+                if err := s.WriteCaller(msg); err != nil {
+                    log.Println("connectEchoWriteJsonError.", err)
                 }
             }
-        }(session)
-    }
-    server.HandleFunc("/ws/connect", wsConnect)
-
-    // Catch-all: 404 for unknown routes. / redirects to /srm in middleware; landing served at /srm.
-    server.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-        http.NotFound(w, r)
-    })
-
-    return server
+        }
+    }(session)
 }
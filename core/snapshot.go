@@ -0,0 +1,139 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Snapshot is a still image of the client's screen captured by a viewer and
+// kept as evidence against the CoBrowseSession
+type Snapshot struct {
+	ID           string    `json:"id"`
+	SessionID    string    `json:"sessionId"`
+	UploadedBy   string    `json:"uploadedBy"`
+	UploaderRole Role      `json:"uploaderRole"`
+	SHA256       string    `json:"sha256"`
+	ContentType  string    `json:"contentType"`
+	SizeBytes    int64     `json:"sizeBytes"`
+	Path         string    `json:"-"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+const maxSnapshotBytes = 10 << 20
+
+var (
+	snapshotDir          = "snapshots"
+	snapshotContentTypes = map[string]string{"image/png": ".png", "image/jpeg": ".jpg", "image/webp": ".webp"}
+)
+
+// SetSnapshotDir sets where snapshot images are written
+func SetSnapshotDir(dir string) {
+	snapshotDir = dir
+}
+
+// apiSessionSnapshot handles POST /api/session/snapshot?sessionId=... with the
+// raw image as the body. Only the session's SRM or an admin may upload, and
+// only while the client's consent stands.
+func apiSessionSnapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "method not allowed"})
+		return
+	}
+	userID, role, authed := RequestCan(r, PermSessionCreate, PermSessionReview)
+	if !authed {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Agent or Admin login required"})
+		return
+	}
+	sessionID := strings.TrimSpace(r.URL.Query().Get("sessionId"))
+	s := StoreGetSession(sessionID)
+	if s == nil || !canActOnSession(r, userID, role, s) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Session not found"})
+		return
+	}
+	if !s.ConsentGiven {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Client has not consented to capture"})
+		return
+	}
+	contentType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	ext, ok := snapshotContentTypes[contentType]
+	if !ok {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		json.NewEncoder(w).Encode(map[string]string{"error": "PNG, JPEG or WebP image required"})
+		return
+	}
+	if err := os.MkdirAll(snapshotDir, 0o700); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Storage unavailable"})
+		return
+	}
+	id := GetRandomName(1)
+	path := filepath.Join(snapshotDir, fmt.Sprintf("%s-%s%s", sessionID, id, ext))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Storage unavailable"})
+		return
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), http.MaxBytesReader(w, r.Body, maxSnapshotBytes))
+	cerr := f.Close()
+	if err != nil || cerr != nil || n == 0 {
+		os.Remove(path)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Empty or oversized image"})
+		return
+	}
+	snap := &Snapshot{
+		ID:           id,
+		SessionID:    sessionID,
+		UploadedBy:   userID,
+		UploaderRole: role,
+		SHA256:       hex.EncodeToString(h.Sum(nil)),
+		ContentType:  contentType,
+		SizeBytes:    n,
+		Path:         path,
+		CreatedAt:    time.Now(),
+	}
+	StoreSaveSnapshot(snap)
+	StoreAppendAudit(sessionID, string(role), userID, "snapshot_captured", map[string]interface{}{
+		"snapshotId": id, "sha256": snap.SHA256, "sizeBytes": n,
+	})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(snap)
+}
+
+// adminSnapshot handles GET /snapshots/:id (download)
+func adminSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/snapshots/")
+	id := strings.Split(path, "/")[0]
+	snap := StoreGetSnapshot(id)
+	if snap == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Snapshot not found"})
+		return
+	}
+	userID, _, _ := GetSessionUser(r)
+	StoreAppendGlobalAudit("admin", userID, "snapshot_download", map[string]interface{}{"snapshotId": id, "sessionId": snap.SessionID})
+	w.Header().Set("Content-Type", snap.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(snap.Path)))
+	w.Header().Set("X-Content-SHA256", snap.SHA256)
+	http.ServeFile(w, r, snap.Path)
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -10,7 +11,7 @@ func normalizeEmail(e string) string {
 	return strings.TrimSpace(strings.ToLower(e))
 }
 
-// Role represents user role in RBAC
+// Role names a RoleDef (see permissions.go). The constants are the built-in roles.
 type Role string
 
 const (
@@ -26,7 +27,38 @@ type User struct {
 	Role      Role      `json:"role"`
 	Active    bool      `json:"active"`
 	Password  string    `json:"-"` // hashed; never expose
+	TeamID    string    `json:"teamId,omitempty"`
 	CreatedAt time.Time `json:"createdAt"`
+	// TOTP second factor. TOTPSecret is set at enrollment and only used once
+	// TOTPEnabled; RecoveryCodes holds SHA-256 hashes of unused codes.
+	TOTPEnabled   bool     `json:"totpEnabled"`
+	TOTPSecret    string   `json:"-"`
+	TOTPLastStep  int64    `json:"-"` // last accepted time step, against replay
+	RecoveryCodes []string `json:"-"`
+	// Password lifecycle. MustChangePassword is set on creation and admin
+	// reset; PasswordHistory holds previous hashes, newest first.
+	PasswordChangedAt  time.Time `json:"passwordChangedAt,omitempty"`
+	MustChangePassword bool      `json:"mustChangePassword"`
+	PasswordHistory    []string  `json:"-"`
+	// Service accounts sign in with API keys only, never a password
+	Service bool `json:"service,omitempty"`
+	// The IdP subject ("sub") this account is linked to for single sign-on
+	OIDCSubject string `json:"-"`
+}
+
+// APIKey is a service account credential. Only the SHA-256 of its secret is
+// kept; the token is shown once, at creation.
+type APIKey struct {
+	ID         string       `json:"id"`
+	UserID     string       `json:"userId"`
+	Name       string       `json:"name"`
+	Hash       string       `json:"-"`
+	Scopes     []Permission `json:"scopes"`
+	RateLimit  int          `json:"rateLimit"` // requests per minute
+	CreatedAt  time.Time    `json:"createdAt"`
+	CreatedBy  string       `json:"createdBy"`
+	LastUsedAt *time.Time   `json:"lastUsedAt,omitempty"`
+	LastUsedIP string       `json:"lastUsedIp,omitempty"`
 }
 
 // GlobalSettings stores system-wide configuration
@@ -39,6 +71,37 @@ type GlobalSettings struct {
 	OnboardingSteps      []string `json:"onboardingSteps"`
 	KycModeDefault       string   `json:"kycModeDefault"` // manual | sumsub | mock
 	AllowedCountries     []string `json:"allowedCountries,omitempty"`
+	// ICE configuration served by /api/ice-servers. TurnSecret is the TURN REST
+	// shared secret used to mint time-limited credentials; never returned by GET.
+	StunURLs                 []string `json:"stunUrls,omitempty"`
+	TurnURLs                 []string `json:"turnUrls,omitempty"`
+	TurnSecret               string   `json:"turnSecret,omitempty"`
+	TurnCredentialTTLMinutes int      `json:"turnCredentialTtlMinutes,omitempty"`
+	// Server-side recording of the client's screen, only after consent
+	RecordingEnabled       bool `json:"recordingEnabled"`
+	RecordingRetentionDays int  `json:"recordingRetentionDays,omitempty"`
+	// SFU mode: the client publishes once to the server, which forwards to every viewer
+	SFUEnabled bool `json:"sfuEnabled"`
+	// Roles whose users must enroll a TOTP second factor before using the app
+	Require2FARoles []Role `json:"require2faRoles,omitempty"`
+	// Only single sign-on may be used; ignored while OIDC is not configured
+	PasswordLoginDisabled bool `json:"passwordLoginDisabled"`
+	// Failed-login lockout; zero uses the defaults (5 per account, 20 per IP, 15 minutes)
+	LoginMaxFailures    int `json:"loginMaxFailures,omitempty"`
+	LoginIPMaxFailures  int `json:"loginIpMaxFailures,omitempty"`
+	LoginLockoutMinutes int `json:"loginLockoutMinutes,omitempty"`
+	// Password policy; zero uses the defaults (10 characters, 3 character
+	// classes, 5 remembered passwords, no expiry)
+	PasswordMinLength  int `json:"passwordMinLength,omitempty"`
+	PasswordMinClasses int `json:"passwordMinClasses,omitempty"`
+	PasswordExpiryDays int `json:"passwordExpiryDays,omitempty"`
+	PasswordHistory    int `json:"passwordHistory,omitempty"`
+	// Logins end after this many minutes without a request; zero uses 60
+	LoginIdleMinutes int `json:"loginIdleMinutes,omitempty"`
+	// Emailed password reset links expire after this many minutes; zero uses 30
+	PasswordResetMinutes int `json:"passwordResetMinutes,omitempty"`
+	// Largest client document upload in MB; zero uses 10
+	UploadMaxMB int `json:"uploadMaxMb,omitempty"`
 }
 
 // DocumentTemplate is a global document in the library
@@ -50,6 +113,17 @@ type DocumentTemplate struct {
 	Required  bool      `json:"required"`
 	Version   int       `json:"version"`
 	UpdatedAt time.Time `json:"updatedAt"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+	// The version this one restored, when it was saved by a rollback
+	RolledBackFrom int `json:"rolledBackFrom,omitempty"`
+}
+
+// AppliedDocTemplate pins the exact template version a session was given
+type AppliedDocTemplate struct {
+	ID       string `json:"id"`
+	Version  int    `json:"version"`
+	Title    string `json:"title"`
+	Required bool   `json:"required"`
 }
 
 // SessionStatus represents co-browse session lifecycle
@@ -76,7 +150,7 @@ type CoBrowseSession struct {
 	ClientIPAtConnect   string       `json:"clientIpAtConnect,omitempty"`
 	ClientUserAgent     string       `json:"clientUserAgentAtConnect,omitempty"`
 	RequestedDocs        []string     `json:"requestedDocs,omitempty"`
-	AppliedDocTemplates  []string     `json:"appliedDocTemplates,omitempty"`
+	AppliedDocTemplates  []AppliedDocTemplate `json:"appliedDocTemplates,omitempty"`
 	OnboardingMode      string       `json:"onboardingMode"`
 	ApplicationName     string       `json:"applicationName,omitempty"`
 	AdminDecision       string       `json:"adminDecision,omitempty"`
@@ -87,6 +161,8 @@ type CoBrowseSession struct {
 	CreatedAt           time.Time    `json:"createdAt"`
 	ClientConnectedAt   *time.Time   `json:"clientConnectedAt,omitempty"`
 	EndedAt             *time.Time   `json:"endedAt,omitempty"`
+	Documents           []ClientDocument `json:"documents,omitempty"`
+	Checklist           []ChecklistItem  `json:"checklist,omitempty"`
 }
 
 // AuditEvent is an append-only audit log entry
@@ -114,10 +190,17 @@ var (
 	usersByEmail   = make(map[string]string)
 	globalSettings *GlobalSettings
 	docTemplates   = make(map[string]*DocumentTemplate)
+	docVersions    = make(map[string][]DocumentTemplate) // template ID -> every saved version, oldest first
 	coBrowseSessions  = make(map[string]*CoBrowseSession)
 	sessionsByToken   = make(map[string]*CoBrowseSession)
 	auditEvents       = make(map[string][]*AuditEvent) // sessionId -> events
 	globalAuditEvents []*AuditEvent                    // system-wide audit (logins, settings, etc.)
+	recordings        = make(map[string]*Recording)
+	snapshots         = make(map[string]*Snapshot)
+	connStats         = make(map[string][]ConnStatsSample) // sessionId -> telemetry samples
+	roles             = defaultRoles()
+	teams             = make(map[string]*Team)
+	apiKeys           = make(map[string]*APIKey)
 )
 
 func initStore() {
@@ -131,6 +214,8 @@ func initStore() {
 			OnboardingSteps:      []string{"CONNECT", "SHARE", "DOCS", "FORM", "KYC", "SIGN", "REVIEW", "SUBMITTED"},
 			KycModeDefault:       "manual",
 			AllowedCountries:     []string{},
+			StunURLs:             []string{"stun:stun1.l.google.com:19302", "stun:stun2.l.google.com:19302"},
+			TurnCredentialTTLMinutes: defaultTurnCredentialTTL,
 		}
 	}
 }
@@ -182,6 +267,7 @@ func StoreCreateUser(email string, role Role, passwordHash string) (*User, error
 		Password:  passwordHash,
 		CreatedAt: time.Now(),
 	}
+	u.PasswordChangedAt = u.CreatedAt
 	users[id] = u
 	usersByEmail[email] = id
 	cp := *u
@@ -203,6 +289,138 @@ func StoreUpdateUser(id string, fn func(*User) bool) bool {
 	return true
 }
 
+func StoreGetRole(name Role) *RoleDef {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	def := roles[name]
+	if def == nil {
+		return nil
+	}
+	cp := *def
+	cp.Permissions = append([]Permission(nil), def.Permissions...)
+	return &cp
+}
+
+func StoreListRoles() []RoleDef {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	list := make([]RoleDef, 0, len(roles))
+	for _, def := range roles {
+		list = append(list, *def)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// StoreCreateRole adds def; false if a role with that name exists
+func StoreCreateRole(def *RoleDef) bool {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if roles[def.Name] != nil {
+		return false
+	}
+	cp := *def
+	roles[def.Name] = &cp
+	return true
+}
+
+func StoreSaveRole(def *RoleDef) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	cp := *def
+	roles[def.Name] = &cp
+}
+
+func StoreDeleteRole(name Role) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	delete(roles, name)
+}
+
+func StoreGetTeam(id string) *Team {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	t := teams[id]
+	if t == nil {
+		return nil
+	}
+	cp := *t
+	cp.SupervisorIDs = append([]string(nil), t.SupervisorIDs...)
+	return &cp
+}
+
+// StoreListTeams returns teams sorted by name
+func StoreListTeams() []Team {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	list := []Team{}
+	for _, t := range teams {
+		cp := *t
+		cp.SupervisorIDs = append([]string(nil), t.SupervisorIDs...)
+		list = append(list, cp)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// StoreSaveTeam upserts t and makes memberIDs its exact membership. Members
+// leave any previous team (and its supervisor list); former members not in
+// memberIDs are left without a team.
+func StoreSaveTeam(t *Team, memberIDs []string) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if t.ID == "" {
+		t.ID = GetRandomName(1)
+		for teams[t.ID] != nil {
+			t.ID = GetRandomName(1)
+		}
+	}
+	keep := make(map[string]bool)
+	for _, id := range memberIDs {
+		keep[id] = true
+	}
+	for _, u := range users {
+		switch {
+		case keep[u.ID]:
+			if old := teams[u.TeamID]; old != nil && u.TeamID != t.ID {
+				old.SupervisorIDs = removeString(old.SupervisorIDs, u.ID)
+			}
+			u.TeamID = t.ID
+		case u.TeamID == t.ID:
+			u.TeamID = ""
+		}
+	}
+	cp := *t
+	cp.SupervisorIDs = append([]string(nil), t.SupervisorIDs...)
+	teams[t.ID] = &cp
+}
+
+// StoreDeleteTeam removes a team and clears its members' TeamID
+func StoreDeleteTeam(id string) bool {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if teams[id] == nil {
+		return false
+	}
+	delete(teams, id)
+	for _, u := range users {
+		if u.TeamID == id {
+			u.TeamID = ""
+		}
+	}
+	return true
+}
+
+func removeString(list []string, v string) []string {
+	out := list[:0]
+	for _, x := range list {
+		if x != v {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
 func StoreListUsers(role Role) []User {
 	storeMu.RLock()
 	defer storeMu.RUnlock()
@@ -211,7 +429,7 @@ func StoreListUsers(role Role) []User {
 		if u == nil {
 			continue
 		}
-		if role != "" && u.Role != role {
+		if u.Service || (role != "" && u.Role != role) {
 			continue
 		}
 		cp := *u
@@ -221,6 +439,75 @@ func StoreListUsers(role Role) []User {
 	return list
 }
 
+// StoreListServiceAccounts returns the service accounts, which StoreListUsers
+// leaves out
+func StoreListServiceAccounts() []User {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	var list []User
+	for _, u := range users {
+		if u != nil && u.Service {
+			cp := *u
+			cp.Password = ""
+			list = append(list, cp)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+func StoreSaveAPIKey(k *APIKey) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	cp := *k
+	apiKeys[k.ID] = &cp
+}
+
+func StoreGetAPIKey(id string) *APIKey {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	k := apiKeys[id]
+	if k == nil {
+		return nil
+	}
+	cp := *k
+	return &cp
+}
+
+// StoreListAPIKeys returns the keys of userID, or all when empty, oldest first
+func StoreListAPIKeys(userID string) []APIKey {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	list := []APIKey{}
+	for _, k := range apiKeys {
+		if k != nil && (userID == "" || k.UserID == userID) {
+			list = append(list, *k)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// StoreTouchAPIKey records a use of key id
+func StoreTouchAPIKey(id, ip string, at time.Time) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if k := apiKeys[id]; k != nil {
+		k.LastUsedAt = &at
+		k.LastUsedIP = ip
+	}
+}
+
+func StoreDeleteAPIKey(id string) bool {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if apiKeys[id] == nil {
+		return false
+	}
+	delete(apiKeys, id)
+	return true
+}
+
 func StoreGetGlobalSettings() *GlobalSettings {
 	storeMu.RLock()
 	defer storeMu.RUnlock()
@@ -262,6 +549,8 @@ func StoreGetDocument(id string) *DocumentTemplate {
 	return &cp
 }
 
+// StoreSaveDocument saves d as the next version of its template. Earlier
+// versions are kept, since sessions pin the version they were given.
 func StoreSaveDocument(d *DocumentTemplate) {
 	storeMu.Lock()
 	defer storeMu.Unlock()
@@ -270,24 +559,44 @@ func StoreSaveDocument(d *DocumentTemplate) {
 	}
 	if d.ID == "" {
 		d.ID = GetRandomName(1)
-		for docTemplates[d.ID] != nil {
+		for docTemplates[d.ID] != nil || docVersions[d.ID] != nil {
 			d.ID = GetRandomName(1)
 		}
 	}
-	d.Version++
+	d.Version = len(docVersions[d.ID]) + 1
 	d.UpdatedAt = time.Now()
 	docTemplates[d.ID] = d
+	docVersions[d.ID] = append(docVersions[d.ID], *d)
 }
 
+// StoreDeleteDocument removes the template from the library; its versions
+// stay readable for the sessions that pinned them
 func StoreDeleteDocument(id string) {
 	storeMu.Lock()
 	defer storeMu.Unlock()
 	delete(docTemplates, id)
 }
 
+// StoreListDocumentVersions returns every saved version of a template, oldest first
+func StoreListDocumentVersions(id string) []DocumentTemplate {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return append([]DocumentTemplate(nil), docVersions[id]...)
+}
+
+func StoreGetDocumentVersion(id string, version int) *DocumentTemplate {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	list := docVersions[id]
+	if version < 1 || version > len(list) {
+		return nil
+	}
+	cp := list[version-1]
+	return &cp
+}
+
 func StoreCreateSession(token, agentID string) *CoBrowseSession {
 	storeMu.Lock()
-	defer storeMu.Unlock()
 	s := &CoBrowseSession{
 		ID:      token,
 		Token:   token,
@@ -295,8 +604,17 @@ func StoreCreateSession(token, agentID string) *CoBrowseSession {
 		Status:  StatusLinkSent,
 		CreatedAt: time.Now(),
 	}
+	// Pin the library as it stands, so later edits do not change what this
+	// client was shown
+	for _, d := range docTemplates {
+		s.AppliedDocTemplates = append(s.AppliedDocTemplates, AppliedDocTemplate{ID: d.ID, Version: d.Version, Title: d.Title, Required: d.Required})
+	}
+	sort.Slice(s.AppliedDocTemplates, func(i, j int) bool { return s.AppliedDocTemplates[i].Title < s.AppliedDocTemplates[j].Title })
 	coBrowseSessions[token] = s
 	sessionsByToken[token] = s
+	cp := *s
+	storeMu.Unlock()
+	publishState(stateMessage{Kind: stateSession, Session: &cp})
 	return s
 }
 
@@ -316,15 +634,27 @@ func StoreGetSession(token string) *CoBrowseSession {
 
 func StoreUpdateSession(token string, fn func(*CoBrowseSession) bool) bool {
 	storeMu.Lock()
-	defer storeMu.Unlock()
 	s := coBrowseSessions[token]
 	if s == nil {
 		s = sessionsByToken[token]
 	}
-	if s == nil {
+	if s == nil || !fn(s) {
+		storeMu.Unlock()
 		return false
 	}
-	return fn(s)
+	cp := *s
+	storeMu.Unlock()
+	publishState(stateMessage{Kind: stateSession, Session: &cp})
+	return true
+}
+
+// storeApplySession upserts a session snapshot replicated from another instance
+func storeApplySession(s *CoBrowseSession) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	cp := *s
+	coBrowseSessions[cp.ID] = &cp
+	sessionsByToken[cp.Token] = &cp
 }
 
 func StoreListSessions() []CoBrowseSession {
@@ -351,9 +681,24 @@ func StoreListSessionsByAgent(agentID string) []CoBrowseSession {
 	return list
 }
 
+// StoreListSessionsByTeam returns sessions owned by members of team teamID
+func StoreListSessionsByTeam(teamID string) []CoBrowseSession {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	var list []CoBrowseSession
+	for _, s := range coBrowseSessions {
+		if s == nil {
+			continue
+		}
+		if u := users[s.AgentID]; u != nil && u.TeamID == teamID {
+			list = append(list, *s)
+		}
+	}
+	return list
+}
+
 func StoreAppendAudit(sessionID, actorRole, actorID, action string, payload map[string]interface{}) {
 	storeMu.Lock()
-	defer storeMu.Unlock()
 	ev := &AuditEvent{
 		ID:        GetRandomName(1),
 		SessionID: sessionID,
@@ -364,6 +709,17 @@ func StoreAppendAudit(sessionID, actorRole, actorID, action string, payload map[
 		CreatedAt: time.Now(),
 	}
 	auditEvents[sessionID] = append(auditEvents[sessionID], ev)
+	cp := *ev
+	storeMu.Unlock()
+	publishState(stateMessage{Kind: stateAudit, Audit: &cp})
+}
+
+// storeApplyAudit appends a session audit event replicated from another instance
+func storeApplyAudit(ev *AuditEvent) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	cp := *ev
+	auditEvents[cp.SessionID] = append(auditEvents[cp.SessionID], &cp)
 }
 
 func StoreGetAuditEvents(sessionID string) []AuditEvent {
@@ -414,3 +770,117 @@ func StoreListGlobalAudit(limit int) []AuditEvent {
 	}
 	return list
 }
+
+func StoreSaveRecording(rec *Recording) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	cp := *rec
+	recordings[rec.ID] = &cp
+}
+
+func StoreGetRecording(id string) *Recording {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	rec := recordings[id]
+	if rec == nil {
+		return nil
+	}
+	cp := *rec
+	return &cp
+}
+
+// StoreListRecordings returns recordings for sessionID, or all when empty
+func StoreListRecordings(sessionID string) []Recording {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	var list []Recording
+	for _, rec := range recordings {
+		if rec != nil && (sessionID == "" || rec.SessionID == sessionID) {
+			list = append(list, *rec)
+		}
+	}
+	return list
+}
+
+func StoreDeleteRecording(id string) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	delete(recordings, id)
+}
+
+// StoreAppendConnStats records a telemetry sample, keeping the newest
+// maxStatsPerSession per session
+func StoreAppendConnStats(x *ConnStatsSample) {
+	storeAppendConnStats(x)
+	cp := *x
+	publishState(stateMessage{Kind: stateStats, Stats: &cp})
+}
+
+// storeApplyConnStats records a telemetry sample replicated from another instance
+func storeApplyConnStats(x *ConnStatsSample) {
+	storeAppendConnStats(x)
+}
+
+func storeAppendConnStats(x *ConnStatsSample) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	list := append(connStats[x.SessionID], *x)
+	if len(list) > maxStatsPerSession {
+		list = list[len(list)-maxStatsPerSession:]
+	}
+	connStats[x.SessionID] = list
+}
+
+func StoreGetConnStats(sessionID string) []ConnStatsSample {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	return append([]ConnStatsSample(nil), connStats[sessionID]...)
+}
+
+// StoreListConnStats returns all samples in [from, to); zero bounds are open
+func StoreListConnStats(from, to time.Time) []ConnStatsSample {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	var list []ConnStatsSample
+	for _, samples := range connStats {
+		for _, x := range samples {
+			if (!from.IsZero() && x.CreatedAt.Before(from)) || (!to.IsZero() && !x.CreatedAt.Before(to)) {
+				continue
+			}
+			list = append(list, x)
+		}
+	}
+	return list
+}
+
+func StoreSaveSnapshot(snap *Snapshot) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	cp := *snap
+	snapshots[snap.ID] = &cp
+}
+
+func StoreGetSnapshot(id string) *Snapshot {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	snap := snapshots[id]
+	if snap == nil {
+		return nil
+	}
+	cp := *snap
+	return &cp
+}
+
+// StoreListSnapshots returns snapshots for sessionID, oldest first
+func StoreListSnapshots(sessionID string) []Snapshot {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+	var list []Snapshot
+	for _, snap := range snapshots {
+		if snap != nil && snap.SessionID == sessionID {
+			list = append(list, *snap)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
@@ -0,0 +1,303 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Team groups SRMs under one or more supervisors. Membership is stored on
+// User.TeamID; supervisors are always members of the team they supervise.
+type Team struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	SupervisorIDs []string  `json:"supervisorIds"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// IsSupervisor reports whether userID supervises the team
+func (t *Team) IsSupervisor(userID string) bool {
+	for _, id := range t.SupervisorIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// supervisedTeam returns the team userID supervises, or nil
+func supervisedTeam(userID string) *Team {
+	u := StoreGetUser(userID)
+	if u == nil || u.TeamID == "" {
+		return nil
+	}
+	t := StoreGetTeam(u.TeamID)
+	if t == nil || !t.IsSupervisor(userID) {
+		return nil
+	}
+	return t
+}
+
+// supervises reports whether userID supervises the team agentID belongs to
+func supervises(userID, agentID string) bool {
+	if agentID == "" {
+		return false
+	}
+	t := supervisedTeam(userID)
+	if t == nil {
+		return false
+	}
+	agent := StoreGetUser(agentID)
+	return agent != nil && agent.TeamID == t.ID
+}
+
+// canActOnSession reports whether the user may view and act on a session they
+// may not own: reviewers always can, supervisors for their team's sessions.
+// For an API key only the permissions it is scoped to count.
+func canActOnSession(r *http.Request, userID string, role Role, s *CoBrowseSession) bool {
+	if s == nil {
+		return false
+	}
+	if s.AgentID == userID || requestHasPermission(r, role, PermSessionReview) {
+		return true
+	}
+	return requestHasPermission(r, role, PermSessionCreate) && supervises(userID, s.AgentID)
+}
+
+// teamView is a team with its members, as returned by the admin API
+type teamView struct {
+	Team
+	Members []User `json:"members"`
+}
+
+func teamMembers(teamID string) []User {
+	members := []User{}
+	for _, u := range StoreListUsers("") {
+		if u.TeamID == teamID {
+			members = append(members, u)
+		}
+	}
+	return members
+}
+
+// teamBody is the JSON accepted by the team endpoints
+type teamBody struct {
+	Name          string   `json:"name"`
+	MemberIDs     []string `json:"memberIds"`
+	SupervisorIDs []string `json:"supervisorIds"`
+}
+
+// validate checks members are active staff who can run sessions and that
+// supervisors are members; it returns the member list with supervisors added.
+func (b *teamBody) validate() ([]string, string) {
+	b.Name = strings.TrimSpace(b.Name)
+	if b.Name == "" {
+		return nil, "Team name required"
+	}
+	seen := make(map[string]bool)
+	var members []string
+	for _, id := range append(append([]string{}, b.MemberIDs...), b.SupervisorIDs...) {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		u := StoreGetUser(id)
+		if u == nil {
+			return nil, "Unknown user: " + id
+		}
+		if !RoleHasPermission(u.Role, PermSessionCreate) || u.Role == RoleAdmin {
+			return nil, "User cannot join a team: " + u.Email
+		}
+		members = append(members, id)
+	}
+	sup := make(map[string]bool)
+	var supervisors []string
+	for _, id := range b.SupervisorIDs {
+		if !sup[id] {
+			sup[id] = true
+			supervisors = append(supervisors, id)
+		}
+	}
+	b.SupervisorIDs = supervisors
+	return members, ""
+}
+
+func adminListTeams(w http.ResponseWriter, r *http.Request) {
+	list := []teamView{}
+	for _, t := range StoreListTeams() {
+		list = append(list, teamView{Team: t, Members: teamMembers(t.ID)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"teams": list})
+}
+
+func adminCreateTeam(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body teamBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	members, msg := body.validate()
+	if msg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+	now := time.Now()
+	t := &Team{Name: body.Name, SupervisorIDs: body.SupervisorIDs, CreatedAt: now, UpdatedAt: now}
+	StoreSaveTeam(t, members)
+	userID, role, _ := GetSessionUser(r)
+	StoreAppendGlobalAudit(string(role), userID, "team_create", map[string]interface{}{
+		"teamId": t.ID, "name": t.Name, "members": members, "supervisors": t.SupervisorIDs,
+	})
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(teamView{Team: *t, Members: teamMembers(t.ID)})
+}
+
+// adminTeam handles PUT and DELETE /teams/:id
+func adminTeam(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	teamID := firstSegment(r.URL.Path, "/teams/")
+	t := StoreGetTeam(teamID)
+	if t == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Team not found"})
+		return
+	}
+	userID, role, _ := GetSessionUser(r)
+	if r.Method == http.MethodDelete {
+		StoreDeleteTeam(teamID)
+		StoreAppendGlobalAudit(string(role), userID, "team_delete", map[string]interface{}{"teamId": teamID, "name": t.Name})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var body teamBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	members, msg := body.validate()
+	if msg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+	t.Name = body.Name
+	t.SupervisorIDs = body.SupervisorIDs
+	t.UpdatedAt = time.Now()
+	StoreSaveTeam(t, members)
+	StoreAppendGlobalAudit(string(role), userID, "team_update", map[string]interface{}{
+		"teamId": t.ID, "name": t.Name, "members": members, "supervisors": t.SupervisorIDs,
+	})
+	json.NewEncoder(w).Encode(teamView{Team: *t, Members: teamMembers(t.ID)})
+}
+
+// apiSessionReassign handles POST /api/session/reassign {sessionId, agentId}.
+// Supervisors may move their team's sessions to another member of the same
+// team; reviewers may do the same for any team.
+func apiSessionReassign(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID, role, _ := GetSessionUser(r)
+	var body struct {
+		SessionID string `json:"sessionId"`
+		AgentID   string `json:"agentId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON"})
+		return
+	}
+	s := StoreGetSession(strings.TrimSpace(body.SessionID))
+	if s == nil || !canActOnSession(r, userID, role, s) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Session not found"})
+		return
+	}
+	if !requestHasPermission(r, role, PermSessionReview) && !supervises(userID, s.AgentID) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Only a supervisor can reassign this session"})
+		return
+	}
+	owner := StoreGetUser(s.AgentID)
+	target := StoreGetUser(strings.TrimSpace(body.AgentID))
+	if owner == nil || owner.TeamID == "" || target == nil || target.TeamID != owner.TeamID {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Sessions can only be reassigned within the owner's team"})
+		return
+	}
+	if !target.Active || !RoleHasPermission(target.Role, PermSessionCreate) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Target user cannot run sessions"})
+		return
+	}
+	if target.ID == owner.ID {
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "agentId": target.ID})
+		return
+	}
+	StoreUpdateSession(s.ID, func(cs *CoBrowseSession) bool {
+		cs.AgentID = target.ID
+		if cs.AgentNameSnapshot != "" {
+			cs.AgentNameSnapshot = target.Email
+		}
+		return true
+	})
+	StoreAppendAudit(s.ID, string(role), userID, "session_reassign", map[string]interface{}{
+		"from": owner.ID, "to": target.ID, "teamId": owner.TeamID,
+	})
+	PublishSessionEvent(s.ID, EventSessionReassigned, map[string]interface{}{"from": owner.ID, "to": target.ID})
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "agentId": target.ID})
+}
+
+// teamSummary is one team's row on the admin dashboard
+type teamSummary struct {
+	TeamID         string `json:"teamId"`
+	Name           string `json:"name"`
+	Members        int    `json:"members"`
+	SessionsToday  int    `json:"sessionsToday"`
+	PendingReviews int    `json:"pendingReviews"`
+	LiveSessions   int    `json:"liveSessions"`
+}
+
+// summarizeTeams aggregates sessions per team; sessions of SRMs without a team
+// are not counted.
+func summarizeTeams(sessions []CoBrowseSession, todayStart time.Time) []teamSummary {
+	byTeam := make(map[string]*teamSummary)
+	var order []*teamSummary
+	for _, t := range StoreListTeams() {
+		ts := &teamSummary{TeamID: t.ID, Name: t.Name}
+		byTeam[t.ID] = ts
+		order = append(order, ts)
+	}
+	agentTeam := make(map[string]string)
+	for _, u := range StoreListUsers("") {
+		if ts := byTeam[u.TeamID]; ts != nil {
+			ts.Members++
+			agentTeam[u.ID] = u.TeamID
+		}
+	}
+	for _, s := range sessions {
+		ts := byTeam[agentTeam[s.AgentID]]
+		if ts == nil {
+			continue
+		}
+		if !s.CreatedAt.Before(todayStart) {
+			ts.SessionsToday++
+		}
+		switch s.Status {
+		case StatusSubmitted, StatusUnderReview, StatusNeedsInfo:
+			ts.PendingReviews++
+		case StatusConnected:
+			ts.LiveSessions++
+		}
+	}
+	list := []teamSummary{}
+	for _, ts := range order {
+		list = append(list, *ts)
+	}
+	return list
+}
@@ -0,0 +1,241 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Connection quality telemetry: both peers periodically send a getStats
+// summary over their signaling WebSocket as a "stats" message. Samples are
+// kept per StreamSession and summarized for the admin session detail and for
+// per-SRM / per-day reports.
+
+// StatsMessageType is the signaling message carrying a getStats summary
+const StatsMessageType = "stats"
+
+const (
+	statsMinInterval    = 2 * time.Second
+	maxStatsPerSession  = 2000
+	statsCandidateHost  = "host"
+	statsCandidateSrflx = "srflx"
+	statsCandidatePrflx = "prflx"
+	statsCandidateRelay = "relay"
+	statsPeerClient     = "client"
+	statsPeerViewer     = "viewer"
+)
+
+// ConnStatsSample is one getStats summary from one side of a StreamSession
+type ConnStatsSample struct {
+	SessionID       string    `json:"sessionId"`
+	StreamSessionID string    `json:"streamSessionId"`
+	Peer            string    `json:"peer"` // client | viewer
+	AgentID         string    `json:"agentId,omitempty"`
+	ViewerID        string    `json:"viewerId,omitempty"`
+	RTTMs           float64   `json:"rttMs"`
+	PacketLoss      float64   `json:"packetLoss"` // fraction 0..1
+	BitrateKbps     float64   `json:"bitrateKbps"`
+	FrameRate       float64   `json:"frameRate"`
+	CandidateType   string    `json:"candidateType,omitempty"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+// ConnStatsSummary aggregates samples for one StreamSession side, one SRM or one day
+type ConnStatsSummary struct {
+	Key             string         `json:"key,omitempty"`
+	StreamSessionID string         `json:"streamSessionId,omitempty"`
+	Peer            string         `json:"peer,omitempty"`
+	Sessions        int            `json:"sessions,omitempty"`
+	Samples         int            `json:"samples"`
+	AvgRTTMs        float64        `json:"avgRttMs"`
+	MaxRTTMs        float64        `json:"maxRttMs"`
+	AvgPacketLoss   float64        `json:"avgPacketLoss"`
+	MaxPacketLoss   float64        `json:"maxPacketLoss"`
+	AvgBitrateKbps  float64        `json:"avgBitrateKbps"`
+	AvgFrameRate    float64        `json:"avgFrameRate"`
+	CandidateTypes  map[string]int `json:"candidateTypes"`
+	FirstAt         time.Time      `json:"firstAt"`
+	LastAt          time.Time      `json:"lastAt"`
+}
+
+func (sum *ConnStatsSummary) add(x ConnStatsSample) {
+	if sum.Samples == 0 || x.CreatedAt.Before(sum.FirstAt) {
+		sum.FirstAt = x.CreatedAt
+	}
+	if x.CreatedAt.After(sum.LastAt) {
+		sum.LastAt = x.CreatedAt
+	}
+	n := float64(sum.Samples)
+	sum.AvgRTTMs = (sum.AvgRTTMs*n + x.RTTMs) / (n + 1)
+	sum.AvgPacketLoss = (sum.AvgPacketLoss*n + x.PacketLoss) / (n + 1)
+	sum.AvgBitrateKbps = (sum.AvgBitrateKbps*n + x.BitrateKbps) / (n + 1)
+	sum.AvgFrameRate = (sum.AvgFrameRate*n + x.FrameRate) / (n + 1)
+	if x.RTTMs > sum.MaxRTTMs {
+		sum.MaxRTTMs = x.RTTMs
+	}
+	if x.PacketLoss > sum.MaxPacketLoss {
+		sum.MaxPacketLoss = x.PacketLoss
+	}
+	if x.CandidateType != "" {
+		if sum.CandidateTypes == nil {
+			sum.CandidateTypes = make(map[string]int)
+		}
+		sum.CandidateTypes[x.CandidateType]++
+	}
+	sum.Samples++
+}
+
+// parseConnStats decodes and sanity-checks the Value of a stats message
+func parseConnStats(value string) (ConnStatsSample, bool) {
+	var in struct {
+		RTTMs         float64 `json:"rttMs"`
+		PacketLoss    float64 `json:"packetLoss"`
+		BitrateKbps   float64 `json:"bitrateKbps"`
+		FrameRate     float64 `json:"frameRate"`
+		CandidateType string  `json:"candidateType"`
+	}
+	if len(value) > 1024 || json.Unmarshal([]byte(value), &in) != nil {
+		return ConnStatsSample{}, false
+	}
+	if in.RTTMs < 0 || in.RTTMs > 60000 || in.PacketLoss < 0 || in.PacketLoss > 1 ||
+		in.BitrateKbps < 0 || in.BitrateKbps > 1e6 || in.FrameRate < 0 || in.FrameRate > 240 {
+		return ConnStatsSample{}, false
+	}
+	switch in.CandidateType {
+	case "", statsCandidateHost, statsCandidateSrflx, statsCandidatePrflx, statsCandidateRelay:
+	default:
+		in.CandidateType = ""
+	}
+	return ConnStatsSample{
+		RTTMs:         in.RTTMs,
+		PacketLoss:    in.PacketLoss,
+		BitrateKbps:   in.BitrateKbps,
+		FrameRate:     in.FrameRate,
+		CandidateType: in.CandidateType,
+	}, true
+}
+
+// recordConnStats stores a stats message from peer ("client" or "viewer") of
+// s. Samples arriving faster than statsMinInterval are dropped.
+func recordConnStats(s *StreamSession, peer string, msg WSMessage) {
+	x, ok := parseConnStats(msg.Value)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	last := &s.viewerStatsAt
+	if peer == statsPeerClient {
+		last = &s.clientStatsAt
+	}
+	if now.Sub(*last) < statsMinInterval {
+		return
+	}
+	*last = now
+	x.SessionID = s.RoomID
+	x.StreamSessionID = s.ID
+	x.Peer = peer
+	x.ViewerID = s.ViewerID
+	x.CreatedAt = now
+	if cs := StoreGetSession(s.RoomID); cs != nil {
+		x.AgentID = cs.AgentID
+	} else {
+		x.AgentID = s.ViewerID
+	}
+	StoreAppendConnStats(&x)
+}
+
+// summarizeConnStats groups samples per StreamSession and peer
+func summarizeConnStats(samples []ConnStatsSample) []ConnStatsSummary {
+	byKey := make(map[string]*ConnStatsSummary)
+	var keys []string
+	for _, x := range samples {
+		k := x.StreamSessionID + "|" + x.Peer
+		sum := byKey[k]
+		if sum == nil {
+			sum = &ConnStatsSummary{StreamSessionID: x.StreamSessionID, Peer: x.Peer}
+			byKey[k] = sum
+			keys = append(keys, k)
+		}
+		sum.add(x)
+	}
+	list := make([]ConnStatsSummary, 0, len(keys))
+	for _, k := range keys {
+		list = append(list, *byKey[k])
+	}
+	return list
+}
+
+// aggregateConnStats groups samples by SRM ("agent") or UTC day ("day")
+func aggregateConnStats(samples []ConnStatsSample, groupBy string) []ConnStatsSummary {
+	byKey := make(map[string]*ConnStatsSummary)
+	seen := make(map[string]map[string]bool)
+	for _, x := range samples {
+		k := x.AgentID
+		if groupBy == "day" {
+			k = x.CreatedAt.UTC().Format("2006-01-02")
+		}
+		sum := byKey[k]
+		if sum == nil {
+			sum = &ConnStatsSummary{Key: k}
+			byKey[k] = sum
+			seen[k] = make(map[string]bool)
+		}
+		sum.add(x)
+		if !seen[k][x.SessionID] {
+			seen[k][x.SessionID] = true
+			sum.Sessions++
+		}
+	}
+	list := make([]ConnStatsSummary, 0, len(byKey))
+	for _, sum := range byKey {
+		list = append(list, *sum)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// adminConnectionStats handles GET /connection-stats?groupBy=agent|day&from=&to=
+// (dates as YYYY-MM-DD, inclusive)
+func adminConnectionStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	q := r.URL.Query()
+	groupBy := strings.TrimSpace(q.Get("groupBy"))
+	if groupBy == "" {
+		groupBy = "day"
+	}
+	if groupBy != "day" && groupBy != "agent" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "groupBy must be agent or day"})
+		return
+	}
+	var from, to time.Time
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid from date"})
+			return
+		}
+		from = t
+	}
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid to date"})
+			return
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+	samples := StoreListConnStats(from, to)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"groupBy": groupBy,
+		"stats":   aggregateConnStats(samples, groupBy),
+	})
+}
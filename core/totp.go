@@ -0,0 +1,426 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP (RFC 6238) second factor: SHA-1, 6 digits, 30 second steps, accepting
+// one step of clock drift either way.
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1
+	totpIssuer        = "Orient Finance"
+	recoveryCodeCount = 10
+	mfaChallengeTTL   = 5 * time.Minute
+	mfaMaxAttempts    = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return totpEncoding.EncodeToString(b)
+}
+
+func totpCode(secret string, step int64) string {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return ""
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// verifyTOTP checks code against secret at now and returns the matched time
+// step. Steps at or before lastStep are rejected so a code works only once.
+func verifyTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	cur := now.Unix() / totpPeriod
+	for d := int64(-totpSkew); d <= totpSkew; d++ {
+		step := cur + d
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// otpauthURI is the provisioning URI authenticator apps read from a QR code
+func otpauthURI(email, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+email) + "?" + v.Encode()
+}
+
+// newRecoveryCodes returns plaintext codes to show once and their hashes to store
+func newRecoveryCodes() ([]string, []string) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		rand.Read(b)
+		c := strings.ToLower(hex.EncodeToString(b))
+		codes[i] = c[:5] + "-" + c[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), " ", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// role2FARequired reports whether GlobalSettings makes 2FA mandatory for role
+func role2FARequired(role Role) bool {
+	for _, r := range StoreGetGlobalSettings().Require2FARoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// needs2FAEnrollment reports whether the user must enroll before using the app
+func needs2FAEnrollment(userID string, role Role) bool {
+	if !role2FARequired(role) {
+		return false
+	}
+	u := StoreGetUser(userID)
+	return u != nil && !u.TOTPEnabled
+}
+
+// checkSecondFactor verifies a TOTP or recovery code for userID, consuming the
+// time step or recovery code on success. It returns "totp", "recovery" or "".
+func checkSecondFactor(userID, code string) string {
+	method := ""
+	now := time.Now()
+	StoreUpdateUser(userID, func(u *User) bool {
+		if !u.TOTPEnabled {
+			return false
+		}
+		if step, ok := verifyTOTP(u.TOTPSecret, code, u.TOTPLastStep, now); ok {
+			u.TOTPLastStep = step
+			method = "totp"
+			return true
+		}
+		h := hashRecoveryCode(code)
+		for i, rc := range u.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(rc), []byte(h)) == 1 {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+				method = "recovery"
+				return true
+			}
+		}
+		return false
+	})
+	return method
+}
+
+// mfaChallenge is the state between a correct password and the second factor.
+// It is kept in the broker so any instance can finish the login.
+type mfaChallenge struct {
+	UserID   string    `json:"userId"`
+	Expires  time.Time `json:"expires"`
+	Attempts int       `json:"attempts"`
+}
+
+func mfaKey(token string) string { return "laplace:mfa:" + token }
+
+func newMFAChallenge(userID string) string {
+	token := newSessionID()
+	c := mfaChallenge{UserID: userID, Expires: time.Now().Add(mfaChallengeTTL)}
+	if b, err := json.Marshal(c); err == nil {
+		getBroker().Set(mfaKey(token), b, mfaChallengeTTL)
+	}
+	return token
+}
+
+func getMFAChallenge(token string) *mfaChallenge {
+	if token == "" {
+		return nil
+	}
+	b, ok, err := getBroker().Get(mfaKey(token))
+	if err != nil || !ok {
+		return nil
+	}
+	c := &mfaChallenge{}
+	if json.Unmarshal(b, c) != nil || time.Now().After(c.Expires) {
+		return nil
+	}
+	return c
+}
+
+// apiLogin2FA handles POST /api/login/2fa (form: mfaToken, code), the second
+// step of a login for users with TOTP enabled
+func apiLogin2FA(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	token := strings.TrimSpace(r.FormValue("mfaToken"))
+	c := getMFAChallenge(token)
+	if c == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Login expired, sign in again"})
+		return
+	}
+	u := StoreGetUser(c.UserID)
+	if u == nil || !u.Active {
+		getBroker().Del(mfaKey(token))
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Account is disabled"})
+		return
+	}
+	ip := loginIP(r)
+	if wait, locked := loginWait(u.Email, ip); wait > 0 {
+		writeLoginThrottled(w, wait, locked)
+		return
+	}
+	method := checkSecondFactor(u.ID, r.FormValue("code"))
+	if method == "" {
+		c.Attempts++
+		recordLoginFailure(u.Email, ip, "Invalid 2FA code")
+		if c.Attempts >= mfaMaxAttempts {
+			getBroker().Del(mfaKey(token))
+		} else if b, err := json.Marshal(c); err == nil {
+			getBroker().Set(mfaKey(token), b, time.Until(c.Expires))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid code"})
+		return
+	}
+	getBroker().Del(mfaKey(token))
+	completeLogin(w, r, u, method)
+}
+
+// loginUser returns the logged-in user even while 2FA enrollment is pending
+func loginUser(r *http.Request) *User {
+	_, userID, _, ok := getSessionInfo(getSessionFromRequest(r))
+	if !ok {
+		return nil
+	}
+	return StoreGetUser(userID)
+}
+
+func write2FAError(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// api2FAStatus handles GET /api/2fa
+func api2FAStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	u := loginUser(r)
+	if u == nil {
+		write2FAError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":                u.TOTPEnabled,
+		"required":               role2FARequired(u.Role),
+		"recoveryCodesRemaining": len(u.RecoveryCodes),
+		"home":                   homePath(u.Role),
+	})
+}
+
+// api2FAEnroll handles POST /api/2fa/enroll: a new secret that becomes active
+// once a code from it is verified
+func api2FAEnroll(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	u := loginUser(r)
+	if u == nil {
+		write2FAError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if u.TOTPEnabled {
+		write2FAError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	secret := newTOTPSecret()
+	StoreUpdateUser(u.ID, func(x *User) bool {
+		x.TOTPSecret = secret
+		x.TOTPLastStep = 0
+		return true
+	})
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":     secret,
+		"otpauthUri": otpauthURI(u.Email, secret),
+	})
+}
+
+// api2FAVerify handles POST /api/2fa/verify {code}, enabling the enrolled
+// secret and returning recovery codes (shown only once)
+func api2FAVerify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	u := loginUser(r)
+	if u == nil {
+		write2FAError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		write2FAError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if u.TOTPEnabled {
+		write2FAError(w, http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if u.TOTPSecret == "" {
+		write2FAError(w, http.StatusBadRequest, "Start enrollment first")
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	ok := StoreUpdateUser(u.ID, func(x *User) bool {
+		step, ok := verifyTOTP(x.TOTPSecret, body.Code, x.TOTPLastStep, time.Now())
+		if !ok {
+			return false
+		}
+		x.TOTPEnabled = true
+		x.TOTPLastStep = step
+		x.RecoveryCodes = hashes
+		return true
+	})
+	if !ok {
+		write2FAError(w, http.StatusBadRequest, "Invalid code")
+		return
+	}
+	StoreAppendGlobalAudit(string(u.Role), u.ID, "2fa_enabled", nil)
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "recoveryCodes": codes, "redirect": homePath(u.Role)})
+}
+
+// api2FARecoveryCodes handles POST /api/2fa/recovery-codes {code}, replacing
+// all recovery codes
+func api2FARecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	u := loginUser(r)
+	if u == nil {
+		write2FAError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		write2FAError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if checkSecondFactor(u.ID, body.Code) == "" {
+		write2FAError(w, http.StatusBadRequest, "Invalid code")
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	StoreUpdateUser(u.ID, func(x *User) bool {
+		x.RecoveryCodes = hashes
+		return true
+	})
+	StoreAppendGlobalAudit(string(u.Role), u.ID, "2fa_recovery_codes_regenerated", nil)
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "recoveryCodes": codes})
+}
+
+// api2FADisable handles POST /api/2fa/disable {code}; refused when the
+// user's role requires 2FA
+func api2FADisable(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	u := loginUser(r)
+	if u == nil {
+		write2FAError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if role2FARequired(u.Role) {
+		write2FAError(w, http.StatusForbidden, "Two-factor authentication is required for your role")
+		return
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		write2FAError(w, http.StatusBadRequest, "Invalid JSON")
+		return
+	}
+	if checkSecondFactor(u.ID, body.Code) == "" {
+		write2FAError(w, http.StatusBadRequest, "Invalid code")
+		return
+	}
+	clearSecondFactor(u.ID)
+	StoreAppendGlobalAudit(string(u.Role), u.ID, "2fa_disabled", nil)
+	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
+
+func clearSecondFactor(userID string) bool {
+	return StoreUpdateUser(userID, func(u *User) bool {
+		u.TOTPEnabled = false
+		u.TOTPSecret = ""
+		u.TOTPLastStep = 0
+		u.RecoveryCodes = nil
+		return true
+	})
+}
+
+// adminReset2FA handles DELETE /users/:id/2fa: removes a user's second factor
+// so they can enroll again (for a lost device). Only admins may reset admins.
+func adminReset2FA(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	targetID := firstSegment(r.URL.Path, "/users/")
+	if !strings.HasSuffix(r.URL.Path, "/2fa") {
+		write2FAError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	target := StoreGetUser(targetID)
+	if target == nil {
+		write2FAError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	userID, role, _ := GetSessionUser(r)
+	if target.Role == RoleAdmin {
+		if role != RoleAdmin {
+			write2FAError(w, http.StatusForbidden, "Only an admin can reset an admin's second factor")
+			return
+		}
+	} else if msg := assignableRole(role, target.Role); msg != "" {
+		// As for password resets, a more privileged account is out of reach
+		write2FAError(w, http.StatusForbidden, msg)
+		return
+	}
+	clearSecondFactor(target.ID)
+	StoreAppendGlobalAudit(string(role), userID, "2fa_reset", map[string]interface{}{"userId": target.ID, "email": target.Email})
+	// Whoever holds the lost device may still be logged in
+	revokeLoginsFor(r, target.ID, "", "2fa_reset")
+	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
@@ -0,0 +1,212 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/turn/v2"
+)
+
+const (
+	defaultTurnRealm         = "orientfinance"
+	defaultTurnCredentialTTL = 60 // minutes
+	defaultStunURL           = "stun:stun1.l.google.com:19302"
+)
+
+// TurnConfig configures the optional embedded TURN/STUN server
+type TurnConfig struct {
+	ListenAddr string // UDP address, e.g. 0.0.0.0:3478
+	PublicIP   string // relay address advertised to peers
+	Realm      string
+	// Internal peer addresses the relay may still reach; see turnPeerAllowed
+	AllowedPeers []*net.IPNet
+}
+
+// turnBlockedPeers are the ranges a relay must not reach by default: anyone
+// holding credentials, which a session code is enough for, could otherwise
+// use the server to reach its own network or the cloud metadata service.
+var turnBlockedPeers = mustParseIPNets(
+	"0.0.0.0/8", "127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10",
+)
+
+func mustParseIPNets(cidrs ...string) []*net.IPNet {
+	nets, err := ParseIPNets(strings.Join(cidrs, ","))
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// turnPeerAllowed refuses loopback, private, link-local and unspecified peers
+// not listed in allowed. The relay's own address is always reachable, for two
+// peers relaying through this server.
+func turnPeerAllowed(peer, relayIP net.IP, allowed []*net.IPNet) bool {
+	if peer.Equal(relayIP) {
+		return true
+	}
+	for _, n := range allowed {
+		if n.Contains(peer) {
+			return true
+		}
+	}
+	for _, n := range turnBlockedPeers {
+		if n.Contains(peer) {
+			return false
+		}
+	}
+	return !peer.IsUnspecified() && !peer.IsLoopback() && !peer.IsLinkLocalUnicast() && !peer.IsMulticast()
+}
+
+// turnCredentials returns TURN REST API credentials (username "<expiry>:<id>",
+// password base64(HMAC-SHA1(secret, username))) valid for ttl.
+func turnCredentials(secret, id string, ttl time.Duration) (username, password string) {
+	username = strconv.FormatInt(time.Now().Add(ttl).Unix(), 10) + ":" + id
+	return username, turnPassword(secret, username)
+}
+
+func turnPassword(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// turnAuthHandler validates TURN REST credentials against the shared secret in
+// GlobalSettings at request time, so rotating the secret takes effect at once.
+func turnAuthHandler(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	secret := StoreGetGlobalSettings().TurnSecret
+	if secret == "" {
+		return nil, false
+	}
+	exp := username
+	if idx := strings.Index(username, ":"); idx >= 0 {
+		exp = username[:idx]
+	}
+	t, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > t {
+		return nil, false
+	}
+	return turn.GenerateAuthKey(username, realm, turnPassword(secret, username)), true
+}
+
+// StartTurnServer runs the embedded TURN server. A shared secret is generated
+// and stored in GlobalSettings when none is configured.
+func StartTurnServer(cfg TurnConfig) (*turn.Server, error) {
+	if cfg.Realm == "" {
+		cfg.Realm = defaultTurnRealm
+	}
+	relayIP := net.ParseIP(cfg.PublicIP)
+	if relayIP == nil {
+		return nil, fmt.Errorf("turn: public IP required, got %q", cfg.PublicIP)
+	}
+	gs := StoreGetGlobalSettings()
+	if gs.TurnSecret == "" {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		gs.TurnSecret = hex.EncodeToString(b)
+		StoreSetGlobalSettings(gs)
+	}
+	udp, err := net.ListenPacket("udp4", cfg.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := turn.NewServer(turn.ServerConfig{
+		Realm:       cfg.Realm,
+		AuthHandler: turnAuthHandler,
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: udp,
+			PermissionHandler: func(clientAddr net.Addr, peerIP net.IP) bool {
+				if turnPeerAllowed(peerIP, relayIP, cfg.AllowedPeers) {
+					return true
+				}
+				log.Printf("[turn] Refused relay from %s to internal address %s", clientAddr, peerIP)
+				return false
+			},
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+				RelayAddress: relayIP,
+				Address:      "0.0.0.0",
+			},
+		}},
+	})
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	log.Printf("[turn] Listening on udp %s, relay %s, realm %s", cfg.ListenAddr, relayIP, cfg.Realm)
+	return s, nil
+}
+
+// iceServer is one RTCIceServer entry as consumed by the browser
+type iceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// iceCredentialOwner identifies who is asking for ICE servers: a logged-in user
+// who may create or review sessions, or a client by a session code that is pending, live or
+// not yet ended.
+func iceCredentialOwner(r *http.Request) (string, bool) {
+	if userID, _, ok := RequestCan(r, PermSessionCreate, PermSessionReview); ok {
+		return userID, true
+	}
+	token := strings.TrimSpace(r.URL.Query().Get("token"))
+	if token == "" || !allowConnectAttempt(requestIP(r)) {
+		return "", false
+	}
+	if s := StoreGetSession(token); s != nil {
+		return token, s.Status != StatusEnded
+	}
+	if _, ok := defaultStore.Get(token); ok {
+		return token, true
+	}
+	return token, roomExists(token)
+}
+
+// apiIceServers handles GET /api/ice-servers
+func apiIceServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	owner, ok := iceCredentialOwner(r)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "login or valid session code required"})
+		return
+	}
+	gs := StoreGetGlobalSettings()
+	stun := gs.StunURLs
+	if len(stun) == 0 {
+		stun = []string{defaultStunURL}
+	}
+	servers := []iceServer{{URLs: stun}}
+	ttlMinutes := gs.TurnCredentialTTLMinutes
+	if ttlMinutes <= 0 {
+		ttlMinutes = defaultTurnCredentialTTL
+	}
+	ttl := time.Duration(ttlMinutes) * time.Minute
+	if len(gs.TurnURLs) > 0 && gs.TurnSecret != "" {
+		user, pass := turnCredentials(gs.TurnSecret, owner, ttl)
+		servers = append(servers, iceServer{URLs: gs.TurnURLs, Username: user, Credential: pass})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"iceServers": servers,
+		"ttl":        int(ttl.Seconds()),
+	})
+}
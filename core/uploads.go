@@ -0,0 +1,404 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ClientDocument is a file the client uploaded into their CoBrowseSession.
+// The bytes live in the blob store under Key; the session keeps the metadata.
+// Files the scanner flags are kept under quarantine/ and never served.
+type ClientDocument struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name"`
+	Doc           string    `json:"doc,omitempty"` // the checklist item it answers
+	ItemID        string    `json:"itemId,omitempty"`
+	ContentType   string    `json:"contentType"`
+	SizeBytes     int64     `json:"sizeBytes"`
+	SHA256        string    `json:"sha256"`
+	Key           string    `json:"-"`
+	UploadedAt    time.Time `json:"uploadedAt"`
+	UploaderIP    string    `json:"uploaderIp,omitempty"`
+	ScanStatus    string    `json:"scanStatus"` // clean | infected | unscanned
+	ScanSignature string    `json:"scanSignature,omitempty"`
+	Scanner       string    `json:"scanner,omitempty"`
+	Quarantined   bool      `json:"quarantined,omitempty"`
+}
+
+const (
+	defaultUploadMaxMB      = 10
+	maxUploadsPerSession    = 20
+	maxUploadNameLength     = 200
+	uploadMultipartHeadroom = 64 << 10
+)
+
+// uploadContentTypes are the accepted types, as sniffed from the content
+var uploadContentTypes = map[string]string{
+	"application/pdf": ".pdf",
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/webp":      ".webp",
+}
+
+func uploadMaxBytes() int64 {
+	if mb := StoreGetGlobalSettings().UploadMaxMB; mb > 0 {
+		return int64(mb) << 20
+	}
+	return defaultUploadMaxMB << 20
+}
+
+// uploadsOpen reports whether the client may add files to s: after consent,
+// while the session is live or more information was asked for
+func uploadsOpen(s *CoBrowseSession) bool {
+	if !s.ConsentGiven || s.ClientConnectedAt == nil {
+		return false
+	}
+	switch s.Status {
+	case StatusConnected, StatusSharing, StatusNeedsInfo:
+		return true
+	}
+	return false
+}
+
+// cleanUploadName keeps the base name of a client-supplied file name, without
+// control characters and at a sensible length
+func cleanUploadName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "." || name == "/" {
+		name = ""
+	}
+	if r := []rune(name); len(r) > maxUploadNameLength {
+		name = string(r[:maxUploadNameLength])
+	}
+	return strings.TrimSpace(name)
+}
+
+// uploadSession resolves the session code of a client upload request. Only
+// unknown codes count against the per-IP connect limit, so a client can keep
+// checking their own session, but a blocked IP gets no answers at all.
+func uploadSession(w http.ResponseWriter, r *http.Request) *CoBrowseSession {
+	token := strings.TrimSpace(r.URL.Query().Get("token"))
+	if token == "" {
+		token = strings.TrimSpace(r.URL.Query().Get("code"))
+	}
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "token required"})
+		return nil
+	}
+	ip := requestIP(r)
+	if connectBlocked(ip) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Too many attempts. Try again later."})
+		return nil
+	}
+	s := StoreGetSession(token)
+	if s == nil {
+		allowConnectAttempt(ip)
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Session not found"})
+		return nil
+	}
+	return s
+}
+
+// apiSessionUpload handles POST /api/session/upload?token=<code> with the
+// checklist item it answers as &item=<id> or &doc=<name>, and the file in the multipart field "file". Only PDF, PNG, JPEG and WebP
+// files up to UploadMaxMB are kept, judged by their content, not their name.
+func apiSessionUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	s := uploadSession(w, r)
+	if s == nil {
+		return
+	}
+	if !uploadsOpen(s) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Uploads are not open for this session"})
+		return
+	}
+	if len(s.Documents) >= maxUploadsPerSession {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("At most %d files per session", maxUploadsPerSession)})
+		return
+	}
+	sc := getScanner()
+	if sc == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "File uploads are not available"})
+		return
+	}
+	itemID := strings.TrimSpace(r.URL.Query().Get("item"))
+	doc := strings.TrimSpace(r.URL.Query().Get("doc"))
+	if itemID != "" || doc != "" {
+		it := checklistItem(s, itemID, doc)
+		if it == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unknown requested document"})
+			return
+		}
+		itemID, doc = it.ID, it.Name
+	}
+
+	max := uploadMaxBytes()
+	r.Body = http.MaxBytesReader(w, r.Body, max+uploadMultipartHeadroom)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "multipart/form-data with a file field required"})
+		return
+	}
+	var part io.Reader
+	var name string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		if p.FormName() == "file" {
+			part, name = p, cleanUploadName(p.FileName())
+			break
+		}
+	}
+	if part == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "file field required"})
+		return
+	}
+
+	tmp, err := ioutil.TempFile("", "laplace-upload-*")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Storage unavailable"})
+		return
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(part, max+1))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Upload interrupted or too large"})
+		return
+	}
+	if n > max {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Files may be at most %d MB", max>>20)})
+		return
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Empty file"})
+		return
+	}
+	head := make([]byte, 512)
+	hn, _ := tmp.ReadAt(head, 0)
+	contentType := strings.Split(http.DetectContentType(head[:hn]), ";")[0]
+	ext, ok := uploadContentTypes[contentType]
+	if !ok {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		json.NewEncoder(w).Encode(map[string]string{"error": "PDF, PNG, JPEG or WebP file required"})
+		return
+	}
+	id := GetRandomName(1)
+	if name == "" {
+		name = id + ext
+	}
+	d := ClientDocument{
+		ID:          id,
+		Name:        name,
+		Doc:         doc,
+		ItemID:      itemID,
+		ContentType: contentType,
+		SizeBytes:   n,
+		SHA256:      hex.EncodeToString(h.Sum(nil)),
+		Key:         fmt.Sprintf("sessions/%s/%s%s", s.ID, id, ext),
+		UploadedAt:  time.Now(),
+		UploaderIP:  loginIP(r),
+	}
+
+	// When the scanner fails, the upload fails. Only -scanner=none, a
+	// development opt-in, stores files unscanned.
+	d.Scanner = sc.Name()
+	var verdict ScanResult
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err == nil {
+		verdict, err = sc.Scan(tmp)
+	}
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Printf("[uploads] Scan failed for session %s: %v", s.ID, err)
+		StoreAppendAudit(s.ID, "system", "", "document_scan", map[string]interface{}{
+			"name": d.Name, "sha256": d.SHA256, "scanner": d.Scanner, "verdict": "error", "error": err.Error(),
+		})
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "The file could not be checked for viruses. Please try again."})
+		return
+	}
+	switch {
+	case verdict.Infected:
+		d.ScanStatus, d.ScanSignature, d.Quarantined = ScanInfected, verdict.Signature, true
+		d.Key = "quarantine/" + d.Key
+	case IsNoopScanner(sc):
+		d.ScanStatus = ScanUnscanned
+	default:
+		d.ScanStatus = ScanClean
+	}
+	store := getBlobStore()
+	if err := store.Put(d.Key, tmp, contentType); err != nil {
+		log.Printf("[uploads] Failed to store %s: %v", d.Key, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Storage unavailable"})
+		return
+	}
+	var itemFrom ChecklistState
+	saved := StoreUpdateSession(s.ID, func(cs *CoBrowseSession) bool {
+		if !uploadsOpen(cs) || len(cs.Documents) >= maxUploadsPerSession {
+			return false
+		}
+		cs.Documents = append(cs.Documents, d)
+		// A clean file answers its checklist item until staff review it
+		if it := checklistItem(cs, d.ItemID, ""); it != nil && d.ItemID != "" && !d.Quarantined {
+			it.DocumentIDs = append(it.DocumentIDs, d.ID)
+			if it.State == ChecklistRequested || it.State == ChecklistRejected {
+				itemFrom = it.State
+				it.State, it.Reason, it.UpdatedAt, it.UpdatedBy = ChecklistUploaded, "", time.Now(), ""
+			}
+		}
+		return true
+	})
+	if !saved {
+		_ = store.Delete(d.Key)
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Uploads are not open for this session"})
+		return
+	}
+	StoreAppendAudit(s.ID, "client", "", "document_upload", map[string]interface{}{
+		"documentId": d.ID, "name": d.Name, "doc": d.Doc, "contentType": d.ContentType,
+		"sizeBytes": d.SizeBytes, "sha256": d.SHA256, "ip": d.UploaderIP,
+	})
+	StoreAppendAudit(s.ID, "system", "", "document_scan", map[string]interface{}{
+		"documentId": d.ID, "sha256": d.SHA256, "scanner": d.Scanner, "verdict": d.ScanStatus,
+		"signature": d.ScanSignature, "quarantined": d.Quarantined,
+	})
+	if itemFrom != "" {
+		StoreAppendAudit(s.ID, "client", "", "checklist_update", map[string]interface{}{
+			"itemId": d.ItemID, "name": d.Doc, "action": "upload", "from": itemFrom, "to": ChecklistUploaded, "documentId": d.ID,
+		})
+	}
+	PublishSessionEvent(s.ID, EventDocumentUploaded, map[string]interface{}{
+		"documentId": d.ID, "name": d.Name, "doc": d.Doc, "quarantined": d.Quarantined,
+	})
+	if d.Quarantined {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":    "This file was flagged by our virus scanner and cannot be used. Please upload a different file.",
+			"document": d,
+		})
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
+
+// apiSessionUploads handles GET /api/session/uploads?token=<code>: the files
+// the client has uploaded so far and the document checklist
+func apiSessionUploads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	s := uploadSession(w, r)
+	if s == nil {
+		return
+	}
+	docs := s.Documents
+	if docs == nil {
+		docs = []ClientDocument{}
+	}
+	missing := checklistMissing(s, false)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"documents":     docs,
+		"requestedDocs": s.RequestedDocs,
+		"checklist":     clientChecklist(s),
+		"missing":       missing,
+		"status":        s.Status,
+		"open":          uploadsOpen(s),
+		"canSubmit":     uploadsOpen(s) && len(missing) == 0,
+		"maxBytes":      uploadMaxBytes(),
+	})
+}
+
+// adminUploads handles GET /uploads/:sessionId (list) and
+// GET /uploads/:sessionId/:documentId (download)
+func adminUploads(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/uploads/"), "/"), "/")
+	s := StoreGetSession(parts[0])
+	if parts[0] == "" || s == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Session not found"})
+		return
+	}
+	if len(parts) == 1 {
+		docs := s.Documents
+		if docs == nil {
+			docs = []ClientDocument{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(docs)
+		return
+	}
+	var d *ClientDocument
+	for i := range s.Documents {
+		if s.Documents[i].ID == parts[1] {
+			d = &s.Documents[i]
+		}
+	}
+	if d == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Document not found"})
+		return
+	}
+	if d.Quarantined {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Document is quarantined"})
+		return
+	}
+	body, err := getBlobStore().Get(d.Key)
+	if err != nil {
+		log.Printf("[uploads] Failed to read %s: %v", d.Key, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Document not available"})
+		return
+	}
+	defer body.Close()
+	userID, role, _ := GetSessionUser(r)
+	StoreAppendAudit(s.ID, string(role), userID, "document_download", map[string]interface{}{"documentId": d.ID, "name": d.Name})
+	w.Header().Set("Content-Type", d.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", d.Name))
+	w.Header().Set("Content-Length", fmt.Sprint(d.SizeBytes))
+	w.Header().Set("X-Content-SHA256", d.SHA256)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.Copy(w, body)
+}
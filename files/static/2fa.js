@@ -0,0 +1,96 @@
+"use strict";
+
+(function () {
+  const $ = (id) => document.getElementById(id);
+  let action = null; // what the code form submits to
+  let home = "/srm";
+
+  function show(id, on) { $(id).style.display = on ? "" : "none"; }
+
+  function showError(msg) {
+    $("tfaError").textContent = msg || "";
+    show("tfaError", !!msg);
+  }
+
+  async function post(url, body) {
+    const res = await fetch(url, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(body || {}),
+      credentials: "include",
+    });
+    const data = await res.json().catch(() => ({}));
+    if (!res.ok) throw new Error(data?.error || "Request failed");
+    return data;
+  }
+
+  function showCodes(codes) {
+    $("tfaCodeList").textContent = codes.join("\n");
+    $("tfaContinue").href = home;
+    show("tfaCodes", true);
+    show("tfaForm", false);
+    show("tfaEnroll", false);
+    show("tfaManage", false);
+  }
+
+  function askCode(label, fn) {
+    action = fn;
+    $("btnTfa").textContent = label;
+    $("tfaCode").value = "";
+    show("tfaForm", true);
+    $("tfaCode").focus();
+  }
+
+  async function enroll() {
+    const d = await post("/api/2fa/enroll");
+    $("tfaSecret").textContent = d.secret;
+    $("tfaQr").innerHTML = "";
+    if (typeof QRCode !== "undefined") new QRCode($("tfaQr"), { text: d.otpauthUri, width: 180, height: 180 });
+    show("tfaEnroll", true);
+    askCode("Verify", async (code) => {
+      const r = await post("/api/2fa/verify", { code });
+      home = r.redirect || home;
+      $("tfaStatus").textContent = "Two-factor authentication is on.";
+      showCodes(r.recoveryCodes || []);
+    });
+  }
+
+  async function load() {
+    const res = await fetch("/api/2fa", { credentials: "include" });
+    if (res.status === 401) { window.location.replace("/srm/login"); return; }
+    const d = await res.json();
+    home = d.home || home;
+    if (!d.enabled) {
+      $("tfaStatus").textContent = d.required
+        ? "Your role requires two-factor authentication. Set it up to continue."
+        : "Protect your account with a code from an authenticator app.";
+      await enroll();
+      return;
+    }
+    $("tfaStatus").textContent = "Two-factor authentication is on. " + d.recoveryCodesRemaining + " recovery codes left.";
+    show("tfaManage", true);
+    show("btnTfaDisable", !d.required);
+  }
+
+  $("tfaForm").addEventListener("submit", async (e) => {
+    e.preventDefault();
+    showError("");
+    const code = ($("tfaCode").value || "").trim();
+    if (!code || !action) return;
+    try { await action(code); } catch (err) { showError(err.message); }
+  });
+
+  $("btnTfaRegen").addEventListener("click", () => askCode("Create new codes", async (code) => {
+    const r = await post("/api/2fa/recovery-codes", { code });
+    showCodes(r.recoveryCodes || []);
+  }));
+
+  $("btnTfaDisable").addEventListener("click", () => askCode("Turn off", async (code) => {
+    await post("/api/2fa/disable", { code });
+    show("tfaForm", false);
+    show("tfaManage", false);
+    $("tfaStatus").textContent = "Two-factor authentication is off.";
+  }));
+
+  load().catch((err) => showError(err.message));
+})();
@@ -17,7 +17,15 @@
     try {
       const r = await fetch("/api/auth-check", { credentials: "include" });
       const d = await r.json().catch(() => ({}));
-      if (r.ok && d?.authed === true && d?.role === "admin") {
+      if (r.ok && d?.authed === true && d?.passwordChangeRequired === true) {
+        window.location.replace("/password");
+        return true;
+      }
+      if (r.ok && d?.authed === true && d?.mfaEnrollRequired === true) {
+        window.location.replace("/2fa");
+        return true;
+      }
+      if (r.ok && d?.authed === true && d?.home === "/admin") {
         window.location.replace("/admin");
         return true;
       }
@@ -39,9 +47,40 @@
     }
   }
 
+  // Set when the password was accepted and a TOTP or recovery code is needed
+  let mfaToken = "";
+
+  async function submitCode() {
+    const code = (document.getElementById("loginCode").value || "").trim();
+    if (!code) {
+      showError("Please enter your authentication code.");
+      return;
+    }
+    const params = new URLSearchParams();
+    params.append("mfaToken", mfaToken);
+    params.append("code", code);
+    const res = await fetch("/api/login/2fa", {
+      method: "POST",
+      headers: { "Content-Type": "application/x-www-form-urlencoded" },
+      body: params.toString(),
+      credentials: "include",
+    });
+    const data = await res.json().catch(() => ({}));
+    if (!res.ok) {
+      showError(data?.error || "Invalid code.");
+      if (res.status === 401 && /expired/i.test(data?.error || "")) mfaToken = "";
+      return;
+    }
+    window.location.replace(data?.redirect || "/admin");
+  }
+
   form.addEventListener("submit", async (e) => {
     e.preventDefault();
     hideError();
+    if (mfaToken) {
+      try { await submitCode(); } catch (err) { showError("Connection failed. Please try again."); }
+      return;
+    }
     const email = (document.getElementById("loginEmail").value || "").trim();
     const password = (document.getElementById("loginPassword").value || "").trim();
     if (!email || !password) {
@@ -64,6 +103,12 @@
         showError(data?.error || "Invalid email or password.");
         return;
       }
+      if (data?.mfaRequired) {
+        mfaToken = data.mfaToken;
+        document.getElementById("mfaField").style.display = "";
+        document.getElementById("loginCode").focus();
+        return;
+      }
       window.location.replace(data?.redirect || "/admin");
     } catch (err) {
       showError("Connection failed. Please try again.");
@@ -81,5 +126,23 @@
     toggleBtn.setAttribute("aria-label", isHidden ? "Hide password" : "Show password");
   });
 
+  // Offer single sign-on when configured; hide the password form if it is the only way in
+  async function setupSSO() {
+    const ssoError = new URLSearchParams(window.location.search).get("sso_error");
+    if (ssoError) showError(ssoError);
+    try {
+      const r = await fetch("/api/oidc", { credentials: "include" });
+      const d = await r.json().catch(() => ({}));
+      if (!d?.enabled) return;
+      const sso = document.getElementById("btnSSO");
+      if (sso) {
+        sso.textContent = d.label || "Sign in with SSO";
+        sso.style.display = "block";
+      }
+      if (d.passwordLogin === false) form.style.display = "none";
+    } catch (e) {}
+  }
+
+  setupSSO();
   checkAuthAndRedirect();
 })();
@@ -84,7 +84,7 @@ async function renderAgents() {
         <form id="createAgentForm" class="mb-3">
           <div class="form-row">
             <div class="col"><input type="email" class="form-control" id="newAgentEmail" placeholder="Email" required></div>
-            <div class="col"><input type="password" class="form-control" id="newAgentPass" placeholder="Password" minlength="6"></div>
+            <div class="col"><input type="password" class="form-control" id="newAgentPass" placeholder="Temporary password" required></div>
             <div class="col-auto"><button type="submit" class="btn btn-dark">Create SRM</button></div>
           </div>
         </form>
@@ -100,6 +100,7 @@ async function renderAgents() {
         <td>
           <button class="btn btn-outline-dark btn-sm" onclick="adminToggleAgent('${a.id}', ${!a.active})">${a.active ? "Disable" : "Enable"}</button>
           <button class="btn btn-outline-dark btn-sm ml-1" onclick="adminResetPass('${a.id}')">Reset password</button>
+          <button class="btn btn-outline-dark btn-sm ml-1" onclick="adminSignOut('${a.id}')">Sign out</button>
         </td>
       </tr>`;
     });
@@ -109,9 +110,10 @@ async function renderAgents() {
       e.preventDefault();
       const email = document.getElementById("newAgentEmail").value.trim();
       const pass = document.getElementById("newAgentPass").value;
-      if (!email || pass.length < 6) { (window.showToast || alert)("Email and password (6+ chars) required", "error"); return; }
+      if (!email || !pass) { (window.showToast || alert)("Email and password required", "error"); return; }
       try {
-        await api("/srms", { method: "POST", headers: { "Content-Type": "application/json" }, body: JSON.stringify({ email, password: pass }) });
+        const d = await api("/srms", { method: "POST", headers: { "Content-Type": "application/json" }, body: JSON.stringify({ email, password: pass }) });
+        if (d.error) throw new Error(d.error);
         route();
       } catch (x) { (window.showToast || alert)(x.message, "error"); }
     });
@@ -137,14 +139,24 @@ window.adminToggleAgent = async (id, active) => {
 };
 
 window.adminResetPass = async (id) => {
-  const pass = prompt("New password (min 6 chars):");
-  if (!pass || pass.length < 6) return;
+  const pass = prompt("Temporary password (the user must change it at next login):");
+  if (!pass) return;
   try {
-    await api("/srms/" + id, { method: "PUT", headers: { "Content-Type": "application/json" }, body: JSON.stringify({ password: pass }) });
+    const d = await api("/srms/" + id, { method: "PUT", headers: { "Content-Type": "application/json" }, body: JSON.stringify({ password: pass }) });
+    if (d.error) throw new Error(d.error);
     (window.showToast || alert)("Password updated", "success");
   } catch (x) { alert(x.message); }
 };
 
+window.adminSignOut = async (id) => {
+  if (!confirm("Sign this user out on every device?")) return;
+  try {
+    const d = await api("/users/" + id + "/logins", { method: "DELETE" });
+    if (d.error) throw new Error(d.error);
+    (window.showToast || alert)("Signed out", "success");
+  } catch (x) { alert(x.message); }
+};
+
 async function renderSettings() {
   const el = document.getElementById("adminContent");
   try {
@@ -182,11 +194,11 @@ async function renderDocuments() {
   try {
     const d = await api("/documents");
     const docs = d.documents || [];
-    let html = `<div class="card-component"><h4>Document Templates</h4><form id="addDocForm" class="mb-3"><div class="form-row"><div class="col"><input type="text" class="form-control" id="docTitle" placeholder="Title" required></div><div class="col"><input type="text" class="form-control" id="docUrl" placeholder="URL"></div><div class="col-auto"><label><input type="checkbox" id="docRequired"> Required</label></div><div class="col-auto"><button type="submit" class="btn btn-dark">Add</button></div></div></form><table class="data-table admin-table"><thead><tr><th>Title</th><th>URL</th><th>Required</th><th></th></tr></thead><tbody>`;
+    let html = `<div class="card-component"><h4>Document Templates</h4><form id="addDocForm" class="mb-3"><div class="form-row"><div class="col"><input type="text" class="form-control" id="docTitle" placeholder="Title" required></div><div class="col"><input type="text" class="form-control" id="docUrl" placeholder="URL"></div><div class="col-auto"><label><input type="checkbox" id="docRequired"> Required</label></div><div class="col-auto"><button type="submit" class="btn btn-dark">Add</button></div></div></form><table class="data-table admin-table"><thead><tr><th>Title</th><th>URL</th><th>Required</th><th>Version</th><th></th></tr></thead><tbody>`;
     docs.forEach(doc => {
-      html += `<tr><td>${escapeHtml(doc.title)}</td><td><code>${escapeHtml(doc.url)}</code></td><td>${doc.required ? "Yes" : "No"}</td><td><button class="btn btn-outline-dark btn-sm" onclick="adminDelDoc('${doc.id}')">Delete</button></td></tr>`;
+      html += `<tr><td>${escapeHtml(doc.title)}</td><td><code>${escapeHtml(doc.url)}</code></td><td>${doc.required ? "Yes" : "No"}</td><td>v${doc.version}</td><td><button class="btn btn-outline-dark btn-sm" onclick="adminDocHistory('${doc.id}')">History</button> <button class="btn btn-outline-dark btn-sm" onclick="adminDelDoc('${doc.id}')">Delete</button></td></tr>`;
     });
-    html += "</tbody></table></div>";
+    html += `</tbody></table></div><div id="docHistory"></div>`;
     el.innerHTML = html;
     document.getElementById("addDocForm")?.addEventListener("submit", async (e) => {
       e.preventDefault();
@@ -210,6 +222,57 @@ window.adminTerminateSession = async (id) => {
   } catch (x) { alert(x.message); }
 };
 
+window.adminDocHistory = async (id) => {
+  const el = document.getElementById("docHistory");
+  if (!el) return;
+  try {
+    const d = await api("/documents/" + encodeURIComponent(id) + "/versions");
+    const versions = (d.versions || []).slice().reverse();
+    const latest = versions.length ? versions[0].version : 0;
+    let html = `<div class="card-component"><h4>History: ${escapeHtml((d.current || versions[0] || {}).title || id)}</h4><table class="data-table admin-table"><thead><tr><th>Version</th><th>Saved</th><th>By</th><th>Changes from previous</th><th></th></tr></thead><tbody>`;
+    for (const v of versions) {
+      let changes = "-";
+      if (v.version > 1) {
+        const diff = await api("/documents/" + encodeURIComponent(id) + "/diff?from=" + (v.version - 1) + "&to=" + v.version);
+        changes = (diff.changes || []).map(c => `${c.field}: ${JSON.stringify(c.from)} → ${JSON.stringify(c.to)}`).join("; ") || "no changes";
+      }
+      if (v.rolledBackFrom) changes = `restored v${v.rolledBackFrom}; ` + changes;
+      const restore = v.version === latest && d.current ? "" : `<button class="btn btn-outline-dark btn-sm" onclick="adminDocRollback('${escapeHtml(id)}', ${v.version})">Restore</button>`;
+      html += `<tr><td>v${v.version}</td><td>${escapeHtml(v.updatedAt ? new Date(v.updatedAt).toLocaleString() : "-")}</td><td>${escapeHtml(v.updatedByEmail || v.updatedBy || "-")}</td><td>${escapeHtml(changes)}</td><td>${restore}</td></tr>`;
+    }
+    html += "</tbody></table></div>";
+    el.innerHTML = html;
+  } catch (x) { (window.showToast || alert)(x.message, "error"); }
+};
+
+window.adminDocRollback = async (id, version) => {
+  if (!confirm("Restore version " + version + "? It will be saved as a new version.")) return;
+  try {
+    await api("/documents/" + encodeURIComponent(id) + "/rollback", { method: "POST", headers: { "Content-Type": "application/json" }, body: JSON.stringify({ version }) });
+    await renderDocuments();
+    adminDocHistory(id);
+  } catch (x) { (window.showToast || alert)(x.message, "error"); }
+};
+
+async function checklistAction(sessionId, body) {
+  try {
+    const res = await fetch("/api/session/checklist?sessionId=" + encodeURIComponent(sessionId), { method: "POST", credentials: "include", headers: { "Content-Type": "application/json" }, body: JSON.stringify(body) });
+    const data = await res.json().catch(() => ({}));
+    if (!res.ok) throw new Error(data.error || "Request failed");
+    renderReview("/admin/review/" + sessionId);
+  } catch (x) { (window.showToast || alert)(x.message, "error"); }
+}
+
+window.adminChecklist = async (sessionId, itemId, action) => {
+  let reason = "";
+  if (action === "reject" || action === "waive") {
+    reason = prompt(action === "reject" ? "Why is this document rejected? The client will see this." : "Reason for waiving (optional)");
+    if (reason === null) return;
+    if (action === "reject" && !reason.trim()) return;
+  }
+  await checklistAction(sessionId, { itemId, action, reason });
+};
+
 window.adminDelDoc = async (id) => {
   if (!confirm("Delete this document?")) return;
   try {
@@ -336,7 +399,44 @@ async function renderReview(path) {
   try {
     const d = await api("/sessions/" + sessionId);
     const s = (d.session || {});
-    el.innerHTML = `
+    const docs = s.documents || [];
+    const actionsFor = { requested: ["waive"], uploaded: ["accept", "reject", "waive", "request"], accepted: ["reject", "request"], rejected: ["waive", "request"], waived: ["request"] };
+    const labels = { accept: "Accept", reject: "Reject", waive: "Waive", request: "Request again" };
+    let docsHtml = `<div class="card-component"><h4>Document checklist</h4>`;
+    const checklist = s.checklist || [];
+    if (checklist.length === 0) {
+      docsHtml += `<p class="text-muted">No documents on the checklist.</p>`;
+    } else {
+      docsHtml += `<table class="data-table admin-table"><thead><tr><th>Document</th><th>Required</th><th>State</th><th>Reason</th><th></th></tr></thead><tbody>`;
+      checklist.forEach(it => {
+        const buttons = (actionsFor[it.state] || []).map(a => `<button class="btn btn-outline-dark btn-sm" onclick="adminChecklist('${escapeHtml(sessionId)}', '${escapeHtml(it.id)}', '${a}')">${labels[a]}</button>`).join(" ");
+        docsHtml += `<tr><td>${escapeHtml(it.name)}</td><td>${it.required ? "Yes" : "No"}</td><td>${escapeHtml(it.state)}</td><td>${escapeHtml(it.reason || "")}</td><td>${buttons}</td></tr>`;
+      });
+      docsHtml += "</tbody></table>";
+    }
+    docsHtml += `<form id="checklistAddForm" class="form-inline mt-2"><input type="text" class="form-control form-control-sm mr-2" id="checklistAddName" placeholder="Request another document" required><button type="submit" class="btn btn-dark btn-sm">Request</button></form></div>`;
+    docsHtml += `<div class="card-component"><h4>Client documents</h4>`;
+    if (docs.length === 0) {
+      docsHtml += `<p class="text-muted">No documents uploaded.</p>`;
+    } else {
+      docsHtml += `<table class="data-table admin-table"><thead><tr><th>File</th><th>For</th><th>Size</th><th>Uploaded</th><th>Scan</th><th></th></tr></thead><tbody>`;
+      docs.forEach(doc => {
+        const href = "/api/admin/uploads/" + encodeURIComponent(sessionId) + "/" + encodeURIComponent(doc.id);
+        const action = doc.quarantined
+          ? `<span class="badge badge-pending" title="${escapeHtml(doc.scanSignature || "")}">Quarantined</span>`
+          : `<a href="${href}" class="btn btn-outline-dark btn-sm">Download</a>`;
+        docsHtml += `<tr><td>${escapeHtml(doc.name)}</td><td>${escapeHtml(doc.doc || "-")}</td><td>${Math.ceil((doc.sizeBytes || 0) / 1024)} KB</td><td>${escapeHtml(doc.uploadedAt ? new Date(doc.uploadedAt).toLocaleString() : "-")}</td><td>${escapeHtml(doc.scanStatus || "-")}</td><td>${action}</td></tr>`;
+      });
+      docsHtml += "</tbody></table>";
+    }
+    const templates = d.documentTemplates || [];
+    if (templates.length) {
+      docsHtml += `<p class="mt-3 mb-1"><strong>Templates given to the client</strong></p><ul>`;
+      templates.forEach(t => { docsHtml += `<li>${escapeHtml(t.title)} (v${t.version})${t.url ? ` — <code>${escapeHtml(t.url)}</code>` : ""}</li>`; });
+      docsHtml += "</ul>";
+    }
+    docsHtml += "</div>";
+    el.innerHTML = docsHtml + `
       <div class="card-component">
         <h4>Review Session ${escapeHtml(sessionId)}</h4>
         <form id="reviewForm">
@@ -346,12 +446,20 @@ async function renderReview(path) {
         </form>
       </div>
     `;
+    document.getElementById("checklistAddForm")?.addEventListener("submit", async (e) => {
+      e.preventDefault();
+      await checklistAction(sessionId, { action: "add", name: document.getElementById("checklistAddName").value });
+    });
     document.getElementById("reviewForm")?.addEventListener("submit", async (e) => {
       e.preventDefault();
       const status = e.target.status.value;
       const notes = e.target.notes.value;
       try {
-        await api("/review/" + sessionId, { method: "POST", headers: { "Content-Type": "application/json" }, body: JSON.stringify({ status, notes }) });
+        const res = await api("/review/" + sessionId, { method: "POST", headers: { "Content-Type": "application/json" }, body: JSON.stringify({ status, notes }) });
+        if (res.error) {
+          (window.showToast || alert)(res.error + (res.missing ? ": " + res.missing.join(", ") : ""), "error");
+          return;
+        }
         (window.showToast || alert)("Review submitted", "success");
         window.location.href = "/admin/sessions";
       } catch (x) { (window.showToast || alert)(x.message, "error"); }
@@ -362,9 +470,54 @@ async function renderReview(path) {
   const _loading = document.getElementById("adminLoading"); if (_loading) _loading.style.display = "none";
 }
 
+// Live updates: /api/events pushes session changes to the dashboard, the
+// sessions list and the open session; polling takes over while the stream is
+// down or unsupported.
+const LIVE_EVENT_TYPES = ["session_created", "client_connected", "client_disconnected", "consent", "review", "session_terminated", "session_reassigned", "document_uploaded", "checklist_updated", "submitted"];
+const LIVE_POLL_MS = 30000;
+let livePoll = null;
+let liveRefresh = null;
+
+function scheduleLiveRefresh(e) {
+  const path = window.location.pathname;
+  let refresh = null;
+  if (path === "/admin" || path === "/admin/") refresh = renderDashboard;
+  else if (path.startsWith("/admin/sessions/")) {
+    const sessionId = path.slice("/admin/sessions/".length).split("/")[0];
+    let ev = null;
+    try { ev = e && e.data ? JSON.parse(e.data) : null; } catch (_) {}
+    if (!ev || ev.sessionId === sessionId) refresh = () => renderSessions(path);
+  } else if (path.startsWith("/admin/sessions")) refresh = () => renderSessions(path);
+  if (!refresh) return;
+  clearTimeout(liveRefresh);
+  liveRefresh = setTimeout(refresh, 300);
+}
+
+function startLivePoll() {
+  if (!livePoll) livePoll = setInterval(scheduleLiveRefresh, LIVE_POLL_MS);
+}
+
+function stopLivePoll() {
+  clearInterval(livePoll);
+  livePoll = null;
+}
+
+function startLiveUpdates() {
+  if (!window.EventSource) return startLivePoll();
+  const source = new EventSource("/api/events", { withCredentials: true });
+  LIVE_EVENT_TYPES.forEach(t => source.addEventListener(t, scheduleLiveRefresh));
+  source.onopen = () => {
+    // Catch up on anything missed while the stream was down
+    if (livePoll) scheduleLiveRefresh();
+    stopLivePoll();
+  };
+  source.onerror = startLivePoll;
+}
+
 window.addEventListener("popstate", route);
 window.addEventListener("load", function() {
   route();
+  startLiveUpdates();
   var t = document.getElementById("sidebarToggle"), s = document.getElementById("sidebar"), o = document.getElementById("sidebarOverlay");
   function toggle() { s.classList.toggle("open"); if (o) o.classList.toggle("open"); }
   if (t) t.addEventListener("click", toggle);
@@ -17,6 +17,14 @@
         showError("Server misconfigured: /api/auth-check returned 404. Rebuild and restart the server.");
         return false;
       }
+      if (r.ok && d?.authed === true && d?.passwordChangeRequired === true) {
+        window.location.replace("/password");
+        return true;
+      }
+      if (r.ok && d?.authed === true && d?.mfaEnrollRequired === true) {
+        window.location.replace("/2fa");
+        return true;
+      }
       if (r.ok && (d?.authed === true || d?.authed === "true")) {
         console.log("[agent-login] redirect from=" + pathname + " to=" + targetAgent + " authed=true");
         window.location.replace(targetAgent);
@@ -49,9 +57,40 @@
     document.getElementById("btnRetryLogin")?.setAttribute("style", "display:none");
   }
 
+  // Set when the password was accepted and a TOTP or recovery code is needed
+  let mfaToken = "";
+
+  async function submitCode() {
+    const code = (document.getElementById("loginCode").value || "").trim();
+    if (!code) {
+      showError("Please enter your authentication code.");
+      return;
+    }
+    const params = new URLSearchParams();
+    params.append("mfaToken", mfaToken);
+    params.append("code", code);
+    const res = await fetch("/api/login/2fa", {
+      method: "POST",
+      headers: { "Content-Type": "application/x-www-form-urlencoded" },
+      body: params.toString(),
+      credentials: "include",
+    });
+    const data = await res.json().catch(() => ({}));
+    if (!res.ok) {
+      showError(data?.error || "Invalid code.");
+      if (res.status === 401 && /expired/i.test(data?.error || "")) mfaToken = "";
+      return;
+    }
+    window.location.replace(data?.redirect || "/srm");
+  }
+
   form.addEventListener("submit", async (e) => {
     e.preventDefault();
     hideError();
+    if (mfaToken) {
+      try { await submitCode(); } catch (err) { showError("Connection failed. Please try again."); }
+      return;
+    }
 
     const email = (document.getElementById("loginEmail").value || "").trim();
     const password = (document.getElementById("loginPassword").value || "").trim();
@@ -84,6 +123,12 @@
         showError(data?.error || "Invalid email or password.");
         return;
       }
+      if (data?.mfaRequired) {
+        mfaToken = data.mfaToken;
+        document.getElementById("mfaField").style.display = "";
+        document.getElementById("loginCode").focus();
+        return;
+      }
 
       window.location.replace(data?.redirect || "/srm");
     } catch (err) {
@@ -106,5 +151,23 @@
     btn.setAttribute("title", isHidden ? "Hide password" : "Show password");
   });
 
+  // Offer single sign-on when configured; hide the password form if it is the only way in
+  async function setupSSO() {
+    const ssoError = new URLSearchParams(window.location.search).get("sso_error");
+    if (ssoError) showError(ssoError);
+    try {
+      const r = await fetch("/api/oidc", { credentials: "include" });
+      const d = await r.json().catch(() => ({}));
+      if (!d?.enabled) return;
+      const sso = document.getElementById("btnSSO");
+      if (sso) {
+        sso.textContent = d.label || "Sign in with SSO";
+        sso.style.display = "block";
+      }
+      if (d.passwordLogin === false) form.style.display = "none";
+    } catch (e) {}
+  }
+
+  setupSSO();
   checkAuthAndRedirect();
 })();
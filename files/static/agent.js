@@ -111,10 +111,17 @@
     });
   }
 
-  async function renderSessions() {
+  // openChecklistId is the session whose documents are shown under the list,
+  // so a live refresh can show them again
+  let openChecklistId = "";
+
+  async function renderSessions(quiet) {
     const el = document.getElementById("srmContent");
     if (!el) return;
-    el.innerHTML = `<div class="card-component"><p>Loading…</p></div>`;
+    if (!quiet) {
+      openChecklistId = "";
+      el.innerHTML = `<div class="card-component"><p>Loading…</p></div>`;
+    }
     try {
       const res = await fetch(getBaseUrl() + "/api/session/list", { credentials: "include" });
       const d = await res.json().catch(() => ({}));
@@ -123,21 +130,75 @@
       if (sessions.length === 0) {
         html += `<p class="text-muted">No sessions yet. Create a session from the dashboard.</p>`;
       } else {
-        html += `<table class="data-table admin-table"><thead><tr><th>Code</th><th>Status</th><th>Created</th><th></th></tr></thead><tbody>`;
+        html += `<table class="data-table admin-table"><thead><tr><th>Code</th><th>Status</th><th>Documents</th><th>Created</th><th></th></tr></thead><tbody>`;
         sessions.forEach(s => {
           const id = s.id || s.token;
           const badgeClass = s.status === "SHARING" || s.status === "CONNECTED" ? "badge-active" : s.status === "ENDED" ? "badge-ended" : "badge-pending";
-          html += `<tr><td><code>${escapeHtml(s.token || id)}</code></td><td><span class="badge ${badgeClass}">${escapeHtml(s.status)}</span></td><td>${escapeHtml((s.createdAt || "").slice(0, 19))}</td><td><a href="/viewer/${escapeHtml(id)}" class="btn btn-outline-dark btn-sm" target="_blank">Open Viewer</a></td></tr>`;
+          const items = s.checklist || [];
+          const done = items.filter(it => it.state === "accepted" || it.state === "waived").length;
+          const docs = `<button class="btn btn-outline-dark btn-sm" data-checklist="${escapeHtml(id)}">${items.length ? `${done}/${items.length}` : "Request"}</button>`;
+          html += `<tr><td><code>${escapeHtml(s.token || id)}</code></td><td><span class="badge ${badgeClass}">${escapeHtml(s.status)}</span></td><td>${docs}</td><td>${escapeHtml((s.createdAt || "").slice(0, 19))}</td><td><a href="/viewer/${escapeHtml(id)}" class="btn btn-outline-dark btn-sm" target="_blank">Open Viewer</a></td></tr>`;
         });
         html += "</tbody></table>";
       }
-      html += "</div>";
+      html += `</div><div id="srmChecklist"></div>`;
       el.innerHTML = html;
+      el.querySelectorAll("[data-checklist]").forEach(b => {
+        b.addEventListener("click", () => renderChecklist(sessions.find(s => (s.id || s.token) === b.getAttribute("data-checklist"))));
+      });
+      if (openChecklistId) renderChecklist(sessions.find(s => (s.id || s.token) === openChecklistId));
     } catch (e) {
+      if (quiet) return;
       el.innerHTML = `<div class="card-component"><p class="text-danger">Failed to load: ${e.message}</p></div>`;
     }
   }
 
+  // Document checklist of one session, with the SRM's review actions
+  function renderChecklist(s) {
+    const el = document.getElementById("srmChecklist");
+    if (!el || !s) return;
+    const id = s.id || s.token;
+    openChecklistId = id;
+    const actionsFor = { requested: ["waive"], uploaded: ["accept", "reject", "waive", "request"], accepted: ["reject", "request"], rejected: ["waive", "request"], waived: ["request"] };
+    const labels = { accept: "Accept", reject: "Reject", waive: "Waive", request: "Request again" };
+    let html = `<div class="card-component"><h4>Documents for ${escapeHtml(s.token || id)}</h4><table class="data-table admin-table"><thead><tr><th>Document</th><th>Required</th><th>State</th><th>Reason</th><th></th></tr></thead><tbody>`;
+    (s.checklist || []).forEach(it => {
+      const buttons = (actionsFor[it.state] || []).map(a => `<button class="btn btn-outline-dark btn-sm" data-item="${escapeHtml(it.id)}" data-action="${a}">${labels[a]}</button>`).join(" ");
+      html += `<tr><td>${escapeHtml(it.name)}</td><td>${it.required ? "Yes" : "No"}</td><td>${escapeHtml(it.state)}</td><td>${escapeHtml(it.reason || "")}</td><td>${buttons}</td></tr>`;
+    });
+    html += `</tbody></table><form id="srmChecklistAdd" class="mt-2"><input type="text" name="name" class="form-control" placeholder="Document to request, e.g. Payslip" maxlength="200" required> <label><input type="checkbox" name="required" checked> Required</label> <button type="submit" class="btn btn-dark btn-sm">Request document</button></form></div>`;
+    el.innerHTML = html;
+    const send = async (body) => {
+      const res = await fetch(getBaseUrl() + "/api/session/checklist?sessionId=" + encodeURIComponent(id), {
+        method: "POST", credentials: "include", headers: { "Content-Type": "application/json" },
+        body: JSON.stringify(body),
+      });
+      const d = await res.json().catch(() => ({}));
+      if (!res.ok) { (window.showToast || alert)(d.error || "Failed", "error"); return; }
+      s.checklist = s.checklist || [];
+      const item = s.checklist.find(it => it.id === d.id);
+      if (item) Object.assign(item, d);
+      else s.checklist.push(d);
+      renderChecklist(s);
+    };
+    el.querySelectorAll("[data-action]").forEach(b => {
+      b.addEventListener("click", () => {
+        const action = b.getAttribute("data-action");
+        let reason = "";
+        if (action === "reject" || action === "waive") {
+          reason = prompt(action === "reject" ? "Why is this document rejected? The client will see this." : "Reason for waiving (optional)");
+          if (reason === null || (action === "reject" && !reason.trim())) return;
+        }
+        send({ itemId: b.getAttribute("data-item"), action, reason });
+      });
+    });
+    document.getElementById("srmChecklistAdd").addEventListener("submit", (e) => {
+      e.preventDefault();
+      const f = e.target;
+      send({ action: "add", name: f.elements["name"].value.trim(), required: f.elements["required"].checked });
+    });
+  }
+
   async function renderProfile() {
     const el = document.getElementById("srmContent");
     if (!el) return;
@@ -156,9 +217,52 @@
     `;
   }
 
+  // Live updates: /api/events pushes changes to the SRM's sessions, and
+  // polling takes over while the stream is down or unsupported.
+  const LIVE_EVENT_TYPES = ["session_created", "client_connected", "client_disconnected", "consent", "review", "session_terminated", "session_reassigned", "document_uploaded", "checklist_updated", "submitted"];
+  const LIVE_POLL_MS = 30000;
+  let livePoll = null;
+  let liveRefresh = null;
+
+  function scheduleLiveRefresh() {
+    if (!window.location.pathname.startsWith("/srm/sessions")) return;
+    clearTimeout(liveRefresh);
+    liveRefresh = setTimeout(() => {
+      // Don't wipe a document name the SRM is typing; try again shortly
+      const active = document.activeElement;
+      if (active && active.tagName === "INPUT" && document.getElementById("srmContent")?.contains(active)) {
+        liveRefresh = setTimeout(scheduleLiveRefresh, 2000);
+        return;
+      }
+      renderSessions(true);
+    }, 300);
+  }
+
+  function startLivePoll() {
+    if (!livePoll) livePoll = setInterval(scheduleLiveRefresh, LIVE_POLL_MS);
+  }
+
+  function stopLivePoll() {
+    clearInterval(livePoll);
+    livePoll = null;
+  }
+
+  function startLiveUpdates() {
+    if (!window.EventSource) return startLivePoll();
+    const source = new EventSource(getBaseUrl() + "/api/events", { withCredentials: true });
+    LIVE_EVENT_TYPES.forEach(t => source.addEventListener(t, scheduleLiveRefresh));
+    source.onopen = () => {
+      // Catch up on anything missed while the stream was down
+      if (livePoll) scheduleLiveRefresh();
+      stopLivePoll();
+    };
+    source.onerror = startLivePoll;
+  }
+
   window.addEventListener("popstate", route);
   window.addEventListener("load", function() {
     route();
+    startLiveUpdates();
     const t = document.getElementById("srmSidebarToggle");
     const s = document.getElementById("srmSidebar");
     const o = document.getElementById("srmSidebarOverlay");
@@ -2,8 +2,8 @@
  * Orient Finance Co-Browse — Brand & WebRTC Configuration
  * BASE_URL / CUSTOMER_APP_BASE_URL: Base URL for client links. Leave empty to use current origin.
  * CONNECT_PATH: Path for connect page (default /connect)
- * STUN_URLS: Array of STUN server URLs (default: Google STUN)
- * TURN_URLS, TURN_USER, TURN_PASS: Optional TURN config for NAT traversal
+ * STUN_URLS: Array of STUN server URLs used until /api/ice-servers responds (default: Google STUN)
+ * TURN servers and their time-limited credentials come from /api/ice-servers (admin settings).
  */
 window.OrientFinanceConfig = {
   BRAND_NAME: "Orient Finance Broker",
@@ -14,7 +14,4 @@ window.OrientFinanceConfig = {
   CUSTOMER_APP_BASE_URL: "",
   CONNECT_PATH: "/connect",
   STUN_URLS: ["stun:stun1.l.google.com:19302", "stun:stun2.l.google.com:19302"],
-  TURN_URLS: [],
-  TURN_USER: "",
-  TURN_PASS: "",
 };
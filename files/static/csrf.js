@@ -0,0 +1,35 @@
+"use strict";
+
+// Adds the login's CSRF token (from /api/auth-check) to every same-origin
+// POST, PUT, PATCH and DELETE made with fetch. Load before other scripts.
+(function () {
+  const origFetch = window.fetch.bind(window);
+  let pending = null;
+
+  function token() {
+    if (!pending) {
+      pending = origFetch("/api/auth-check", { credentials: "include" })
+        .then((res) => res.json())
+        .then((d) => d.csrfToken || "")
+        .catch(() => "");
+      // A missing token is fetched again next time, e.g. after signing in
+      pending.then((t) => { if (!t) pending = null; });
+    }
+    return pending;
+  }
+
+  window.fetch = async function (input, init) {
+    init = init || {};
+    const method = (init.method || (input instanceof Request ? input.method : "GET")).toUpperCase();
+    const url = new URL(input instanceof Request ? input.url : String(input), window.location.href);
+    if (!["GET", "HEAD", "OPTIONS"].includes(method) && url.origin === window.location.origin) {
+      const t = await token();
+      if (t) {
+        const headers = new Headers(init.headers || (input instanceof Request ? input.headers : undefined));
+        headers.set("X-CSRF-Token", t);
+        init = Object.assign({}, init, { headers });
+      }
+    }
+    return origFetch(input, init);
+  };
+})();
@@ -5,18 +5,29 @@ function getIceConfig() {
   const servers = [];
   const stunUrls = cfg.STUN_URLS || ["stun:stun1.l.google.com:19302", "stun:stun2.l.google.com:19302"];
   servers.push({ urls: stunUrls });
-  if (cfg.TURN_URLS && cfg.TURN_URLS.length) {
-    servers.push({
-      urls: cfg.TURN_URLS,
-      username: cfg.TURN_USER || "",
-      credential: cfg.TURN_PASS || "",
-    });
-  }
   return { iceServers: servers, iceCandidatePoolSize: 10 };
 }
 
 const iceConfig = getIceConfig();
 
+/**
+ * Replace the static STUN list with servers from /api/ice-servers, which adds
+ * time-limited TURN credentials for the logged-in SRM or the session code.
+ */
+async function loadServerIceServers() {
+  const params = new URLSearchParams(window.location.search);
+  const token = params.get("token") || params.get("claim") || params.get("room") || params.get("id") || "";
+  try {
+    const res = await fetch("/api/ice-servers" + (token ? "?token=" + encodeURIComponent(token) : ""), { credentials: "same-origin" });
+    if (!res.ok) return;
+    const data = await res.json();
+    if (!data.iceServers || !data.iceServers.length) return;
+    [iceConfig, rtpPeerConnectionOptions.stunGoogle, DEFAULT_PC_OPTION].forEach((c) => {
+      c.iceServers = data.iceServers;
+    });
+  } catch (_) {}
+}
+
 const displayMediaOptions = {
   noConstraint: { video: true, audio: true },
   v720p30: { video: { height: 720, frameRate: 30 }, audio: true },
@@ -77,12 +88,34 @@ function hideErrorPanel() {
   if (panel) panel.style.display = "none";
 }
 
-function showClientToast(msg) {
+// showClientToast shows msg for 5s, or with actions (buttons of { label,
+// onClick }) until one is pressed or timeoutMs passes, then calls onTimeout
+function showClientToast(msg, actions, timeoutMs, onTimeout) {
   const el = document.getElementById("client-toast");
   if (!el) return;
+  clearTimeout(LaplaceVar.toastTimer);
   el.textContent = msg;
+  const hide = () => {
+    clearTimeout(LaplaceVar.toastTimer);
+    el.classList.remove("visible");
+  };
+  (actions || []).forEach((a) => {
+    const btn = document.createElement("button");
+    btn.type = "button";
+    btn.className = a.primary ? "btn btn-light btn-sm" : "btn btn-outline-light btn-sm";
+    btn.textContent = a.label;
+    btn.onclick = () => {
+      hide();
+      a.onClick();
+    };
+    el.appendChild(btn);
+  });
+  el.classList.toggle("with-actions", !!(actions && actions.length));
   el.classList.add("visible");
-  setTimeout(() => el.classList.remove("visible"), 5000);
+  LaplaceVar.toastTimer = setTimeout(() => {
+    el.classList.remove("visible");
+    if (onTimeout) onTimeout();
+  }, actions && actions.length ? timeoutMs || 5000 : 5000);
 }
 
 function avg(arr) {
@@ -164,6 +197,13 @@ function initUI() {
   LaplaceVar.ui.streamCompatMsg = document.getElementById("stream-compat-msg");
   LaplaceVar.ui.streamDebugInfo = document.getElementById("stream-debug-info");
   LaplaceVar.ui.streamConnectedMsg = document.getElementById("streamConnectedMsg");
+  LaplaceVar.ui.streamUploads = document.getElementById("stream-uploads");
+  LaplaceVar.ui.streamUploadDoc = document.getElementById("streamUploadDoc");
+  LaplaceVar.ui.streamUploadFile = document.getElementById("streamUploadFile");
+  LaplaceVar.ui.btnStreamUpload = document.getElementById("btnStreamUpload");
+  LaplaceVar.ui.streamUploadsList = document.getElementById("streamUploadsList");
+  LaplaceVar.ui.streamSubmitHint = document.getElementById("streamSubmitHint");
+  LaplaceVar.ui.btnStreamSubmit = document.getElementById("btnStreamSubmit");
   LaplaceVar.ui.video = document.getElementById("mainVideo");
   LaplaceVar.ui.videoContainer = document.getElementById("video-container");
 
@@ -206,10 +246,7 @@ function initUI() {
     };
 
     try {
-      let res = await fetch(apiUrl, { method: "POST" }).catch((e) => null);
-      if (!res) {
-        res = await fetch(apiUrl, { method: "GET" }).catch((e) => null);
-      }
+      const res = await fetch(apiUrl, { method: "POST" }).catch((e) => null);
       if (!res) {
         handleError("Cannot reach server. Is it running? Check console for details.", new Error("fetch failed"), true);
         return;
@@ -282,6 +319,8 @@ function initUI() {
 
   LaplaceVar.ui.btnStartShareSimple?.addEventListener("click", () => startStreamSimple());
   LaplaceVar.ui.btnStopShare?.addEventListener("click", leaveRoom);
+  LaplaceVar.ui.btnStreamUpload?.addEventListener("click", handleClientUpload);
+  LaplaceVar.ui.btnStreamSubmit?.addEventListener("click", handleClientSubmit);
   document.getElementById("btnNeedHelp")?.addEventListener("click", () => {
     document.getElementById("stream-help-sheet")?.classList.add("open");
   });
@@ -355,6 +394,7 @@ async function newRoom(rID) {
 async function newSessionStream(sessionID, pcOption) {
   print("[+] New session: " + sessionID);
   LaplaceVar.pcs[sessionID] = new RTCPeerConnection(pcOption);
+  startStatsReporting(LaplaceVar.pcs[sessionID], sessionID);
   LaplaceVar.pcs[sessionID].onicecandidate = (e) => {
     if (!e.candidate) return;
     LaplaceVar.socket.send(JSON.stringify({ Type: "addCallerIceCandidate", SessionID: sessionID, Value: JSON.stringify(e.candidate) }));
@@ -386,12 +426,7 @@ async function newSessionStream(sessionID, pcOption) {
   });
   LaplaceVar.dataChannels[sessionID].addEventListener("message", (e) => {
     if (e.data.startsWith("ping")) LaplaceVar.dataChannels[sessionID].send("pong" + e.data.slice(4));
-    else if (e.data.startsWith("assistant:")) {
-      try {
-        const cmd = JSON.parse(e.data.slice(10));
-        if (cmd.type === "requestClick" && cmd.message) showClientToast(cmd.message);
-      } catch (_) {}
-    } else if (e.data.startsWith("pong")) {
+    else if (e.data.startsWith("pong")) {
       const then = parseInt(e.data.slice(4), 10);
       if (!isNaN(then)) {
         LaplaceVar.pingHistories[sessionID].push(Date.now() - then);
@@ -399,11 +434,6 @@ async function newSessionStream(sessionID, pcOption) {
         LaplaceVar.pings[sessionID] = avg(LaplaceVar.pingHistories[sessionID]);
         updateStatusUIStream();
       }
-    } else if (e.data.startsWith("assistant:")) {
-      try {
-        const cmd = JSON.parse(e.data.slice(10));
-        if (cmd.type === "requestClick" && cmd.message) showClientToast(cmd.message);
-      } catch (_) {}
     }
   });
 
@@ -414,6 +444,80 @@ async function newSessionStream(sessionID, pcOption) {
   LaplaceVar.socket.send(JSON.stringify({ Type: "gotOffer", SessionID: sessionID, Value: JSON.stringify(offer) }));
 }
 
+// Connection telemetry
+
+const STATS_INTERVAL_MS = 10000;
+
+// Summarize getStats for the server: RTT, video packet loss, bitrate, frame rate
+// and the selected local candidate type. prev carries counters between calls.
+async function summarizeStats(pc, prev) {
+  const report = await pc.getStats();
+  let pair = null;
+  report.forEach((s) => {
+    if (s.type === "transport" && s.selectedCandidatePairId) pair = report.get(s.selectedCandidatePairId);
+  });
+  if (!pair) {
+    report.forEach((s) => {
+      if (s.type === "candidate-pair" && s.nominated && s.state === "succeeded") pair = s;
+    });
+  }
+  let rtt = 0;
+  let candidateType = "";
+  if (pair) {
+    rtt = (pair.currentRoundTripTime || 0) * 1000;
+    const local = report.get(pair.localCandidateId);
+    if (local) candidateType = local.candidateType || "";
+  }
+  let bytes = 0;
+  let packets = 0;
+  let lost = 0;
+  let fps = 0;
+  report.forEach((s) => {
+    if (s.kind !== "video") return;
+    if (s.type === "outbound-rtp") {
+      bytes += s.bytesSent || 0;
+      packets += s.packetsSent || 0;
+      fps = s.framesPerSecond || fps;
+    } else if (s.type === "inbound-rtp") {
+      bytes += s.bytesReceived || 0;
+      packets += s.packetsReceived || 0;
+      lost += s.packetsLost || 0;
+      fps = s.framesPerSecond || fps;
+    } else if (s.type === "remote-inbound-rtp") {
+      lost += s.packetsLost || 0;
+    }
+  });
+  const now = Date.now();
+  const out = { rttMs: Math.round(rtt), packetLoss: 0, bitrateKbps: 0, frameRate: fps, candidateType };
+  if (prev.at) {
+    const dt = (now - prev.at) / 1000;
+    const dp = packets - prev.packets;
+    const dl = lost - prev.lost;
+    out.bitrateKbps = Math.max(0, Math.round(((bytes - prev.bytes) * 8) / dt / 1000));
+    out.packetLoss = dp + dl > 0 ? Math.max(0, Math.min(1, dl / (dp + dl))) : 0;
+  }
+  Object.assign(prev, { at: now, bytes, packets, lost });
+  return out;
+}
+
+// Post a stats summary for pc over the signaling socket every STATS_INTERVAL_MS
+function startStatsReporting(pc, sessionID) {
+  const prev = {};
+  const timer = setInterval(async () => {
+    if (pc.signalingState === "closed" || !LaplaceVar.socket || LaplaceVar.socket.readyState !== WebSocket.OPEN) {
+      clearInterval(timer);
+      return;
+    }
+    if (pc.iceConnectionState !== "connected" && pc.iceConnectionState !== "completed") return;
+    try {
+      const stats = await summarizeStats(pc, prev);
+      LaplaceVar.socket.send(JSON.stringify({ Type: "stats", SessionID: sessionID, Value: JSON.stringify(stats) }));
+    } catch (err) {
+      clearInterval(timer);
+    }
+  }, STATS_INTERVAL_MS);
+}
+
 async function addCalleeIceCandidate(sessionID, v) {
   return LaplaceVar.pcs[sessionID].addIceCandidate(v);
 }
@@ -463,6 +567,8 @@ const DEFAULT_PC_OPTION = (() => {
   return { iceServers: c.iceServers, iceCandidatePoolSize: 10 };
 })();
 
+loadServerIceServers();
+
 function supportsDisplayMedia() {
   return !!(navigator.mediaDevices && navigator.mediaDevices.getDisplayMedia);
 }
@@ -512,6 +618,123 @@ async function handleConsentContinue() {
   startStreamSimple();
 }
 
+// Client document uploads, bound to the session code
+async function refreshClientUploads() {
+  const token = LaplaceVar.claimToken;
+  const box = LaplaceVar.ui.streamUploads;
+  if (!token || !box) return;
+  let data;
+  try {
+    const res = await fetch(getBaseUrl() + "/api/session/uploads?token=" + encodeURIComponent(token));
+    if (!res.ok) return;
+    data = await res.json();
+  } catch (_) {
+    return;
+  }
+  const checklist = data.checklist || [];
+  box.style.display = data.open || data.documents.length || checklist.length ? "block" : "none";
+  // Items still to upload come first in the picker
+  const outstanding = checklist.filter((it) => it.state === "requested" || it.state === "rejected");
+  const select = LaplaceVar.ui.streamUploadDoc;
+  if (select) {
+    select.innerHTML = "";
+    outstanding.concat(checklist.filter((it) => it.state === "uploaded")).forEach((it) => {
+      const opt = document.createElement("option");
+      opt.value = it.id;
+      opt.textContent = it.name + (it.required ? "" : " (optional)");
+      select.appendChild(opt);
+    });
+    const other = document.createElement("option");
+    other.value = "";
+    other.textContent = "Other document";
+    select.appendChild(other);
+    select.style.display = checklist.length ? "block" : "none";
+  }
+  if (LaplaceVar.ui.btnStreamUpload) LaplaceVar.ui.btnStreamUpload.disabled = !data.open;
+  const stateLabels = { requested: "needed", uploaded: "received", accepted: "accepted", rejected: "please upload again", waived: "not needed" };
+  const list = LaplaceVar.ui.streamUploadsList;
+  if (list) {
+    list.innerHTML = "";
+    checklist.forEach((it) => {
+      const li = document.createElement("li");
+      li.textContent = it.name + (it.required ? "" : " (optional)") + ": " + (stateLabels[it.state] || it.state) + (it.reason ? " — " + it.reason : "");
+      list.appendChild(li);
+    });
+    data.documents.filter((d) => !d.itemId).forEach((d) => {
+      const li = document.createElement("li");
+      li.textContent = d.name + (d.quarantined ? ": rejected by virus scan" : ": received");
+      list.appendChild(li);
+    });
+    data.documents.filter((d) => d.itemId && d.quarantined).forEach((d) => {
+      const li = document.createElement("li");
+      li.textContent = d.name + ": rejected by virus scan";
+      list.appendChild(li);
+    });
+  }
+  const hint = LaplaceVar.ui.streamSubmitHint;
+  const submit = LaplaceVar.ui.btnStreamSubmit;
+  if (submit) {
+    submit.style.display = data.open ? "block" : "none";
+    submit.disabled = !data.canSubmit;
+  }
+  if (hint) {
+    const missing = data.missing || [];
+    hint.textContent = data.status === "SUBMITTED" ? "Your application has been submitted." : missing.length ? "Still needed before you can submit: " + missing.join(", ") : "";
+    hint.style.display = hint.textContent ? "block" : "none";
+  }
+  LaplaceVar.uploadMaxBytes = data.maxBytes;
+}
+
+async function handleClientUpload() {
+  const token = LaplaceVar.claimToken;
+  const input = LaplaceVar.ui.streamUploadFile;
+  const btn = LaplaceVar.ui.btnStreamUpload;
+  const file = input?.files?.[0];
+  if (!token || !file) {
+    showClientToast("Choose a file to upload.");
+    return;
+  }
+  if (LaplaceVar.uploadMaxBytes && file.size > LaplaceVar.uploadMaxBytes) {
+    showClientToast("That file is too large.");
+    return;
+  }
+  const item = LaplaceVar.ui.streamUploadDoc?.value || "";
+  const form = new FormData();
+  form.append("file", file);
+  let url = getBaseUrl() + "/api/session/upload?token=" + encodeURIComponent(token);
+  if (item) url += "&item=" + encodeURIComponent(item);
+  if (btn) { btn.disabled = true; btn.textContent = "Uploading…"; }
+  try {
+    const res = await fetch(url, { method: "POST", body: form });
+    const data = await res.json().catch(() => ({}));
+    if (!res.ok) {
+      showClientToast(data.error || "Upload failed. Please try again.");
+    } else {
+      showClientToast("Uploaded " + data.name);
+      input.value = "";
+    }
+  } catch (_) {
+    showClientToast("Connection failed. Please try again.");
+  }
+  if (btn) { btn.disabled = false; btn.textContent = "Upload"; }
+  refreshClientUploads();
+}
+
+async function handleClientSubmit() {
+  const token = LaplaceVar.claimToken;
+  const btn = LaplaceVar.ui.btnStreamSubmit;
+  if (!token) return;
+  if (btn) btn.disabled = true;
+  try {
+    const res = await fetch(getBaseUrl() + "/api/session/submit?token=" + encodeURIComponent(token), { method: "POST" });
+    const data = await res.json().catch(() => ({}));
+    showClientToast(res.ok ? "Application submitted." : data.error || "Could not submit. Please try again.");
+  } catch (_) {
+    showClientToast("Connection failed. Please try again.");
+  }
+  refreshClientUploads();
+}
+
 async function startStreamSimple() {
   const btn = LaplaceVar.ui.btnStartShareSimple;
   const compatMsg = LaplaceVar.ui.streamCompatMsg;
@@ -559,6 +782,9 @@ async function startStreamSimple() {
   LaplaceVar.ui.streamSimpleUI.style.display = "flex";
   LaplaceVar.ui.videoContainer.style.display = "block";
   showClientToast("Connected. Your SRM can now see your screen.");
+  refreshClientUploads();
+  // Pick up checklist changes made by the SRM or reviewer
+  if (!LaplaceVar.uploadsTimer) LaplaceVar.uploadsTimer = setInterval(refreshClientUploads, 15000);
 
   LaplaceVar.mediaStream = mediaStream;
   await startStream(displayMediaOption, pcOption);
@@ -606,6 +832,8 @@ async function startStream(displayMediaOption, pcOption) {
       else if (jsonData.Type === "newSession") await newSessionStream(jsonData.SessionID, pcOption);
       else if (jsonData.Type === "addCalleeIceCandidate") await addCalleeIceCandidate(jsonData.SessionID, JSON.parse(jsonData.Value));
       else if (jsonData.Type === "gotAnswer") await gotAnswer(jsonData.SessionID, JSON.parse(jsonData.Value));
+      else if (jsonData.Type === "pointer" || jsonData.Type === "highlight") showGuidance(jsonData.Type, JSON.parse(jsonData.Value));
+      else if (jsonData.Type === "requestClick") showClickRequest(jsonData.SessionID, JSON.parse(jsonData.Value));
     } catch (err) {
       console.error(err);
     }
@@ -620,6 +848,7 @@ async function startStream(displayMediaOption, pcOption) {
 async function newSessionJoin(sID) {
   LaplaceVar.sessionID = sID;
   LaplaceVar.pc = new RTCPeerConnection(iceConfig);
+  startStatsReporting(LaplaceVar.pc, sID);
   LaplaceVar.pc.onicecandidate = (e) => {
     if (!e.candidate) return;
     LaplaceVar.socket.send(JSON.stringify({ Type: "addCalleeIceCandidate", SessionID: LaplaceVar.sessionID, Value: JSON.stringify(e.candidate) }));
@@ -752,6 +981,7 @@ function tryConnectAgent(roomID) {
       else if (jsonData.Type === "roomNotFound") {
         showWaitingForClient(roomID);
       } else if (jsonData.Type === "roomClosed") alert("Room closed");
+      else handleGuidanceReply(jsonData);
     } catch (err) {
       console.error(err);
     }
@@ -784,6 +1014,7 @@ async function doJoin(roomID) {
       else if (jsonData.Type === "roomNotFound") {
         showWaitingForClient(LaplaceVar.roomID);
       } else if (jsonData.Type === "roomClosed") alert("Room closed");
+      else handleGuidanceReply(jsonData);
     } catch (err) {
       console.error(err);
     }
@@ -803,15 +1034,18 @@ function leaveRoom() {
   window.location.href = getBaseUrl() + "/srm";
 }
 
-function initAgentOverlay() {
-  const wrapper = document.getElementById("video-wrapper");
-  const video = document.getElementById("mainVideo");
-  const canvas = document.getElementById("agent-overlay");
-  const tools = document.getElementById("agent-tools");
-  const btnRequest = document.getElementById("btnRequestClick");
-  const btnHighlight = document.getElementById("btnHighlight");
-  if (!wrapper || !canvas || !LaplaceVar.dataChannel) return;
-  if (tools) tools.style.display = "flex";
+const GUIDANCE_POINTER_INTERVAL_MS = 50;
+const CLICK_REQUEST_TIMEOUT_MS = 30000;
+
+// createOverlay draws a pointer and fading highlight boxes on canvas over
+// video. Coordinates are normalized to 0..1 so viewer and client agree
+// whatever size each renders the stream at.
+function createOverlay(canvas, video) {
+  const ctx = canvas.getContext("2d");
+  const highlights = [];
+  const HIGHLIGHT_FADE_MS = 5000;
+  let pointer = null;
+  let laser = false;
 
   const resizeCanvas = () => {
     if (!video || !video.parentElement) return;
@@ -821,36 +1055,27 @@ function initAgentOverlay() {
       canvas.width = w;
       canvas.height = h;
     }
+    draw();
   };
 
-  video.addEventListener("loadedmetadata", resizeCanvas);
-  window.addEventListener("resize", resizeCanvas);
-  resizeCanvas();
-
-  let laserOn = false;
-  let highlightMode = false;
-  let highlightStart = null;
-  let lastCursor = { x: 0, y: 0 };
-  const ctx = canvas.getContext("2d");
-  const highlights = [];
-  const HIGHLIGHT_FADE_MS = 5000;
-
-  function drawOverlay(cursorX, cursorY) {
-    lastCursor.x = cursorX;
-    lastCursor.y = cursorY;
+  function draw() {
     if (!ctx || canvas.width === 0) return;
     ctx.clearRect(0, 0, canvas.width, canvas.height);
-    ctx.fillStyle = "rgba(0,0,0,0.3)";
-    ctx.beginPath();
-    ctx.arc(cursorX, cursorY, 8, 0, Math.PI * 2);
-    ctx.fill();
-    if (laserOn) {
-      ctx.strokeStyle = "#ff0000";
-      ctx.lineWidth = 2;
+    if (pointer) {
+      const x = pointer.x * canvas.width;
+      const y = pointer.y * canvas.height;
+      ctx.fillStyle = "rgba(0,0,0,0.3)";
       ctx.beginPath();
-      ctx.moveTo(cursorX, cursorY);
-      ctx.lineTo(cursorX, 0);
-      ctx.stroke();
+      ctx.arc(x, y, 8, 0, Math.PI * 2);
+      ctx.fill();
+      if (laser) {
+        ctx.strokeStyle = "#ff0000";
+        ctx.lineWidth = 2;
+        ctx.beginPath();
+        ctx.moveTo(x, y);
+        ctx.lineTo(x, 0);
+        ctx.stroke();
+      }
     }
     const now = Date.now();
     for (let i = highlights.length - 1; i >= 0; i--) {
@@ -863,64 +1088,166 @@ function initAgentOverlay() {
       const alpha = 0.4 * (1 - age / HIGHLIGHT_FADE_MS);
       ctx.strokeStyle = `rgba(255, 200, 0, ${alpha})`;
       ctx.lineWidth = 3;
-      ctx.strokeRect(h.x, h.y, h.w, h.h);
+      ctx.strokeRect(h.x * canvas.width, h.y * canvas.height, h.w * canvas.width, h.h * canvas.height);
     }
   }
 
-  function toCanvasCoords(e) {
-    const rect = canvas.getBoundingClientRect();
-    return {
-      x: ((e.clientX - rect.left) / rect.width) * canvas.width,
-      y: ((e.clientY - rect.top) / rect.height) * canvas.height
-    };
+  if (video) video.addEventListener("loadedmetadata", resizeCanvas);
+  window.addEventListener("resize", resizeCanvas);
+  resizeCanvas();
+
+  if (LaplaceVar._overlayInterval) clearInterval(LaplaceVar._overlayInterval);
+  LaplaceVar._overlayInterval = setInterval(() => {
+    if (highlights.length > 0) draw();
+  }, 200);
+
+  return {
+    // toNormalized maps a mouse event to 0..1 coordinates on the canvas
+    toNormalized(e) {
+      const rect = canvas.getBoundingClientRect();
+      if (!rect.width || !rect.height) return { x: 0, y: 0 };
+      return {
+        x: Math.min(1, Math.max(0, (e.clientX - rect.left) / rect.width)),
+        y: Math.min(1, Math.max(0, (e.clientY - rect.top) / rect.height))
+      };
+    },
+    pointer(x, y, laserOn) {
+      pointer = { x, y };
+      laser = !!laserOn;
+      draw();
+    },
+    highlight(r) {
+      highlights.push({ x: r.x, y: r.y, w: r.w, h: r.h, t: Date.now() });
+      draw();
+    }
+  };
+}
+
+function isGuidanceNumber(v) {
+  return typeof v === "number" && v >= 0 && v <= 1;
+}
+
+// sendGuidance sends a guidance event to the client over the signaling socket;
+// the server checks the viewer's role and rate-limits each type
+function sendGuidance(type, value) {
+  if (!LaplaceVar.socket || LaplaceVar.socket.readyState !== WebSocket.OPEN || !LaplaceVar.sessionID) return false;
+  LaplaceVar.socket.send(JSON.stringify({ Type: type, SessionID: LaplaceVar.sessionID, Value: JSON.stringify(value) }));
+  return true;
+}
+
+// handleGuidanceReply shows the client's answer to a click request, or a
+// notice that the server dropped guidance sent too quickly
+function handleGuidanceReply(jsonData) {
+  if (jsonData.Type === "requestClickResponse") {
+    const v = JSON.parse(jsonData.Value);
+    const pending = LaplaceVar.clickRequests && LaplaceVar.clickRequests[v.id];
+    if (!pending) return;
+    delete LaplaceVar.clickRequests[v.id];
+    showClientToast(v.accepted ? "Client accepted: " + pending : "Client declined: " + pending);
+  } else if (jsonData.Type === "guidanceRateLimited") {
+    if (jsonData.Value === "highlight") showClientToast("Too many highlights. Wait a moment and try again.");
+    else if (jsonData.Value === "requestClick") showClientToast("Too many click requests. Wait a few seconds and try again.");
+  }
+}
+
+function initAgentOverlay() {
+  const wrapper = document.getElementById("video-wrapper");
+  const video = document.getElementById("mainVideo");
+  const canvas = document.getElementById("agent-overlay");
+  const tools = document.getElementById("agent-tools");
+  const btnRequest = document.getElementById("btnRequestClick");
+  const btnHighlight = document.getElementById("btnHighlight");
+  const btnSnapshot = document.getElementById("btnSnapshot");
+  if (!wrapper || !canvas || LaplaceVar.agentOverlay) return;
+  if (tools) tools.style.display = "flex";
+
+  const overlay = createOverlay(canvas, video);
+  LaplaceVar.agentOverlay = overlay;
+  LaplaceVar.clickRequests = {};
+
+  let laserOn = false;
+  let highlightMode = false;
+  let highlightStart = null;
+  let pendingClickMessage = null;
+  let lastCursor = { x: 0, y: 0 };
+  let lastPointerSent = 0;
+
+  const onTools = (e) => tools && tools.contains(e.target);
+
+  function moveCursor(x, y) {
+    lastCursor = { x, y };
+    overlay.pointer(x, y, laserOn);
+    const now = Date.now();
+    if (now - lastPointerSent < GUIDANCE_POINTER_INTERVAL_MS) return;
+    lastPointerSent = now;
+    sendGuidance("pointer", { x, y, laser: laserOn });
   }
 
   wrapper.addEventListener("mousemove", (e) => {
-    const { x, y } = toCanvasCoords(e);
-    if (highlightStart) return;
-    drawOverlay(x, y);
+    if (highlightStart || onTools(e)) return;
+    const { x, y } = overlay.toNormalized(e);
+    moveCursor(x, y);
   });
 
   wrapper.addEventListener("mousedown", (e) => {
-    if (!highlightMode || e.button !== 0) return;
-    const { x, y } = toCanvasCoords(e);
-    highlightStart = { x, y };
+    if (!highlightMode || pendingClickMessage || e.button !== 0 || onTools(e)) return;
+    highlightStart = overlay.toNormalized(e);
   });
 
   wrapper.addEventListener("mouseup", (e) => {
     if (!highlightStart || e.button !== 0) return;
-    const { x, y } = toCanvasCoords(e);
-    const w = Math.abs(x - highlightStart.x);
-    const h = Math.abs(y - highlightStart.y);
-    if (w > 5 && h > 5) {
-      highlights.push({
-        x: Math.min(highlightStart.x, x),
-        y: Math.min(highlightStart.y, y),
-        w, h,
-        t: Date.now()
-      });
-    }
+    const { x, y } = overlay.toNormalized(e);
+    const rect = {
+      x: Math.min(highlightStart.x, x),
+      y: Math.min(highlightStart.y, y),
+      w: Math.abs(x - highlightStart.x),
+      h: Math.abs(y - highlightStart.y)
+    };
     highlightStart = null;
-    const rect = canvas.getBoundingClientRect();
-    const mx = (e.clientX - rect.left) / rect.width * canvas.width;
-    const my = (e.clientY - rect.top) / rect.height * canvas.height;
-    drawOverlay(mx, my);
+    const px = canvas.getBoundingClientRect();
+    if (rect.w * px.width > 5 && rect.h * px.height > 5) {
+      overlay.highlight(rect);
+      sendGuidance("highlight", rect);
+    }
+    moveCursor(x, y);
   });
 
-  if (LaplaceVar._overlayInterval) clearInterval(LaplaceVar._overlayInterval);
-  LaplaceVar._overlayInterval = setInterval(() => {
-    if (!ctx || canvas.width === 0) return;
-    if (highlights.length > 0) drawOverlay(lastCursor.x, lastCursor.y);
-  }, 200);
-
-  document.addEventListener("keydown", (e) => { if (e.key === "l" || e.key === "L") laserOn = true; });
-  document.addEventListener("keyup", (e) => { if (e.key === "l" || e.key === "L") laserOn = false; });
+  // After "Request click", the next click on the stream picks where the
+  // client is asked to click
+  wrapper.addEventListener("click", (e) => {
+    if (!pendingClickMessage || onTools(e)) return;
+    e.preventDefault();
+    const { x, y } = overlay.toNormalized(e);
+    const id = Date.now().toString(36) + Math.random().toString(36).slice(2, 8);
+    if (sendGuidance("requestClick", { id, message: pendingClickMessage, x, y })) {
+      LaplaceVar.clickRequests[id] = pendingClickMessage;
+      showClientToast("Click request sent. Waiting for the client…");
+    }
+    pendingClickMessage = null;
+    if (btnRequest) btnRequest.classList.remove("active");
+  }, true);
+
+  document.addEventListener("keydown", (e) => {
+    if ((e.key === "l" || e.key === "L") && !laserOn) {
+      laserOn = true;
+      lastPointerSent = 0;
+      moveCursor(lastCursor.x, lastCursor.y);
+    }
+  });
+  document.addEventListener("keyup", (e) => {
+    if (e.key === "l" || e.key === "L") {
+      laserOn = false;
+      lastPointerSent = 0;
+      moveCursor(lastCursor.x, lastCursor.y);
+    }
+  });
 
   if (btnRequest) btnRequest.onclick = () => {
     const msg = prompt("Message for client:", "Please click here");
-    if (msg && LaplaceVar.dataChannel) {
-      LaplaceVar.dataChannel.send("assistant:" + JSON.stringify({ type: "requestClick", message: msg }));
-    }
+    if (!msg) return;
+    pendingClickMessage = msg.slice(0, 200);
+    btnRequest.classList.add("active");
+    showClientToast("Click on the shared screen where the client should click.");
   };
 
   if (btnHighlight) {
@@ -930,6 +1257,66 @@ function initAgentOverlay() {
       btnHighlight.textContent = highlightMode ? "Highlight (on)" : "Highlight";
     };
   }
+
+  if (btnSnapshot) btnSnapshot.onclick = () => takeSnapshot(video);
+}
+
+// showGuidance draws the SRM's pointer and highlights over the client's own
+// preview of the shared screen
+function showGuidance(type, v) {
+  if (!LaplaceVar.clientOverlay) {
+    const canvas = document.getElementById("agent-overlay");
+    if (!canvas) return;
+    LaplaceVar.clientOverlay = createOverlay(canvas, document.getElementById("mainVideo"));
+  }
+  if (type === "pointer" && isGuidanceNumber(v.x) && isGuidanceNumber(v.y)) {
+    LaplaceVar.clientOverlay.pointer(v.x, v.y, v.laser === true);
+  } else if (type === "highlight" && [v.x, v.y, v.w, v.h].every(isGuidanceNumber)) {
+    LaplaceVar.clientOverlay.highlight(v);
+  }
+}
+
+// showClickRequest asks the client to click where the SRM pointed and sends
+// their answer back; an unanswered prompt counts as declined
+function showClickRequest(sessionID, v) {
+  if (typeof v.id !== "string" || typeof v.message !== "string") return;
+  if (isGuidanceNumber(v.x) && isGuidanceNumber(v.y)) showGuidance("pointer", { x: v.x, y: v.y });
+  const respond = (accepted) => {
+    if (!LaplaceVar.socket || LaplaceVar.socket.readyState !== WebSocket.OPEN) return;
+    LaplaceVar.socket.send(JSON.stringify({ Type: "requestClickResponse", SessionID: sessionID, Value: JSON.stringify({ id: v.id, accepted }) }));
+  };
+  showClientToast(v.message, [
+    { label: "OK", onClick: () => respond(true), primary: true },
+    { label: "Decline", onClick: () => respond(false) }
+  ], CLICK_REQUEST_TIMEOUT_MS, () => respond(false));
+}
+
+function takeSnapshot(video) {
+  if (!video || !video.srcObject || !video.srcObject.getVideoTracks().length || !video.videoWidth) return;
+  const canvas = document.createElement("canvas");
+  canvas.width = video.videoWidth;
+  canvas.height = video.videoHeight;
+  canvas.getContext("2d").drawImage(video, 0, 0);
+  const a = document.createElement("a");
+  a.href = canvas.toDataURL("image/png");
+  a.download = "orient-co-browse-snapshot-" + Date.now() + ".png";
+  a.click();
+  canvas.toBlob((blob) => uploadSnapshot(blob), "image/png");
+}
+
+// Attach the snapshot to the session as evidence (requires client consent)
+function uploadSnapshot(blob) {
+  if (!blob || !LaplaceVar.roomID) return;
+  fetch("/api/session/snapshot?sessionId=" + encodeURIComponent(LaplaceVar.roomID), {
+    method: "POST",
+    credentials: "same-origin",
+    headers: { "Content-Type": "image/png" },
+    body: blob,
+  })
+    .then((res) => {
+      if (!res.ok) return res.json().then((d) => alert("Snapshot not saved: " + (d.error || res.status)));
+    })
+    .catch(() => alert("Snapshot upload failed. Please try again."));
 }
 
 (function ensureAuth() {
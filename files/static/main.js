@@ -382,7 +382,6 @@ function initViewerView(roomID) {
   };
 
   document.getElementById("btn-fullscreen").onclick = () => toggleFullscreen(video);
-  document.getElementById("btn-snapshot").onclick = () => takeSnapshot(video);
 }
 
 function showViewerError(msg) {
@@ -464,18 +463,6 @@ function toggleFullscreen(video) {
   }
 }
 
-function takeSnapshot(video) {
-  if (!video.srcObject || !video.srcObject.getVideoTracks().length) return;
-  const canvas = document.createElement("canvas");
-  canvas.width = video.videoWidth;
-  canvas.height = video.videoHeight;
-  canvas.getContext("2d").drawImage(video, 0, 0);
-  const a = document.createElement("a");
-  a.href = canvas.toDataURL("image/png");
-  a.download = "orient-co-browse-snapshot-" + Date.now() + ".png";
-  a.click();
-}
-
 // ——— Leave ———
 
 function leaveRoom() {
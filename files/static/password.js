@@ -0,0 +1,55 @@
+"use strict";
+
+(function () {
+  const $ = (id) => document.getElementById(id);
+
+  function showError(msg) {
+    $("pwError").textContent = msg || "";
+    $("pwError").style.display = msg ? "" : "none";
+  }
+
+  async function load() {
+    const res = await fetch("/api/password", { credentials: "include" });
+    if (res.status === 401) { window.location.replace("/srm/login"); return; }
+    const d = await res.json();
+    const p = d.policy || {};
+    $("pwPolicy").textContent = "At least " + p.minLength + " characters, mixing " + p.minClasses +
+      " of lowercase, uppercase, digits and symbols. Common passwords and your last " + p.history + " passwords are not accepted.";
+    if (d.expired) {
+      $("pwStatus").textContent = "Your password has expired. Choose a new one to continue.";
+    } else if (d.mustChange) {
+      $("pwStatus").textContent = "You must choose a new password before continuing.";
+    } else if (d.expiresAt) {
+      $("pwStatus").textContent = "Your password expires on " + new Date(d.expiresAt).toLocaleDateString() + ".";
+    }
+  }
+
+  $("pwForm").addEventListener("submit", async (e) => {
+    e.preventDefault();
+    showError("");
+    const currentPassword = $("pwCurrent").value;
+    const newPassword = $("pwNew").value;
+    if (newPassword !== $("pwConfirm").value) {
+      showError("The new passwords do not match.");
+      return;
+    }
+    $("btnPw").disabled = true;
+    try {
+      const res = await fetch("/api/password", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ currentPassword, newPassword }),
+        credentials: "include",
+      });
+      const d = await res.json().catch(() => ({}));
+      if (!res.ok) throw new Error(d?.error || "Request failed");
+      window.location.replace(d.redirect || "/srm");
+    } catch (err) {
+      showError(err.message);
+    } finally {
+      $("btnPw").disabled = false;
+    }
+  });
+
+  load().catch((err) => showError(err.message));
+})();
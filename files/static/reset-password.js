@@ -0,0 +1,81 @@
+"use strict";
+
+(function () {
+  const $ = (id) => document.getElementById(id);
+  const token = new URLSearchParams(window.location.search).get("token");
+
+  function showError(msg) {
+    $("resetError").textContent = msg || "";
+    $("resetError").style.display = msg ? "" : "none";
+  }
+
+  async function post(url, body) {
+    const res = await fetch(url, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(body),
+      credentials: "include",
+    });
+    const d = await res.json().catch(() => ({}));
+    if (!res.ok) throw new Error(d?.error || "Request failed");
+    return d;
+  }
+
+  async function load() {
+    if (!token) {
+      $("resetStatus").textContent = "Enter your account email and we will send you a link to choose a new password.";
+      $("forgotForm").style.display = "";
+      return;
+    }
+    // Keep the token out of the address bar and history once read
+    window.history.replaceState(null, "", "/password/reset");
+    const res = await fetch("/api/password/reset?token=" + encodeURIComponent(token), { credentials: "include" });
+    const d = await res.json().catch(() => ({}));
+    if (!res.ok) {
+      showError(d?.error || "This reset link is invalid or has expired");
+      $("resetStatus").innerHTML = '<a href="/password/reset">Request a new link</a>';
+      return;
+    }
+    const p = d.policy || {};
+    $("resetStatus").textContent = "Choose a new password for " + d.email + ".";
+    $("resetPolicy").textContent = "At least " + p.minLength + " characters, mixing " + p.minClasses +
+      " of lowercase, uppercase, digits and symbols. Common passwords and your last " + p.history + " passwords are not accepted.";
+    $("resetForm").style.display = "";
+  }
+
+  $("forgotForm").addEventListener("submit", async (e) => {
+    e.preventDefault();
+    showError("");
+    $("btnForgot").disabled = true;
+    try {
+      const d = await post("/api/password/forgot", { email: $("forgotEmail").value });
+      $("forgotForm").style.display = "none";
+      $("resetStatus").textContent = d.message;
+    } catch (err) {
+      showError(err.message);
+    } finally {
+      $("btnForgot").disabled = false;
+    }
+  });
+
+  $("resetForm").addEventListener("submit", async (e) => {
+    e.preventDefault();
+    showError("");
+    const newPassword = $("resetNew").value;
+    if (newPassword !== $("resetConfirm").value) {
+      showError("The new passwords do not match.");
+      return;
+    }
+    $("btnReset").disabled = true;
+    try {
+      const d = await post("/api/password/reset", { token, newPassword });
+      window.location.replace(d.redirect || "/srm/login");
+    } catch (err) {
+      showError(err.message);
+    } finally {
+      $("btnReset").disabled = false;
+    }
+  });
+
+  load().catch((err) => showError(err.message));
+})();
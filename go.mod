@@ -3,6 +3,11 @@ module laplace
 go 1.16
 
 require (
+	github.com/at-wat/ebml-go v0.17.1
 	github.com/gorilla/websocket v1.4.2
-	golang.org/x/crypto v0.17.0
+	github.com/pion/rtcp v1.2.14
+	github.com/pion/rtp v1.8.7
+	github.com/pion/turn/v2 v2.1.6
+	github.com/pion/webrtc/v3 v3.3.6
+	golang.org/x/crypto v0.21.0
 )
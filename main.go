@@ -1,22 +1,18 @@
 package main
 
 import (
-	_ "embed"
+	"bufio"
 	"flag"
+	"fmt"
 	"laplace/core"
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 )
 
-//go:embed files/agent-login.html
-var agentLoginHTML []byte
-
-//go:embed files/admin-login.html
-var adminLoginHTML []byte
-
 // nocacheDevWrapper adds Cache-Control: no-store in dev mode to prevent stale HTML/JS.
 func nocacheDevWrapper(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -27,152 +23,177 @@ func nocacheDevWrapper(next http.Handler) http.Handler {
 	})
 }
 
-// Routing regression checklist (verify after changes):
-// - / opens SRM landing (via 302 redirect to /srm)
-// - /srm opens SRM landing (Welcome, Join session, SRM login)
-// - From /srm → Join session → /join
-// - On /join, logo/title "Orient Finance Co-Browse" → /srm (not /)
-// - Client Back/Home on join, connect → /srm
-// - SRM pages → /srm, Admin pages → /admin
-// - No route shows old advisor/landing at /
-
-func authMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		path := r.URL.Path
-		if path == "" {
-			path = "/"
-		}
-
-		// 0) /admin/login FIRST — must match before any other logic
-		if path == "/admin/login" || strings.HasPrefix(path, "/admin/login/") {
-			w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
-			w.Header().Set("Pragma", "no-cache")
-			w.Header().Set("Expires", "0")
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-			w.Write(adminLoginHTML)
-			return
-		}
-
-		authed := core.IsAuthenticated(r)
-
-		// 1) Redirect / → /srm (Option A: single landing at /srm)
-		if path == "/" {
-			http.Redirect(w, r, "/srm", http.StatusFound)
-			return
-		}
-
-		// 2) Redirect /agent/* → /srm/* (permanent)
-		if strings.HasPrefix(path, "/agent") {
-			srmPath := "/srm" + strings.TrimPrefix(path, "/agent")
-			if srmPath == "/srm" {
-				srmPath = "/srm"
-			}
-			http.Redirect(w, r, srmPath, http.StatusMovedPermanently)
-			return
-		}
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
 
-		// 3) SRM login page (public)
-		if path == "/srm/login" || strings.HasPrefix(path, "/srm/login/") {
-			w.Header().Set("Cache-Control", "no-store, no-cache")
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-			w.Write(agentLoginHTML)
-			return
+// hashPassword implements `laplace hash-password [password]`: it prints the
+// bcrypt hash for ADMIN_PASSWORD_HASH or AGENT_PASSWORD_HASH. The password is
+// read from stdin when not given, which keeps it out of shell history.
+func hashPassword(args []string) {
+	var pw string
+	if len(args) > 0 {
+		pw = args[0]
+	} else {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatalln("hash-password:", err)
 		}
+		pw = line
+	}
+	pw = strings.TrimSpace(pw)
+	if pw == "" {
+		log.Fatalln("hash-password: empty password")
+	}
+	h, err := core.HashPassword(pw)
+	if err != nil {
+		log.Fatalln("hash-password:", err)
+	}
+	fmt.Println(h)
+}
 
-		// 4) /api/auth-check and /api/health - never 404, handled before mux
-		if path == "/api/auth-check" {
-			core.ApiAuthCheck(w, r)
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "hash-password":
+			hashPassword(os.Args[2:])
 			return
-		}
-		if path == "/api/health" {
-			core.ApiHealth(w, r)
+		case "session-key":
+			// A new entry to prepend to SESSION_KEYS
+			fmt.Println(core.NewSessionKey())
 			return
 		}
+	}
+	addr := flag.String("addr", "0.0.0.0:443", "Listen address")
+	tls := flag.Bool("tls", true, "Use TLS")
+	certFile := flag.String("certFile", "files/server.crt", "TLS cert file")
+	keyFile := flag.String("keyFile", "files/server.key", "TLS key file")
+	dev := flag.Bool("dev", false, "Dev mode: Cache-Control no-store on all responses to prevent browser cache confusion")
+	brokerURL := flag.String("broker", os.Getenv("BROKER_URL"), "Signaling/state broker for multi-instance: memory or redis://[:password@]host:port[/db]")
+	turnAddr := flag.String("turn-addr", os.Getenv("TURN_ADDR"), "Embedded TURN/STUN UDP listen address, e.g. 0.0.0.0:3478 (empty = disabled)")
+	turnPublicIP := flag.String("turn-public-ip", os.Getenv("TURN_PUBLIC_IP"), "Public IP the embedded TURN server advertises for relays")
+	turnRealm := flag.String("turn-realm", "", "Embedded TURN realm")
+	turnAllowPeers := flag.String("turn-allow-peers", os.Getenv("TURN_ALLOW_PEERS"), "Comma-separated internal IPs or CIDRs the embedded TURN server may relay to (loopback, private and link-local peers are refused otherwise)")
+	recordingsDir := flag.String("recordings-dir", "recordings", "Directory for server-side session recordings")
+	snapshotsDir := flag.String("snapshots-dir", "snapshots", "Directory for evidence snapshots uploaded by viewers")
+	scannerURL := flag.String("scanner", os.Getenv("SCANNER_URL"), "Malware scanner for client uploads: clamd://host:port or clamd:///path/to/clamd.sock; fake (EICAR only, for tests) or none (store unscanned, development only). Unset refuses uploads")
+	blobStoreURL := flag.String("blob-store", os.Getenv("BLOB_STORE"), "Store for client document uploads: file://dir (empty = ./uploads) or s3://bucket[/prefix]?region=...&endpoint=...")
+	oidcIssuer := flag.String("oidc-issuer", os.Getenv("OIDC_ISSUER"), "OpenID Connect issuer URL for staff single sign-on (empty = disabled)")
+	oidcClientID := flag.String("oidc-client-id", os.Getenv("OIDC_CLIENT_ID"), "OIDC client ID")
+	oidcRedirectURL := flag.String("oidc-redirect-url", os.Getenv("OIDC_REDIRECT_URL"), "OIDC redirect URL, https://<host>/api/oidc/callback")
+	oidcRoleClaim := flag.String("oidc-role-claim", envOr("OIDC_ROLE_CLAIM", "groups"), "ID token claim holding group or role names")
+	oidcRoleMap := flag.String("oidc-role-map", os.Getenv("OIDC_ROLE_MAP"), "Claim value to role mapping, e.g. cobrowse-admins=admin,sales=srm")
+	oidcDefaultRole := flag.String("oidc-default-role", envOr("OIDC_DEFAULT_ROLE", "srm"), "Role for SSO users matching no mapping (empty = refuse them)")
+	oidcTrustMFA := flag.Bool("oidc-trust-mfa", os.Getenv("OIDC_TRUST_MFA") == "true", "Let roles that require 2FA sign in through SSO without an amr claim showing MFA (only if the IdP enforces MFA itself)")
+	mailURL := flag.String("mail", os.Getenv("MAIL_URL"), "Mailer for password reset links: smtp://[user:password@]host:port?from=address, or log or file:///path for development (empty = password reset by email is off)")
+	publicURL := flag.String("public-url", os.Getenv("PUBLIC_URL"), "External base URL for emailed links, e.g. https://cobrowse.example.com")
+	corsOrigins := flag.String("cors-origins", os.Getenv("CORS_ORIGINS"), "Comma-separated origins allowed to call the session API from a browser, e.g. https://crm.example.com")
+	trustedProxies := flag.String("trusted-proxies", os.Getenv("TRUSTED_PROXIES"), "Comma-separated IPs or CIDRs of reverse proxies whose X-Forwarded-For is trusted (empty = use the connection address)")
+	flag.Parse()
 
-		// Public routes (no auth). Note: / redirects to /srm above.
-		if path == "/join" ||
-			strings.HasPrefix(path, "/connect") ||
-			strings.HasPrefix(path, "/start") ||
-			strings.HasPrefix(path, "/room/") ||
-			strings.HasPrefix(path, "/static/") ||
-			strings.HasPrefix(path, "/api/") ||
-			path == "/ws/serve" || path == "/ws/connect" ||
-			path == "/logout" {
-			next.ServeHTTP(w, r)
-			return
-		}
+	proxies, err := core.ParseIPNets(*trustedProxies)
+	if err != nil {
+		log.Fatalln("trusted proxies:", err)
+	}
+	core.SetTrustedProxies(proxies)
 
-		// /stream.html: client (stream=1&room) = public, agent (id=) = protected
-		if path == "/stream.html" {
-			stream, room := r.URL.Query().Get("stream"), r.URL.Query().Get("room")
-			if stream == "1" && room != "" {
-				next.ServeHTTP(w, r)
-				return
-			}
-			if !authed {
-				log.Printf("[redirect] from=%s to=/srm/login authed=false pathname=%s", path, path)
-				http.Redirect(w, r, "/srm/login", http.StatusFound)
-				return
-			}
-			next.ServeHTTP(w, r)
-			return
+	if *brokerURL != "" {
+		b, err := core.NewBrokerFromURL(*brokerURL)
+		if err != nil {
+			log.Fatalln("broker:", err)
 		}
+		core.SetBroker(b)
+		log.Println("Broker enabled for multi-instance signaling")
+	}
 
-		// /srm, /srm/: landing when unauthed, dashboard when authed
-		if path == "/srm" || path == "/srm/" {
-			if !authed {
-				w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate")
-				w.Header().Set("Pragma", "no-cache")
-				http.ServeFile(w, r, "files/landing.html")
-				return
-			}
-			next.ServeHTTP(w, r)
-			return
-		}
-		// /srm/* (deeper), /viewer: require auth
-		if strings.HasPrefix(path, "/srm") || strings.HasPrefix(path, "/viewer") {
-			if !authed {
-				http.Redirect(w, r, "/srm/login", http.StatusFound)
-				return
-			}
-			next.ServeHTTP(w, r)
-			return
+	// Session cookie keys are only read from the environment to keep them out of ps
+	if raw := os.Getenv("SESSION_KEYS"); raw != "" {
+		keys, err := core.ParseSessionKeys(raw)
+		if err != nil {
+			log.Fatalln(err)
 		}
-
-		// Protect /admin (NOT /admin/login - handled above). Requires admin role.
-		if strings.HasPrefix(path, "/admin") {
-			if !authed {
-				http.Redirect(w, r, "/admin/login", http.StatusFound)
-				return
-			}
-			_, role, _ := core.GetSessionUser(r)
-			if role != core.RoleAdmin {
-				http.Redirect(w, r, "/srm", http.StatusFound)
-				return
-			}
-			next.ServeHTTP(w, r)
-			return
+		if !core.BrokerPersistent() {
+			log.Fatalln("SESSION_KEYS requires -broker redis://...: revoked logins are kept in the broker and would be forgotten on restart")
 		}
+		core.SetSessionKeys(keys)
+		log.Printf("Sealed session cookies enabled (%d keys)", len(keys))
+	}
 
-		next.ServeHTTP(w, r)
-	})
-}
-
-func main() {
-	addr := flag.String("addr", "0.0.0.0:443", "Listen address")
-	tls := flag.Bool("tls", true, "Use TLS")
-	certFile := flag.String("certFile", "files/server.crt", "TLS cert file")
-	keyFile := flag.String("keyFile", "files/server.key", "TLS key file")
-	dev := flag.Bool("dev", false, "Dev mode: Cache-Control no-store on all responses to prevent browser cache confusion")
-	flag.Parse()
+	mailer, err := core.NewMailerFromURL(*mailURL)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	// Links built from the request Host could be pointed at another site
+	if *publicURL == "" && !core.IsDevMailer(mailer) {
+		log.Fatalln("mail: -public-url (PUBLIC_URL) is required with an SMTP mailer")
+	}
+	switch {
+	case mailer == nil:
+		log.Println("mail: no -mail configured; password reset by email is off")
+	case core.IsDevMailer(mailer):
+		log.Printf("mail: WARNING: -mail %s writes working password reset links locally; use smtp:// in production", *mailURL)
+	}
+	core.SetMailer(mailer)
+	core.SetPublicURL(*publicURL)
+	core.SetAllowedOrigins(strings.Split(*corsOrigins, ","))
 
 	rand.Seed(time.Now().UnixNano())
 	core.SeedAdmin()
 	core.SeedDefaultAgent()
-	mux := core.GetHttp()
-	server := authMiddleware(mux)
+	core.SetRecordingDir(*recordingsDir)
+	core.SetSnapshotDir(*snapshotsDir)
+	// S3 credentials are only read from the environment to keep them out of ps
+	blobs, err := core.NewBlobStoreFromURL(*blobStoreURL, envOr("S3_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID")), envOr("S3_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	core.SetBlobStore(blobs)
+	scanner, err := core.NewScannerFromURL(*scannerURL)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if scanner == nil {
+		log.Println("[uploads] No malware scanner configured; client uploads are refused (set -scanner, or -scanner=none to store them unscanned in development)")
+	} else if core.IsNoopScanner(scanner) {
+		log.Println("[uploads] -scanner=none: client uploads are stored unscanned; do not use in production")
+	}
+	core.SetScanner(scanner)
+	if *oidcIssuer != "" {
+		roleMap, err := core.ParseRoleMap(*oidcRoleMap)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		// The client secret is only read from the environment to keep it out of ps
+		core.SetOIDC(&core.OIDCConfig{
+			Issuer:       *oidcIssuer,
+			ClientID:     *oidcClientID,
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:  *oidcRedirectURL,
+			RoleClaim:    *oidcRoleClaim,
+			RoleMap:      roleMap,
+			DefaultRole:  core.Role(*oidcDefaultRole),
+			TrustIdPMFA:  *oidcTrustMFA,
+		})
+		log.Println("OIDC single sign-on enabled:", *oidcIssuer)
+	}
+	core.StartRecordingJanitor()
+	if *turnAddr != "" {
+		allowPeers, err := core.ParseIPNets(*turnAllowPeers)
+		if err != nil {
+			log.Fatalln("turn allowed peers:", err)
+		}
+		ts, err := core.StartTurnServer(core.TurnConfig{ListenAddr: *turnAddr, PublicIP: *turnPublicIP, Realm: *turnRealm, AllowedPeers: allowPeers})
+		if err != nil {
+			log.Fatalln("turn:", err)
+		}
+		defer ts.Close()
+	}
+	// Routes, access rules and cache policy: see core.Routes()
+	var server http.Handler = core.GetHttp()
 	if *dev {
 		server = nocacheDevWrapper(server)
 	}